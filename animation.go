@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+
+	"github.com/disintegration/imaging"
+)
+
+// Animated GIF photos keep their animation in the "fit" derivatives,
+// which are GIFs resized frame by frame. Thumbnails, WebP versions and
+// the placeholders are made from a single poster frame chosen by the owner.
+
+// Returns the frames of an animated GIF, or nil if the image is not
+// an animated GIF.
+func DecodeAnimation(format string, data []byte) (*gif.GIF, error) {
+	if format != "gif" {
+		return nil, nil
+	}
+
+	// DecodeAll keeps every frame in memory, so the frames are counted
+	// and the size checked before.
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	frames, err := CountGifFrames(data)
+	if err != nil {
+		return nil, err
+	}
+	if frames < 2 {
+		return nil, nil
+	}
+
+	err = CheckAnimationSize(frames, config.Width, config.Height)
+	if err != nil {
+		return nil, err
+	}
+
+	return gif.DecodeAll(bytes.NewReader(data))
+}
+
+// Counts the frames of a GIF by walking its blocks, without decoding
+// the image data.
+func CountGifFrames(data []byte) (int, error) {
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return 0, fmt.Errorf("Invalid GIF")
+	}
+
+	// Header and logical screen descriptor, then the global color table.
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+
+	// Skips a sequence of data sub-blocks, ended by an empty one.
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return fmt.Errorf("Invalid GIF: unexpected end of data")
+			}
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+
+	frames := 0
+	for {
+		if pos >= len(data) {
+			// A missing trailer is left to DecodeAll.
+			return frames, nil
+		}
+
+		switch data[pos] {
+		case 0x21: // extension
+			pos += 2
+			if err := skipSubBlocks(); err != nil {
+				return frames, err
+			}
+
+		case 0x2c: // image descriptor
+			if pos+10 > len(data) {
+				return frames, fmt.Errorf("Invalid GIF: unexpected end of data")
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// LZW minimum code size, then the image data.
+			pos++
+			if err := skipSubBlocks(); err != nil {
+				return frames, err
+			}
+			frames++
+
+		case 0x3b: // trailer
+			return frames, nil
+
+		default:
+			return frames, fmt.Errorf("Invalid GIF: unknown block 0x%02x", data[pos])
+		}
+	}
+}
+
+// Calls fn with every frame of the animation drawn over the previous ones,
+// as the frames are shown. The frame passed to fn is reused between calls.
+func AnimationFrames(g *gif.GIF, fn func(i int, frame *image.NRGBA) error) error {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+
+	canvas := image.NewNRGBA(bounds)
+	var previous *image.NRGBA
+
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		err := fn(i, canvas)
+		if err != nil {
+			return err
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			draw.Draw(canvas, bounds, previous, bounds.Min, draw.Src)
+		}
+	}
+	return nil
+}
+
+// Returns a copy of the given frame as it is shown. Frame numbers out
+// of range give the first frame.
+func AnimationFrame(g *gif.GIF, index int) *image.NRGBA {
+	if index < 0 || index >= len(g.Image) {
+		index = 0
+	}
+
+	var result *image.NRGBA
+	AnimationFrames(g, func(i int, frame *image.NRGBA) error {
+		if i == index {
+			result = imaging.Clone(frame)
+		}
+		return nil
+	})
+	return result
+}
+
+// Resizes every frame of the animation. Timing and loop count are kept.
+// The frames are stored whole, each one replacing the previous one.
+func ResizeAnimation(g *gif.GIF, sz ResizeMode) *gif.GIF {
+	result := &gif.GIF{
+		Image:     make([]*image.Paletted, 0, len(g.Image)),
+		Delay:     g.Delay,
+		Disposal:  make([]byte, 0, len(g.Image)),
+		LoopCount: g.LoopCount,
+	}
+
+	AnimationFrames(g, func(i int, frame *image.NRGBA) error {
+		dst := Resize(frame, sz)
+
+		// The palette of the original frame fits the resized one too,
+		// it only needs a transparent color for the transparent pixels.
+		p := animationPalette(g.Image[i].Palette)
+		paletted := image.NewPaletted(dst.Bounds(), p)
+		draw.FloydSteinberg.Draw(paletted, dst.Bounds(), dst, dst.Bounds().Min)
+
+		result.Image = append(result.Image, paletted)
+		result.Disposal = append(result.Disposal, gif.DisposalBackground)
+		return nil
+	})
+
+	b := result.Image[0].Bounds()
+	result.Config = image.Config{Width: b.Dx(), Height: b.Dy()}
+	return result
+}
+
+func animationPalette(p color.Palette) color.Palette {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	if len(p) < 256 {
+		return append(append(color.Palette{}, p...), color.Transparent)
+	}
+	result := append(color.Palette{}, p...)
+	result[len(result)-1] = color.Transparent
+	return result
+}
+
+func EncodeAnimation(g *gif.GIF) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, g)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
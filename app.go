@@ -0,0 +1,16 @@
+package main
+
+import (
+	"html/template"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Everything the web handlers depend on. RunWeb makes one with the
+// database stores; NewMemoryStores gives one that needs no database.
+type App struct {
+	Stores
+
+	Tp *template.Template
+	Sc *securecookie.SecureCookie
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Placeholders shown while photos load: a BlurHash (https://blurha.sh),
+// decoded by quiet.js, and the dominant color as the background.
+// Both are computed from a small copy of the photo.
+const placeholderSourceSize = 32
+
+// Named colors photos can be searched by. Every photo gets the name
+// of its dominant color.
+var PhotoColors = []string{
+	"red", "orange", "yellow", "green", "teal", "blue",
+	"purple", "pink", "brown", "black", "gray", "white",
+}
+
+func IsPhotoColor(name string) bool {
+	for _, c := range PhotoColors {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the BlurHash, the dominant color as "#rrggbb" and its name.
+func ComputePhotoPlaceholder(img image.Image) (string, string, string) {
+	small := imaging.Resize(img, placeholderSourceSize, placeholderSourceSize, imaging.Box)
+
+	// More components along the longer side.
+	xComp, yComp := 4, 3
+	if b := img.Bounds(); b.Dy() > b.Dx() {
+		xComp, yComp = 3, 4
+	}
+	hash := EncodeBlurHash(small, xComp, yComp)
+
+	r, g, b := DominantColor(small)
+	return hash, fmt.Sprintf("#%02x%02x%02x", r, g, b), ColorName(r, g, b)
+}
+
+// Returns the average of the most common group of similar colors.
+// Transparent pixels are skipped.
+func DominantColor(img *image.NRGBA) (uint8, uint8, uint8) {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	var buckets [4096]bucket
+	best := -1
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			r, g, b, a := img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]
+			if a < 128 {
+				continue
+			}
+
+			k := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+			buckets[k].count++
+			buckets[k].r += int(r)
+			buckets[k].g += int(g)
+			buckets[k].b += int(b)
+
+			if best < 0 || buckets[k].count > buckets[best].count {
+				best = k
+			}
+		}
+	}
+
+	if best < 0 {
+		return 255, 255, 255
+	}
+	c := buckets[best]
+	return uint8(c.r / c.count), uint8(c.g / c.count), uint8(c.b / c.count)
+}
+
+// Returns the name of the color from PhotoColors closest to the given one.
+func ColorName(r, g, b uint8) string {
+	h, s, l := rgbToHsl(r, g, b)
+
+	switch {
+	case l < 0.15:
+		return "black"
+	case l > 0.9:
+		return "white"
+	case s < 0.15:
+		return "gray"
+	}
+
+	switch {
+	case h < 15 || h >= 345:
+		return "red"
+	case h < 45:
+		if l < 0.4 {
+			return "brown"
+		}
+		return "orange"
+	case h < 70:
+		return "yellow"
+	case h < 160:
+		return "green"
+	case h < 200:
+		return "teal"
+	case h < 260:
+		return "blue"
+	case h < 290:
+		return "purple"
+	}
+	return "pink"
+}
+
+// Hue in degrees, saturation and lightness in 0-1.
+func rgbToHsl(r8, g8, b8 uint8) (float64, float64, float64) {
+	r, g, b := float64(r8)/255, float64(g8)/255, float64(b8)/255
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	l := (max + min) / 2
+
+	if max == min {
+		return 0, 0, l
+	}
+
+	d := max - min
+	s := d / (1 - math.Abs(2*l-1))
+
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/d, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h, s, l
+}
+
+const blurHashChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Encodes the image as a BlurHash with the given number of components,
+// 1-9 on each axis.
+func EncodeBlurHash(img *image.NRGBA, xComp, yComp int) string {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	factors := make([][3]float64, 0, xComp*yComp)
+	for j := 0; j < yComp; j++ {
+		for i := 0; i < xComp; i++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) *
+						math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := img.PixOffset(bounds.Min.X+x, bounds.Min.Y+y)
+					f[0] += basis * srgbToLinear(img.Pix[p])
+					f[1] += basis * srgbToLinear(img.Pix[p+1])
+					f[2] += basis * srgbToLinear(img.Pix[p+2])
+				}
+			}
+
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encodeBase83((xComp-1)+(yComp-1)*9, 1))
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	sb.WriteString(encodeBase83(linearToSrgb(dc[0])<<16|linearToSrgb(dc[1])<<8|linearToSrgb(dc[2]), 4))
+
+	for _, f := range factors[1:] {
+		var q [3]int
+		for k, v := range f {
+			q[k] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encodeBase83(q[0]*19*19+q[1]*19+q[2], 2))
+	}
+
+	return sb.String()
+}
+
+func encodeBase83(value int, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = blurHashChars[value%83]
+		value /= 83
+	}
+	return string(b)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
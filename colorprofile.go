@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Photos with an embedded ICC profile other than sRGB, like Adobe RGB or
+// Display P3 from cameras and phones, are converted to sRGB when decoded.
+// Browsers show untagged images as sRGB, so the derivatives need no profile.
+// Only matrix/TRC RGB profiles are supported, which covers the profiles
+// of cameras and phones. Photos with other profiles are used as they are.
+
+// Whether the derivatives keep the wide-gamut profiles of the originals
+// instead of being converted to sRGB. Set by COLOR_PROFILES=keep.
+// WebP derivatives are converted in any case, as they are encoded
+// without a profile.
+func KeepColorProfiles() bool {
+	return os.Getenv("COLOR_PROFILES") == "keep"
+}
+
+// Compressed iCCP chunks can inflate to any size, larger profiles are
+// rejected. Real ones are a few kilobytes, rarely over a megabyte.
+const MaxColorProfileSize = 4 * 1024 * 1024
+
+type ColorProfile struct {
+	// The ICC profile as embedded in the image.
+	Data []byte
+
+	// RGB to XYZ (D50) of the linear colors, and the tone curves
+	// turning the channel values into linear ones.
+	matrix [3][3]float64
+	curves [3]func(float64) float64
+}
+
+// XYZ (D50) to linear sRGB, with the Bradford adaptation from D65.
+var xyzToSrgb = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// Linear sRGB to XYZ (D50), for telling sRGB profiles.
+var srgbToXyz = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+func srgbCurve(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// Returns the color profile embedded in a JPEG, PNG or WebP file,
+// or nil if there is none or it is not supported.
+func ReadColorProfile(data []byte) (*ColorProfile, error) {
+	var icc []byte
+	var err error
+
+	switch {
+	case len(data) > 2 && data[0] == 0xFF && data[1] == 0xD8:
+		icc = jpegIccProfile(data)
+	case len(data) > 8 && string(data[1:4]) == "PNG":
+		icc, err = pngIccProfile(data)
+	case len(data) > 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		icc = webpIccProfile(data)
+	}
+	if err != nil || icc == nil {
+		return nil, err
+	}
+	return ParseColorProfile(icc)
+}
+
+// Parses an ICC profile. Returns nil for the profiles that are not
+// supported.
+func ParseColorProfile(icc []byte) (*ColorProfile, error) {
+	if len(icc) < 132 || string(icc[36:40]) != "acsp" {
+		return nil, fmt.Errorf("Invalid ICC profile")
+	}
+	if string(icc[16:20]) != "RGB " || string(icc[20:24]) != "XYZ " {
+		return nil, nil
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(icc[128:]))
+	for i := 0; i < count; i++ {
+		e := 132 + i*12
+		if e+12 > len(icc) {
+			return nil, fmt.Errorf("Invalid ICC profile")
+		}
+		offset := int(binary.BigEndian.Uint32(icc[e+4:]))
+		size := int(binary.BigEndian.Uint32(icc[e+8:]))
+		if offset < 0 || size < 0 || offset+size > len(icc) || offset+size < offset {
+			return nil, fmt.Errorf("Invalid ICC profile")
+		}
+		tags[string(icc[e:e+4])] = icc[offset : offset+size]
+	}
+
+	p := &ColorProfile{Data: icc}
+
+	for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := tags[name]
+		if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+			return nil, nil
+		}
+		for j := 0; j < 3; j++ {
+			p.matrix[j][i] = s15Fixed16(tag[8+j*4:])
+		}
+	}
+
+	for i, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseToneCurve(tags[name])
+		if err != nil || curve == nil {
+			return nil, err
+		}
+		p.curves[i] = curve
+	}
+
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// Parses a "curv" or "para" tag. Returns nil for other tags.
+func parseToneCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, nil
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if len(tag) < 12+n*2 {
+			return nil, fmt.Errorf("Invalid ICC profile")
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+		}
+		return func(v float64) float64 {
+			x := v * float64(n-1)
+			i := int(x)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(x-float64(i))
+		}, nil
+
+	case "para":
+		paramsCounts := []int{1, 3, 4, 5, 7}
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		if kind >= len(paramsCounts) || len(tag) < 12+paramsCounts[kind]*4 {
+			return nil, fmt.Errorf("Invalid ICC profile")
+		}
+		// Missing parameters give the simpler functions.
+		g, a, b, c, d, e, f := 1.0, 1.0, 0.0, 0.0, 0.0, 0.0, 0.0
+		for i, ptr := range []*float64{&g, &a, &b, &c, &d, &e, &f}[:paramsCounts[kind]] {
+			*ptr = s15Fixed16(tag[12+i*4:])
+		}
+		switch kind {
+		case 1:
+			d = -b / a
+		case 2:
+			d = -b / a
+			e, f = c, c
+			c = 0
+		}
+		return func(v float64) float64 {
+			if v >= d {
+				return math.Pow(math.Max(a*v+b, 0), g) + e
+			}
+			return c*v + f
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// Whether the profile gives the same colors as sRGB.
+func (p *ColorProfile) IsSRGB() bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if math.Abs(p.matrix[i][j]-srgbToXyz[i][j]) > 0.01 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for v := 0.0; v <= 1; v += 0.125 {
+			if math.Abs(curve(v)-srgbCurve(v)) > 0.005 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Converts an image with this profile to sRGB. Colors out of the sRGB
+// gamut are clipped.
+func (p *ColorProfile) ToSRGB(img image.Image) *image.NRGBA {
+	// Channel values to linear colors.
+	var in [3][256]float64
+	for c := 0; c < 3; c++ {
+		for v := 0; v < 256; v++ {
+			in[c][v] = p.curves[c](float64(v) / 255)
+		}
+	}
+
+	// Linear colors to sRGB values.
+	const outSize = 4096
+	var out [outSize + 1]uint8
+	for i := range out {
+		out[i] = uint8(linearToSrgb(float64(i) / outSize))
+	}
+
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzToSrgb[i][k] * p.matrix[k][j]
+			}
+		}
+	}
+
+	dst := imaging.Clone(img)
+	for i := 0; i+3 < len(dst.Pix); i += 4 {
+		r := in[0][dst.Pix[i]]
+		g := in[1][dst.Pix[i+1]]
+		b := in[2][dst.Pix[i+2]]
+		for c := 0; c < 3; c++ {
+			v := m[c][0]*r + m[c][1]*g + m[c][2]*b
+			dst.Pix[i+c] = out[int(math.Max(0, math.Min(1, v))*outSize+0.5)]
+		}
+	}
+	return dst
+}
+
+var jpegIccHeader = []byte("ICC_PROFILE\x00")
+
+// Returns the ICC profile from the APP2 segments of a JPEG file,
+// where it may be split into several chunks.
+func jpegIccProfile(data []byte) []byte {
+	chunks := make(map[int][]byte)
+	total := 0
+
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		if marker == 0xDA {
+			break
+		}
+		if marker == 0xFF || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2
+			continue
+		}
+
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			break
+		}
+		payload := data[pos+4 : end]
+
+		if marker == 0xE2 && bytes.HasPrefix(payload, jpegIccHeader) && len(payload) > len(jpegIccHeader)+2 {
+			seq := int(payload[len(jpegIccHeader)])
+			total = int(payload[len(jpegIccHeader)+1])
+			chunks[seq] = payload[len(jpegIccHeader)+2:]
+		}
+		pos = end
+	}
+
+	if total == 0 {
+		return nil
+	}
+	var icc []byte
+	for seq := 1; seq <= total; seq++ {
+		chunk, ok := chunks[seq]
+		if !ok {
+			return nil
+		}
+		icc = append(icc, chunk...)
+	}
+	return icc
+}
+
+// Returns the ICC profile from the iCCP chunk of a PNG file.
+func pngIccProfile(data []byte) ([]byte, error) {
+	pos := 8
+	for pos+12 <= len(data) {
+		end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+		if end > len(data) || end < pos {
+			break
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "iCCP":
+			chunk := data[pos+8 : end-4]
+			i := bytes.IndexByte(chunk, 0)
+			if i < 0 || i+2 > len(chunk) {
+				return nil, fmt.Errorf("Invalid PNG iCCP chunk")
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(chunk[i+2:]))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			icc, err := ioutil.ReadAll(io.LimitReader(zr, MaxColorProfileSize+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(icc) > MaxColorProfileSize {
+				return nil, fmt.Errorf("PNG color profile too large")
+			}
+			return icc, nil
+		case "IDAT":
+			return nil, nil
+		}
+		pos = end
+	}
+	return nil, nil
+}
+
+// Returns the ICC profile from the ICCP chunk of a WebP file.
+func webpIccProfile(data []byte) []byte {
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size
+		if end > len(data) || end < pos {
+			break
+		}
+		if string(data[pos:pos+4]) == "ICCP" {
+			return data[pos+8 : end]
+		}
+		pos = end + size%2
+	}
+	return nil
+}
+
+// Embeds the profile in an encoded JPEG or PNG image. Other formats
+// are returned as they are.
+func EmbedColorProfile(data []byte, ext string, p *ColorProfile) ([]byte, error) {
+	switch strings.ToLower(ext) {
+	case "jpg", "jpeg":
+		return embedJpegIccProfile(data, p.Data)
+	case "png":
+		return embedPngIccProfile(data, p.Data)
+	}
+	return data, nil
+}
+
+// Inserts APP2 segments with the profile after the start of the image.
+func embedJpegIccProfile(data []byte, icc []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, fmt.Errorf("Invalid JPEG file")
+	}
+
+	const chunkSize = 65535 - 2 - 14
+	total := (len(icc) + chunkSize - 1) / chunkSize
+	if total > 255 {
+		return nil, fmt.Errorf("ICC profile is too large: %d bytes", len(icc))
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+len(icc)+total*18))
+	out.Write(data[:2])
+	for i := 0; i < total; i++ {
+		chunk := icc[i*chunkSize:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		payload := append(append([]byte{}, jpegIccHeader...), byte(i+1), byte(total))
+		writeJpegSegment(out, 0xE2, append(payload, chunk...))
+	}
+	out.Write(data[2:])
+	return out.Bytes(), nil
+}
+
+// Inserts an iCCP chunk after the IHDR chunk, which is always the first.
+func embedPngIccProfile(data []byte, icc []byte) ([]byte, error) {
+	const ihdrEnd = 8 + 12 + 13
+	if len(data) < ihdrEnd || string(data[1:4]) != "PNG" || string(data[12:16]) != "IHDR" {
+		return nil, fmt.Errorf("Invalid PNG file")
+	}
+
+	var chunk bytes.Buffer
+	chunk.WriteString("iCCP")
+	chunk.WriteString("ICC profile\x00\x00")
+	zw := zlib.NewWriter(&chunk)
+	zw.Write(icc)
+	err := zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)+chunk.Len()+8))
+	out.Write(data[:ihdrEnd])
+	binary.Write(out, binary.BigEndian, uint32(chunk.Len()-4))
+	out.Write(chunk.Bytes())
+	binary.Write(out, binary.BigEndian, crc32.ChecksumIEEE(chunk.Bytes()))
+	out.Write(data[ihdrEnd:])
+	return out.Bytes(), nil
+}
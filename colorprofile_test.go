@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+// The profiles in testdata are matrix/TRC profiles with the published
+// colorants and tone curves of Adobe RGB (1998), Display P3 and sRGB.
+// adobergb.jpg and displayp3.png are 16x16 images filled with
+// testColor and tagged with these profiles, the JPEG with its profile
+// split into two APP2 segments.
+
+var testColor = color.NRGBA{200, 100, 50, 255}
+
+// Linear RGB of the profiles to linear sRGB, both with the D65 white point,
+// as published for the color spaces. They don't go through the D50 XYZ
+// of the profiles, unlike ToSRGB.
+var (
+	adobeRgbToSrgb = [3][3]float64{
+		{1.3983557, -0.3983557, 0},
+		{0, 1, 0},
+		{0, -0.0429289, 1.0429289},
+	}
+	displayP3ToSrgb = [3][3]float64{
+		{1.2249401, -0.2249404, 0},
+		{-0.0420569, 1.0420571, 0},
+		{-0.0196376, -0.0786361, 1.0982735},
+	}
+)
+
+func readTestFile(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readTestProfile(t *testing.T, name string) *ColorProfile {
+	p, err := ParseColorProfile(readTestFile(t, name))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if p == nil {
+		t.Fatalf("%s: profile not supported", name)
+	}
+	return p
+}
+
+// Converts a color with the given tone curve and matrix to sRGB.
+func referenceSrgb(c color.NRGBA, curve func(float64) float64, m [3][3]float64) color.NRGBA {
+	in := []float64{
+		curve(float64(c.R) / 255),
+		curve(float64(c.G) / 255),
+		curve(float64(c.B) / 255),
+	}
+	var out [3]uint8
+	for i := 0; i < 3; i++ {
+		v := m[i][0]*in[0] + m[i][1]*in[1] + m[i][2]*in[2]
+		out[i] = uint8(linearToSrgb(math.Max(0, math.Min(1, v))))
+	}
+	return color.NRGBA{out[0], out[1], out[2], c.A}
+}
+
+func adobeRgbCurve(v float64) float64 {
+	return math.Pow(v, 563.0/256)
+}
+
+func checkColor(t *testing.T, name string, got color.Color, want color.NRGBA, tolerance int) {
+	t.Helper()
+	c := color.NRGBAModel.Convert(got).(color.NRGBA)
+	for _, d := range []int{
+		int(c.R) - int(want.R),
+		int(c.G) - int(want.G),
+		int(c.B) - int(want.B),
+	} {
+		if d < -tolerance || d > tolerance {
+			t.Errorf("%s: got %v, want %v", name, c, want)
+			return
+		}
+	}
+}
+
+func solidImage(c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestParseColorProfile(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		srgb bool
+	}{
+		{"AdobeRGB1998.icc", false},
+		{"DisplayP3.icc", false},
+		{"sRGB.icc", true},
+	} {
+		p := readTestProfile(t, test.name)
+		if p.IsSRGB() != test.srgb {
+			t.Errorf("%s: IsSRGB() = %v, want %v", test.name, p.IsSRGB(), test.srgb)
+		}
+	}
+
+	_, err := ParseColorProfile([]byte("not a profile"))
+	if err == nil {
+		t.Error("invalid profile: no error")
+	}
+}
+
+func TestToSRGB(t *testing.T) {
+	colors := []color.NRGBA{
+		testColor,
+		{128, 128, 128, 255},
+		{255, 255, 255, 255},
+		{0, 0, 0, 255},
+		{255, 0, 0, 255},
+		{30, 200, 120, 128},
+	}
+
+	for _, test := range []struct {
+		name   string
+		curve  func(float64) float64
+		matrix [3][3]float64
+	}{
+		{"AdobeRGB1998.icc", adobeRgbCurve, adobeRgbToSrgb},
+		{"DisplayP3.icc", srgbCurve, displayP3ToSrgb},
+	} {
+		p := readTestProfile(t, test.name)
+		for _, c := range colors {
+			got := p.ToSRGB(solidImage(c)).At(0, 0)
+			checkColor(t, test.name, got, referenceSrgb(c, test.curve, test.matrix), 1)
+		}
+	}
+}
+
+func TestJpegIccProfile(t *testing.T) {
+	data := readTestFile(t, "adobergb.jpg")
+	icc := jpegIccProfile(data)
+	if !bytes.Equal(icc, readTestFile(t, "AdobeRGB1998.icc")) {
+		t.Fatalf("got a profile of %d bytes, want the one of AdobeRGB1998.icc", len(icc))
+	}
+
+	// A missing segment makes the profile unusable.
+	pos := bytes.Index(data, jpegIccHeader) - 4
+	size := int(data[pos+2])<<8 | int(data[pos+3])
+	truncated := append(append([]byte{}, data[:pos]...), data[pos+2+size:]...)
+	if icc := jpegIccProfile(truncated); icc != nil {
+		t.Errorf("missing segment: got a profile of %d bytes", len(icc))
+	}
+}
+
+func TestDecodeImageProfile(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		want      color.NRGBA
+		tolerance int
+	}{
+		{"adobergb.jpg", referenceSrgb(testColor, adobeRgbCurve, adobeRgbToSrgb), 3},
+		{"displayp3.png", referenceSrgb(testColor, srgbCurve, displayP3ToSrgb), 1},
+	} {
+		img, err := DecodeImage(readTestFile(t, test.name))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		checkColor(t, test.name, img.At(8, 8), test.want, test.tolerance)
+	}
+}
+
+func TestEmbedColorProfile(t *testing.T) {
+	img := solidImage(testColor)
+
+	var jpegData bytes.Buffer
+	err := jpeg.Encode(&jpegData, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pngData bytes.Buffer
+	err = png.Encode(&pngData, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Over 64 KB, so that the JPEG needs several APP2 segments.
+	large := &ColorProfile{Data: bytes.Repeat(readTestFile(t, "DisplayP3.icc"), 300)}
+
+	for _, test := range []struct {
+		ext     string
+		data    []byte
+		profile *ColorProfile
+	}{
+		{"jpg", jpegData.Bytes(), readTestProfile(t, "AdobeRGB1998.icc")},
+		{"jpg", jpegData.Bytes(), large},
+		{"png", pngData.Bytes(), readTestProfile(t, "DisplayP3.icc")},
+		{"png", pngData.Bytes(), large},
+	} {
+		data, err := EmbedColorProfile(test.data, test.ext, test.profile)
+		if err != nil {
+			t.Fatalf("%s: %v", test.ext, err)
+		}
+
+		var icc []byte
+		if test.ext == "jpg" {
+			icc = jpegIccProfile(data)
+		} else {
+			icc, err = pngIccProfile(data)
+			if err != nil {
+				t.Fatalf("%s: %v", test.ext, err)
+			}
+		}
+		if !bytes.Equal(icc, test.profile.Data) {
+			t.Errorf("%s: got a profile of %d bytes, want %d bytes", test.ext, len(icc), len(test.profile.Data))
+		}
+
+		// The image itself is unchanged.
+		decoded, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", test.ext, err)
+		}
+		checkColor(t, test.ext, decoded.At(8, 8), testColor, 2)
+	}
+}
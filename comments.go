@@ -25,7 +25,13 @@ func CreateComment(userId int64, photoId int64, comment string) (*Comment, error
 		Tm:      time.Now(),
 	}
 
-	err := Db.QueryRow(
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
 		`
 		INSERT INTO comments(user_id, photo_id, comment, tm) 
 		VALUES ($1, $2, $3, $4)
@@ -34,6 +40,16 @@ func CreateComment(userId int64, photoId int64, comment string) (*Comment, error
 		cmt.UserId, cmt.PhotoId, cmt.Comment, cmt.Tm,
 	).Scan(&cmt.Id)
 
+	if err != nil {
+		return nil, err
+	}
+
+	err = addPhotoCommentsCount(tx, cmt.PhotoId, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
@@ -85,6 +101,7 @@ func GetCommentsByPhotoId(photoId int64) ([]*Comment, error) {
 	if err != nil {
 		return []*Comment{}, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		cmt := &Comment{}
@@ -107,6 +124,23 @@ func GetCommentsByPhotoId(photoId int64) ([]*Comment, error) {
 }
 
 func DelCommentById(id int64) error {
-	_, err := Db.Exec(`DELETE FROM comments WHERE id = $1`, id)
-	return err
+	tx, err := Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var photoId int64
+	err = tx.QueryRow(`DELETE FROM comments WHERE id = $1 RETURNING photo_id`, id).Scan(&photoId)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = addPhotoCommentsCount(tx, photoId, -1)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
@@ -85,6 +85,7 @@ func GetContactsByUserId(id int64) ([]*Contact, error) {
 	if err != nil {
 		return []*Contact{}, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		contact := &Contact{}
@@ -8,17 +8,15 @@ import (
 	"github.com/gorilla/securecookie"
 )
 
-var Sc *securecookie.SecureCookie
-
-func init() {
-	Sc = securecookie.New(
+func NewSecureCookie() *securecookie.SecureCookie {
+	return securecookie.New(
 		[]byte("6fbbd7p95oe8ut5qrttebiwar88s74do"),
 		[]byte("nnl9x8lipmar2rysjl0p0f5p9u8nz7lc"),
 	)
 }
 
-func SetSecureCookie(w http.ResponseWriter, name, value string) {
-	if encoded, err := Sc.Encode(name, value); err == nil {
+func (app *App) SetSecureCookie(w http.ResponseWriter, name, value string) {
+	if encoded, err := app.Sc.Encode(name, value); err == nil {
 		http.SetCookie(w, &http.Cookie{
 			Name:  name,
 			Value: encoded,
@@ -27,28 +25,28 @@ func SetSecureCookie(w http.ResponseWriter, name, value string) {
 	}
 }
 
-func GetSecureCookie(r *http.Request, name string) (string, error) {
+func (app *App) GetSecureCookie(r *http.Request, name string) (string, error) {
 	if cookie, err := r.Cookie(name); err == nil {
 		var value string
-		if err = Sc.Decode(name, cookie.Value, &value); err == nil {
+		if err = app.Sc.Decode(name, cookie.Value, &value); err == nil {
 			return value, nil
 		}
 	}
 	return "", fmt.Errorf("No such cookie: %s", name)
 }
 
-func SetCurrentUser(w http.ResponseWriter, user *User) {
+func (app *App) SetCurrentUser(w http.ResponseWriter, user *User) {
 	userIdStr := strconv.FormatInt(user.Id, 10)
-	SetSecureCookie(w, "user", userIdStr)
+	app.SetSecureCookie(w, "user", userIdStr)
 }
 
-func GetCurrentUser(r *http.Request) *User {
+func (app *App) GetCurrentUser(r *http.Request) *User {
 	var err error
 	var userIdStr string
 	var id int64
 	var user *User
 
-	userIdStr, err = GetSecureCookie(r, "user")
+	userIdStr, err = app.GetSecureCookie(r, "user")
 	if err != nil {
 		return nil
 	}
@@ -58,7 +56,7 @@ func GetCurrentUser(r *http.Request) *User {
 		return nil
 	}
 
-	user, err = GetUserById(id)
+	user, err = app.Users.GetById(id)
 	if err != nil {
 		return nil
 	}
@@ -85,13 +83,23 @@ func SetLayout(w http.ResponseWriter, layout string) {
 func GetLayout(r *http.Request) string {
 	if cookie, err := r.Cookie("layout"); err == nil {
 		layout := cookie.Value
-		if layout == "S" || layout == "M" || layout == "L" {
+		if layout == "S" || layout == "M" || layout == "L" || layout == "J" {
 			return layout
 		}
 	}
 	return "S"
 }
 
+func GetPhotoOrder(r *http.Request) string {
+	if cookie, err := r.Cookie("order"); err == nil {
+		order := cookie.Value
+		if order == PhotoOrderUploaded || order == PhotoOrderTaken {
+			return order
+		}
+	}
+	return PhotoOrderUploaded
+}
+
 func GetPhotoSuffixByLayout(layout string) string {
 	switch layout {
 	case "S":
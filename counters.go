@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Photos keep the numbers of their comments and favorites, which
+// CreateComment, DelCommentById, CreateFavorite and DelFavorite update
+// along with the rows. This recomputes the numbers that are off, e.g.
+// after the rows were changed by hand.
+const recountPhotosQuery = `
+	UPDATE photos
+	SET
+		comments_count = (SELECT COUNT(*) FROM comments c WHERE c.photo_id = photos.id),
+		favorites_count = (SELECT COUNT(*) FROM favorites f WHERE f.photo_id = photos.id)
+	WHERE
+		comments_count <> (SELECT COUNT(*) FROM comments c WHERE c.photo_id = photos.id)
+		OR favorites_count <> (SELECT COUNT(*) FROM favorites f WHERE f.photo_id = photos.id);
+`
+
+// RecountPhotos fixes the comment and favorite counters of photos and
+// returns the number of photos fixed.
+func RecountPhotos() (int64, error) {
+	res, err := Db.Exec(recountPhotosQuery)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Adds n to the comment counter of a photo.
+func addPhotoCommentsCount(tx *Tx, photoId int64, n int64) error {
+	_, err := tx.Exec(`UPDATE photos SET comments_count = comments_count + $2 WHERE id = $1`, photoId, n)
+	return err
+}
+
+// Adds n to the favorite counter of a photo.
+func addPhotoFavoritesCount(tx *Tx, photoId int64, n int64) error {
+	_, err := tx.Exec(`UPDATE photos SET favorites_count = favorites_count + $2 WHERE id = $1`, photoId, n)
+	return err
+}
+
+// RunRecount implements the "recount" command.
+func RunRecount(args []string) {
+	fs := flag.NewFlagSet("recount", flag.ExitOnError)
+	fs.Parse(args)
+
+	n, err := RecountPhotos()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot recount photos: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d photos fixed\n", n)
+}
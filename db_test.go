@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connects Db to an in-memory SQLite database of the test and applies
+// the migrations. The database lasts as long as one of its connections,
+// so the pool keeps one open.
+func newTestDb(t *testing.T) {
+	db, url := Db, os.Getenv("DATABASE_URL")
+
+	name := strings.Replace(t.Name(), "/", "_", -1)
+	os.Setenv("DATABASE_URL", "sqlite://"+name+"?mode=memory&cache=shared")
+	DbConnect()
+	Db.SetMaxIdleConns(1)
+	Db.SetConnMaxLifetime(0)
+
+	t.Cleanup(func() {
+		Db.Close()
+		Db = db
+		os.Setenv("DATABASE_URL", url)
+	})
+
+	_, err := MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Keeps the storage in a temporary directory of the test.
+func newTestStorage(t *testing.T) {
+	store := Store
+	Store = &LocalStorage{Dir: t.TempDir() + "/", UrlPrefix: "/static/"}
+	t.Cleanup(func() { Store = store })
+}
+
+func TestDbBind(t *testing.T) {
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	query := `SELECT 1 WHERE a = $1 AND b = $2 AND c = $1 AND d < NOW() AND e > NOW()`
+	args := []interface{}{"a", tm}
+
+	pg := &DB{Dialect: DialectPostgres}
+	if q, a := pg.bind(query, args); q != query || len(a) != 2 || a[1] != tm {
+		t.Errorf("postgres: got %q with %v", q, a)
+	}
+
+	sqlite := &DB{Dialect: DialectSqlite}
+	q, a := sqlite.bind(query, args)
+	want := `SELECT 1 WHERE a = ?1 AND b = ?2 AND c = ?1 AND d < ?3 AND e > ?3`
+	if q != want {
+		t.Errorf("sqlite: got %q, want %q", q, want)
+	}
+	if len(a) != 3 || a[0] != "a" || a[1] != tm.UTC() {
+		t.Fatalf("sqlite: got arguments %v", a)
+	}
+	if now, ok := a[2].(time.Time); !ok || now.Location() != time.UTC {
+		t.Errorf("sqlite: got %v for NOW(), want a UTC time", a[2])
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	newTestDb(t)
+
+	status := func() int {
+		var count int
+		err := Db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	if n := status(); n != len(Migrations) {
+		t.Fatalf("%d migrations applied, want %d", n, len(Migrations))
+	}
+
+	reverted, err := MigrateDown(len(Migrations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(Migrations) || status() != 0 {
+		t.Errorf("reverted %d migrations, %d left", len(reverted), status())
+	}
+
+	applied, err := MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) || status() != len(Migrations) {
+		t.Errorf("applied %d migrations again, want %d", len(applied), len(Migrations))
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"image"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/lib/pq"
+)
+
+// Photos whose perceptual hashes differ in at most this many bits
+// are considered duplicates.
+const DuplicateMaxDistance = 4
+
+// For the database lookup, hashes are split into DuplicateMaxDistance+1
+// bands. Two hashes within DuplicateMaxDistance bits of each other have
+// at least one equal band, so the candidates are found with the GIN
+// index on photos.phash_bands and checked exactly afterwards.
+const duplicateBands = DuplicateMaxDistance + 1
+
+// How long after an upload the photostream reminds about duplicates.
+const DuplicateWarningPeriod = 24 * time.Hour
+
+// Computes the difference hash (dHash) of an image: every bit tells
+// if a pixel of a 9x8 grayscale copy is brighter than its right neighbor.
+// Resizing, recompression and small color changes keep the hash.
+func PerceptualHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Lanczos))
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Returns the bands of a hash, tagged with their positions.
+func hashBands(hash uint64) []int64 {
+	bands := make([]int64, duplicateBands)
+	start := 0
+	for i := 0; i < duplicateBands; i++ {
+		size := (64 - start) / (duplicateBands - i)
+		band := (hash >> uint(start)) & (1<<uint(size) - 1)
+		bands[i] = int64(i)<<16 | int64(band)
+		start += size
+	}
+	return bands
+}
+
+// Returns the bands of a hash as a literal array for queries. With the
+// bands in the query rather than in a parameter, the GIN index is used
+// whatever plan the statement gets.
+func hashBandsLiteral(hash uint64) string {
+	bands := make([]string, 0, duplicateBands)
+	for _, band := range hashBands(hash) {
+		bands = append(bands, strconv.FormatInt(band, 10))
+	}
+	return "'{" + strings.Join(bands, ",") + "}'::BIGINT[]"
+}
+
+func SetPhotoHash(id int64, hash uint64) error {
+	_, err := Db.Exec(
+		`UPDATE photos SET phash = $1, phash_bands = $2 WHERE id = $3`,
+		int64(hash), pq.Array(hashBands(hash)), id,
+	)
+	return err
+}
+
+// Returns the other photos of the same user that look the same.
+func GetDuplicatesOfPhoto(photo *Photo) ([]*Photo, error) {
+	if !photo.HasHash {
+		return []*Photo{}, nil
+	}
+
+	// SQLite has no arrays, there all the photos of the user with a hash
+	// are candidates, which is fine for the libraries it serves.
+	bands := "p.phash_bands && " + hashBandsLiteral(photo.Hash)
+	if Db.Dialect == DialectSqlite {
+		bands = "p.phash IS NOT NULL"
+	}
+
+	candidates, err := queryPhotos(
+		`
+		SELECT `+photoColumns+`
+		FROM
+			photos p
+			JOIN users u ON u.id = p.user_id
+		WHERE
+			p.user_id = $1
+			AND p.id <> $2
+			AND p.processed = 1
+			AND `+bands+`
+		ORDER BY p.tm DESC
+		`,
+		photo.UserId, photo.Id,
+	)
+	if err != nil {
+		return []*Photo{}, err
+	}
+
+	result := make([]*Photo, 0, len(candidates))
+	for _, c := range candidates {
+		if HashDistance(c.Hash, photo.Hash) <= DuplicateMaxDistance {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+type DuplicatePair struct {
+	Photo     *Photo
+	Duplicate *Photo
+	Distance  int
+}
+
+// Returns the pairs of near-identical photos of a user, the newer photo
+// first. Only photos uploaded after since are looked at as the newer one.
+// The candidates are looked up for one photo at a time, with its bands as
+// a literal array, as a self-join on the bands can't use the GIN index.
+func GetDuplicatePairsByUserId(userId int64, since time.Time, limit int) ([]*DuplicatePair, error) {
+	hashes, err := getPhotoHashesByUserId(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Position of every photo in hashes, the newest first.
+	order := make(map[int64]int, len(hashes))
+	for i, h := range hashes {
+		order[h.id] = i
+	}
+
+	type pair struct {
+		a, b     int64
+		distance int
+	}
+	pairs := make([]pair, 0, 1)
+
+	// SQLite has no arrays, there all the older photos are candidates,
+	// as in GetDuplicatesOfPhoto.
+	for i := 0; i < len(hashes) && len(pairs) < limit; i++ {
+		a := hashes[i]
+		if a.tm.Before(since) {
+			break
+		}
+
+		candidates := hashes[i+1:]
+		if Db.Dialect == DialectPostgres {
+			candidates, err = getPhotoHashCandidates(userId, a.hash)
+			if err != nil {
+				return nil, err
+			}
+			sort.Slice(candidates, func(j, k int) bool {
+				return order[candidates[j].id] < order[candidates[k].id]
+			})
+		}
+
+		for _, b := range candidates {
+			if j, ok := order[b.id]; !ok || j <= i {
+				continue
+			}
+			distance := HashDistance(a.hash, b.hash)
+			if distance <= DuplicateMaxDistance {
+				pairs = append(pairs, pair{a.id, b.id, distance})
+				if len(pairs) >= limit {
+					break
+				}
+			}
+		}
+	}
+
+	ids := make([]int64, 0, 2*len(pairs))
+	for _, p := range pairs {
+		ids = append(ids, p.a, p.b)
+	}
+	photos, err := getPhotosByIds(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Photos deleted in the meantime are left out.
+	result := make([]*DuplicatePair, 0, len(pairs))
+	for _, p := range pairs {
+		a, b := photos[p.a], photos[p.b]
+		if a != nil && b != nil {
+			result = append(result, &DuplicatePair{a, b, p.distance})
+		}
+	}
+	return result, nil
+}
+
+type photoHash struct {
+	id   int64
+	tm   time.Time
+	hash uint64
+}
+
+// Returns the hashes of the processed photos of a user, the newest first.
+func getPhotoHashesByUserId(userId int64) ([]photoHash, error) {
+	return queryPhotoHashes(
+		`
+		SELECT id, tm, phash
+		FROM photos
+		WHERE user_id = $1 AND processed = 1 AND phash IS NOT NULL
+		ORDER BY tm DESC, id DESC
+		`,
+		userId,
+	)
+}
+
+// Returns the hashes of the processed photos of a user that share a band
+// with the given hash.
+func getPhotoHashCandidates(userId int64, hash uint64) ([]photoHash, error) {
+	return queryPhotoHashes(
+		`
+		SELECT id, tm, phash
+		FROM photos
+		WHERE
+			user_id = $1
+			AND processed = 1
+			AND phash_bands && `+hashBandsLiteral(hash)+`
+		`,
+		userId,
+	)
+}
+
+func queryPhotoHashes(query string, args ...interface{}) ([]photoHash, error) {
+	result := make([]photoHash, 0, 1)
+
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h photoHash
+		var hash int64
+		if err := rows.Scan(&h.id, &h.tm, &hash); err != nil {
+			return nil, err
+		}
+		h.hash = uint64(hash)
+		result = append(result, h)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// Photo edits are kept as a list of operations, applied to the original
+// whenever the derivatives are made. The original itself never changes,
+// so the edits can be reverted.
+const (
+	EditRotate     = "rotate"     // Value: 90, 180 or 270 degrees counter-clockwise
+	EditStraighten = "straighten" // Value: -45 to 45 degrees counter-clockwise
+	EditCrop       = "crop"       // Crop: the part of the image to keep
+	EditBrightness = "brightness" // Value: -100 to 100 percent
+	EditContrast   = "contrast"   // Value: -100 to 100 percent
+	EditGamma      = "gamma"      // Value: 0.1 to 10, 1 keeps the image as is
+	EditSaturation = "saturation" // Value: -100 to 100 percent
+)
+
+type PhotoEdit struct {
+	Op    string    `json:"op"`
+	Value float64   `json:"value,omitempty"`
+	Crop  *EditRect `json:"crop,omitempty"`
+}
+
+// A rectangle in fractions of the image size, so that it doesn't depend
+// on the size of the image it was chosen on.
+type EditRect struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"w"`
+	Height float64 `json:"h"`
+}
+
+func (e PhotoEdit) Validate() error {
+	switch e.Op {
+	case EditRotate:
+		if e.Value != 90 && e.Value != 180 && e.Value != 270 {
+			return fmt.Errorf("Invalid rotation: %v", e.Value)
+		}
+	case EditStraighten:
+		if e.Value < -45 || e.Value > 45 {
+			return fmt.Errorf("Invalid straighten angle: %v", e.Value)
+		}
+	case EditCrop:
+		c := e.Crop
+		if c == nil || c.X < 0 || c.Y < 0 || c.Width <= 0 || c.Height <= 0 ||
+			c.X+c.Width > 1.0001 || c.Y+c.Height > 1.0001 {
+			return fmt.Errorf("Invalid crop rectangle")
+		}
+	case EditBrightness, EditContrast, EditSaturation:
+		if e.Value < -100 || e.Value > 100 {
+			return fmt.Errorf("Invalid %s: %v", e.Op, e.Value)
+		}
+	case EditGamma:
+		if e.Value < 0.1 || e.Value > 10 {
+			return fmt.Errorf("Invalid gamma: %v", e.Value)
+		}
+	default:
+		return fmt.Errorf("Unknown edit operation: %s", e.Op)
+	}
+	return nil
+}
+
+func ParsePhotoEdits(data string) ([]PhotoEdit, error) {
+	edits := []PhotoEdit{}
+	if data == "" {
+		return edits, nil
+	}
+	err := json.Unmarshal([]byte(data), &edits)
+	if err != nil {
+		return nil, err
+	}
+	return edits, nil
+}
+
+func FormatPhotoEdits(edits []PhotoEdit) (string, error) {
+	if len(edits) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(edits)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Applies the edits to an image in order. Invalid edits are skipped.
+func ApplyPhotoEdits(img image.Image, edits []PhotoEdit) image.Image {
+	for _, e := range edits {
+		if e.Validate() != nil {
+			continue
+		}
+
+		switch e.Op {
+		case EditRotate:
+			switch e.Value {
+			case 90:
+				img = imaging.Rotate90(img)
+			case 180:
+				img = imaging.Rotate180(img)
+			case 270:
+				img = imaging.Rotate270(img)
+			}
+		case EditStraighten:
+			img = straighten(img, e.Value)
+		case EditCrop:
+			b := img.Bounds()
+			w, h := float64(b.Dx()), float64(b.Dy())
+			rect := image.Rect(
+				int(math.Floor(e.Crop.X*w)), int(math.Floor(e.Crop.Y*h)),
+				int(math.Ceil((e.Crop.X+e.Crop.Width)*w)), int(math.Ceil((e.Crop.Y+e.Crop.Height)*h)),
+			).Add(b.Min).Intersect(b)
+			if !rect.Empty() {
+				img = imaging.Crop(img, rect)
+			}
+		case EditBrightness:
+			img = imaging.AdjustBrightness(img, e.Value)
+		case EditContrast:
+			img = imaging.AdjustContrast(img, e.Value)
+		case EditGamma:
+			img = imaging.AdjustGamma(img, e.Value)
+		case EditSaturation:
+			img = imaging.AdjustSaturation(img, e.Value)
+		}
+	}
+	return img
+}
+
+// Rotates the image by a small angle and crops it to the largest
+// rectangle of the same aspect ratio without the empty corners.
+func straighten(img image.Image, angle float64) image.Image {
+	if angle == 0 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	sin, cos := math.Abs(math.Sin(angle*math.Pi/180)), math.Cos(angle*math.Pi/180)
+	scale := math.Min(w/(w*cos+h*sin), h/(w*sin+h*cos))
+
+	// A couple of pixels more are cut, as the edges of the rotated
+	// image are blended with the background.
+	cw := int(math.Floor(w*scale)) - 2
+	ch := int(math.Floor(h*scale)) - 2
+	if cw < 1 || ch < 1 {
+		return img
+	}
+
+	rotated := imaging.Rotate(img, angle, color.Transparent)
+	return imaging.CropCenter(rotated, cw, ch)
+}
+
+// The edit page shows a fixed set of fields. The fields are turned into
+// a list of edits in this order: rotate, straighten, crop, adjustments.
+type PhotoEditForm struct {
+	Rotate     int
+	Straighten float64
+
+	// Crop rectangle in percent.
+	CropX      float64
+	CropY      float64
+	CropWidth  float64
+	CropHeight float64
+
+	Brightness float64
+	Contrast   float64
+	Gamma      float64
+	Saturation float64
+}
+
+// Returns the form fields for a list of edits made by the form.
+func NewPhotoEditForm(edits []PhotoEdit) *PhotoEditForm {
+	f := &PhotoEditForm{CropWidth: 100, CropHeight: 100, Gamma: 1}
+	for _, e := range edits {
+		switch e.Op {
+		case EditRotate:
+			f.Rotate = int(e.Value)
+		case EditStraighten:
+			f.Straighten = e.Value
+		case EditCrop:
+			if e.Crop != nil {
+				f.CropX = e.Crop.X * 100
+				f.CropY = e.Crop.Y * 100
+				f.CropWidth = e.Crop.Width * 100
+				f.CropHeight = e.Crop.Height * 100
+			}
+		case EditBrightness:
+			f.Brightness = e.Value
+		case EditContrast:
+			f.Contrast = e.Value
+		case EditGamma:
+			f.Gamma = e.Value
+		case EditSaturation:
+			f.Saturation = e.Value
+		}
+	}
+	return f
+}
+
+// Returns the edits set in the form. Fields left at their defaults
+// give no edits.
+func (f *PhotoEditForm) Edits() ([]PhotoEdit, error) {
+	edits := make([]PhotoEdit, 0, 1)
+
+	if f.Rotate != 0 {
+		edits = append(edits, PhotoEdit{Op: EditRotate, Value: float64(f.Rotate)})
+	}
+	if f.Straighten != 0 {
+		edits = append(edits, PhotoEdit{Op: EditStraighten, Value: f.Straighten})
+	}
+	if f.CropX != 0 || f.CropY != 0 || f.CropWidth != 100 || f.CropHeight != 100 {
+		edits = append(edits, PhotoEdit{Op: EditCrop, Crop: &EditRect{
+			X:      f.CropX / 100,
+			Y:      f.CropY / 100,
+			Width:  f.CropWidth / 100,
+			Height: f.CropHeight / 100,
+		}})
+	}
+	if f.Brightness != 0 {
+		edits = append(edits, PhotoEdit{Op: EditBrightness, Value: f.Brightness})
+	}
+	if f.Contrast != 0 {
+		edits = append(edits, PhotoEdit{Op: EditContrast, Value: f.Contrast})
+	}
+	if f.Gamma != 1 {
+		edits = append(edits, PhotoEdit{Op: EditGamma, Value: f.Gamma})
+	}
+	if f.Saturation != 0 {
+		edits = append(edits, PhotoEdit{Op: EditSaturation, Value: f.Saturation})
+	}
+
+	for _, e := range edits {
+		if err := e.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return edits, nil
+}
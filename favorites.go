@@ -21,7 +21,13 @@ func CreateFavorite(userId int64, photoId int64) (*Favorite, error) {
 		Tm:      time.Now(),
 	}
 
-	err := Db.QueryRow(
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
 		`
 		INSERT INTO favorites(user_id, photo_id, tm) 
 		VALUES ($1, $2, $3)
@@ -30,6 +36,16 @@ func CreateFavorite(userId int64, photoId int64) (*Favorite, error) {
 		fav.UserId, fav.PhotoId, fav.Tm,
 	).Scan(&fav.Id)
 
+	if err != nil {
+		return nil, err
+	}
+
+	err = addPhotoFavoritesCount(tx, fav.PhotoId, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return nil, err
 	}
@@ -54,6 +70,7 @@ func GetFavoritesByPhotoId(photoId int64) ([]*Favorite, error) {
 	if err != nil {
 		return []*Favorite{}, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		fav := &Favorite{}
@@ -76,7 +93,7 @@ func GetFavoritesByPhotoId(photoId int64) ([]*Favorite, error) {
 func GetFavoritesCountByPhotoId(photoId int64) (int, error) {
 	var count int
 
-	err := Db.QueryRow(`SELECT COUNT(*) FROM favorites WHERE photo_id = $1`, photoId).Scan(&count)
+	err := Db.QueryRow(`SELECT favorites_count FROM photos WHERE id = $1`, photoId).Scan(&count)
 
 	if err != nil {
 		return 0, err
@@ -84,10 +101,20 @@ func GetFavoritesCountByPhotoId(photoId int64) (int, error) {
 	return count, nil
 }
 
-func GetFavoritesCountByUserId(userId int64) (int, error) {
+func GetFavoritesCountByUserId(userId int64, color string) (int, error) {
 	var count int
 
-	err := Db.QueryRow(`SELECT COUNT(*) FROM favorites WHERE user_id = $1`, userId).Scan(&count)
+	err := Db.QueryRow(
+		`
+		SELECT COUNT(*) 
+		FROM favorites f, photos p
+		WHERE 
+			f.user_id = $1 
+			AND f.photo_id = p.id
+			AND ($2 = '' OR p.color = $2)
+		`,
+		userId, color,
+	).Scan(&count)
 
 	if err != nil {
 		return 0, err
@@ -113,6 +140,27 @@ func IsFavorited(userId int64, photoId int64) (bool, error) {
 }
 
 func DelFavorite(userId int64, photoId int64) error {
-	_, err := Db.Exec(`DELETE FROM favorites WHERE user_id = $1 and photo_id = $2`, userId, photoId)
-	return err
+	tx, err := Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM favorites WHERE user_id = $1 and photo_id = $2`, userId, photoId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+
+	err = addPhotoFavoritesCount(tx, photoId, -n)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files younger than this are never collected, so that files written
+// just before their database rows are not taken for orphans.
+const GcDefaultGracePeriod = 24 * time.Hour
+
+// How long the sizes made on demand are kept. Set by the IMAGE_CACHE_TTL
+// environment variable, defaults to 30 days.
+func GetImageCacheTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("IMAGE_CACHE_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return 30 * 24 * time.Hour
+}
+
+// Names of the files under each storage prefix. The first group is
+// the photo or user ID, the next ones are the photo's RandId, the suffix
+// of the size and the extension.
+var (
+	gcPhotoFileRe  = regexp.MustCompile(`^(\d+)_([a-z0-9]+)_([a-z0-9]+)\.([a-z]+)$`)
+	gcAvatarFileRe = regexp.MustCompile(`^(\d+)_[a-z0-9]+\.[a-z]+$`)
+)
+
+type GcResult struct {
+	Files     int
+	Orphans   int
+	Unknown   int
+	Reclaimed int64
+	Errors    int
+}
+
+// CollectGarbage finds the files in the storage that belong to deleted
+// photos and users, or are left over from failed writes, and the sizes made
+// on demand that have expired, and deletes them
+// unless dryRun is set. Files matching no known name are reported, but
+// kept. report is called for every orphan and unknown file.
+func CollectGarbage(grace time.Duration, dryRun bool, report func(info *StorageFileInfo, orphan bool)) (*GcResult, error) {
+	// Read the live IDs first, so that a photo created during
+	// the listing has a file younger than the grace period.
+	photos, err := GetPhotoFileNames()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := GetPhotoVersionRandIds()
+	if err != nil {
+		return nil, err
+	}
+	users, err := GetUserIds()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GcResult{}
+	deadline := time.Now().Add(-grace)
+	expired := time.Now().Add(-GetImageCacheTTL())
+
+	check := func(prefix string, isOrphan func(name string) (bool, bool), expires bool) error {
+		return Store.List(prefix, func(info *StorageFileInfo) error {
+			result.Files++
+
+			name := path.Base(info.Key)
+			orphan, known := isOrphan(name)
+
+			// Leftovers of LocalStorage.Put.
+			if strings.HasSuffix(name, ".tmp") {
+				orphan, known = true, true
+			}
+			if expires && info.ModTime.Before(expired) {
+				orphan, known = true, true
+			}
+
+			if !known {
+				result.Unknown++
+				report(info, false)
+				return nil
+			}
+			if !orphan || info.ModTime.After(deadline) {
+				return nil
+			}
+
+			result.Orphans++
+			report(info, true)
+
+			if !dryRun {
+				err := Store.Delete(info.Key)
+				if err != nil {
+					log.Printf("ERROR: cannot delete %s: %v\n", info.Key, err)
+					result.Errors++
+					return nil
+				}
+				if expires && ImgCache != nil {
+					ImgCache.Remove(info.Key)
+				}
+			}
+			result.Reclaimed += info.Size
+			return nil
+		})
+	}
+
+	// Originals of the previous versions of photos are kept,
+	// their derivatives are made on demand and kept until they expire.
+	isOriginalOrphan := func(name string) (bool, bool) {
+		m := gcPhotoFileRe.FindStringSubmatch(name)
+		if m == nil {
+			return false, false
+		}
+		id, _ := strconv.ParseInt(m[1], 10, 64)
+		if photo, ok := photos[id]; ok && photo.RandId == m[2] {
+			return false, true
+		}
+		for _, randId := range versions[id] {
+			if randId == m[2] {
+				return false, true
+			}
+		}
+		return true, true
+	}
+
+	// Derivatives are orphans when the photo has another RandId, or has
+	// changed the extension of its derivatives, e.g. from PNG to JPEG after
+	// FLATTEN_BACKGROUND was set.
+	isPhotoOrphan := func(name string) (bool, bool) {
+		m := gcPhotoFileRe.FindStringSubmatch(name)
+		if m == nil {
+			return false, false
+		}
+		id, _ := strconv.ParseInt(m[1], 10, 64)
+		suffix, ext := m[3], m[4]
+
+		// Originals not moved yet, of photos and versions,
+		// see ReadPhotoOriginal.
+		if suffix == "o" {
+			return isOriginalOrphan(name)
+		}
+
+		photo, ok := photos[id]
+		if !ok || photo.RandId != m[2] {
+			return true, true
+		}
+		switch {
+		case ext == photo.SuffixExt(suffix):
+			return false, true
+		case ext == "webp" && photo.SuffixExt(suffix) != "gif":
+			return false, true
+		}
+		return true, true
+	}
+
+	isUserOrphan := func(name string) (bool, bool) {
+		// Default avatars share the directory with the local storage.
+		if strings.HasPrefix(name, "default_") {
+			return false, true
+		}
+		m := gcAvatarFileRe.FindStringSubmatch(name)
+		if m == nil {
+			return false, false
+		}
+		id, _ := strconv.ParseInt(m[1], 10, 64)
+		return !users[id], true
+	}
+
+	for _, p := range []struct {
+		prefix   string
+		isOrphan func(name string) (bool, bool)
+		expires  bool
+	}{
+		{PathToPhotos, isPhotoOrphan, false},
+		{PathToOriginals + "photos/", isOriginalOrphan, false},
+		{PathToCache + "photos/", isOriginalOrphan, true},
+		{PathToAvatars, isUserOrphan, false},
+		{PathToOriginals + "avatars/", isUserOrphan, false},
+	} {
+		err := check(p.prefix, p.isOrphan, p.expires)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// RunGc implements the "gc" command.
+func RunGc(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	grace := fs.Duration("grace", GcDefaultGracePeriod, "keep orphaned files younger than this")
+	dryRun := fs.Bool("dry-run", false, "report orphaned files without deleting them")
+	fs.Parse(args)
+
+	result, err := CollectGarbage(*grace, *dryRun, func(info *StorageFileInfo, orphan bool) {
+		if orphan {
+			fmt.Printf("orphan  %s (%s)\n", info.Key, FormatSize(info.Size))
+		} else {
+			fmt.Printf("unknown %s\n", info.Key)
+		}
+	})
+	if result != nil {
+		verb := "reclaimed"
+		if *dryRun {
+			verb = "would be reclaimed"
+		}
+		fmt.Printf(
+			"%d files checked, %d orphaned, %d unknown, %d errors, %s %s\n",
+			result.Files, result.Orphans, result.Unknown, result.Errors,
+			FormatSize(result.Reclaimed), verb,
+		)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot collect garbage: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// StartGc runs the garbage collector periodically if GC_INTERVAL is set,
+// e.g. to "24h". It should be set on one node only.
+func StartGc() {
+	interval, err := time.ParseDuration(os.Getenv("GC_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			result, err := CollectGarbage(GcDefaultGracePeriod, false, func(*StorageFileInfo, bool) {})
+			if err != nil {
+				log.Printf("ERROR: cannot collect garbage: %v\n", err)
+			}
+			if result != nil && result.Orphans > 0 {
+				log.Printf("Deleted %d orphaned files, reclaimed %s\n", result.Orphans, FormatSize(result.Reclaimed))
+			}
+		}
+	}()
+}
+
+func FormatSize(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ImageCache bounds the total size of the photo sizes made on demand,
+// see PathToCache. When it goes over MaxSize, the least recently used
+// files are deleted from the storage. Files are used when the workers
+// of this process make them and when HandleImage redirects to them.
+// Expired files are also deleted by the garbage collector, see
+// GetImageCacheTTL.
+type ImageCache struct {
+	MaxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *imageCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type imageCacheEntry struct {
+	key  string
+	size int64
+}
+
+// Set on the nodes running workers, see StartProcessing.
+var ImgCache *ImageCache
+
+// Size limit of the sizes made on demand, in megabytes. Set by the
+// IMAGE_CACHE_SIZE environment variable, defaults to 1024. Every worker
+// node keeps the files it knows of under the limit.
+func GetImageCacheSize() int64 {
+	if size, err := strconv.ParseInt(os.Getenv("IMAGE_CACHE_SIZE"), 10, 64); err == nil && size > 0 {
+		return size
+	}
+	return 1024
+}
+
+// ImageCacheConnect indexes the files already in the cache and deletes
+// the ones over the limit.
+func ImageCacheConnect() {
+	var err error
+	ImgCache, err = NewImageCache(GetImageCacheSize() * 1024 * 1024)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// NewImageCache indexes the files already in the cache, as if they were
+// used in the order they were made.
+func NewImageCache(maxSize int64) (*ImageCache, error) {
+	c := &ImageCache{
+		MaxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	files := []*StorageFileInfo{}
+	err := Store.List(PathToCache, func(info *StorageFileInfo) error {
+		files = append(files, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+
+	for _, info := range files {
+		c.Add(info.Key, info.Size)
+	}
+	return c, nil
+}
+
+// Add records a file stored in the cache and deletes the least recently
+// used ones if the cache is over the limit.
+func (c *ImageCache) Add(key string, size int64) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*imageCacheEntry).size
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&imageCacheEntry{key, size})
+	c.size += size
+	evicted := c.evict()
+	c.mu.Unlock()
+
+	for _, key := range evicted {
+		err := Store.Delete(key)
+		if err != nil && !IsStorageNotFound(err) {
+			log.Printf("ERROR: cannot delete %s: %v\n", key, err)
+		}
+	}
+}
+
+// Touch marks a file as used.
+func (c *ImageCache) Touch(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+	}
+}
+
+// Remove forgets a file deleted by someone else, e.g. the garbage
+// collector.
+func (c *ImageCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*imageCacheEntry).size
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// Size returns the total size of the files in the cache.
+func (c *ImageCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// Removes the least recently used entries until the cache is under
+// the limit and returns their keys. The most recent one is always kept.
+func (c *ImageCache) evict() []string {
+	evicted := []string{}
+	for c.size > c.MaxSize && c.lru.Len() > 1 {
+		entry := c.lru.Remove(c.lru.Back()).(*imageCacheEntry)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		evicted = append(evicted, entry.key)
+	}
+	return evicted
+}
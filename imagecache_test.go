@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImageCache(t *testing.T) {
+	newTestStorage(t)
+
+	put := func(key string) {
+		err := Store.Put(key, make([]byte, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(key string) bool {
+		_, err := Store.Stat(key)
+		if err != nil && !IsStorageNotFound(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// Files made before the start are used in the order they were made.
+	a, b, c, d := PathToCache+"photos/a", PathToCache+"photos/b", PathToCache+"photos/c", PathToCache+"photos/d"
+	for _, key := range []string{a, b, c} {
+		put(key)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cache, err := NewImageCache(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(a) || !exists(b) || !exists(c) {
+		t.Errorf("start: got a %v, b %v, c %v, want the oldest file deleted", exists(a), exists(b), exists(c))
+	}
+	if cache.Size() != 200 {
+		t.Errorf("start: got size %d, want 200", cache.Size())
+	}
+
+	cache.Touch(b)
+	put(d)
+	cache.Add(d, 100)
+	if !exists(b) || exists(c) || !exists(d) {
+		t.Errorf("add: got b %v, c %v, d %v, want the least recently used file deleted", exists(b), exists(c), exists(d))
+	}
+
+	cache.Remove(b)
+	if cache.Size() != 100 {
+		t.Errorf("remove: got size %d, want 100", cache.Size())
+	}
+
+	// A file over the limit is kept until the next one.
+	cache.Add(a, 1000)
+	if cache.Size() != 1000 {
+		t.Errorf("large file: got size %d, want 1000", cache.Size())
+	}
+}
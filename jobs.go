@@ -0,0 +1,479 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	JobKindPhoto      = "photo"
+	JobKindAvatar     = "avatar"
+	JobKindDerivative = "derivative"
+)
+
+const (
+	JobStatePending = "pending"
+	JobStateRunning = "running"
+	JobStateDone    = "done"
+	JobStateDead    = "dead"
+)
+
+// Channel used to notify workers on other nodes about new jobs.
+// The payload is the job kind.
+const JobsNotifyChannel = "quiet_jobs"
+
+// Channel used to notify web nodes about stored derivatives, so that the
+// requests waiting for them can be answered. The payload is the storage key.
+const DerivativesNotifyChannel = "quiet_derivatives"
+
+// How long a claimed job stays locked by its worker, which renews the lease
+// while the job runs. A job whose lease has expired is considered abandoned
+// (crashed worker) and is claimed again.
+const JobLeaseTimeout = 10 * time.Minute
+
+// Failed jobs are retried with exponential backoff until JobMaxAttempts
+// is reached, then they are moved to the dead state.
+const JobMaxAttempts = 5
+const JobBackoffBase = 30 * time.Second
+const JobBackoffMax = 1 * time.Hour
+
+type Job struct {
+	Id          int64
+	Kind        string
+	TargetId    int64
+	Payload     string // what to do with the target, for some kinds
+	State       string
+	Attempts    int
+	LastError   string
+	RunAt       time.Time
+	LockedUntil time.Time
+	Tm          time.Time
+}
+
+func CreateJob(kind string, targetId int64) (*Job, error) {
+	job := &Job{
+		Kind:     kind,
+		TargetId: targetId,
+		State:    JobStatePending,
+		RunAt:    time.Now(),
+		Tm:       time.Now(),
+	}
+
+	for {
+		err := Db.QueryRow(
+			`
+			INSERT INTO jobs(kind, target_id, state, run_at, tm)
+			VALUES ($1, $2, $3, $4, $5)
+			`+onPendingJobConflict+`
+			RETURNING id
+			`,
+			job.Kind, job.TargetId, job.State, job.RunAt, job.Tm,
+		).Scan(&job.Id)
+
+		// The pending job already there does the work, unless a worker
+		// has claimed it in the meantime.
+		if err == sql.ErrNoRows {
+			err = Db.QueryRow(
+				`SELECT id, run_at, tm FROM jobs WHERE kind = $1 AND target_id = $2 AND payload = '' AND state = $3`,
+				job.Kind, job.TargetId, job.State,
+			).Scan(&job.Id, &job.RunAt, &job.Tm)
+			if err == sql.ErrNoRows {
+				continue
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+}
+
+// Targets have at most one pending job of each kind and payload, see the
+// jobs_pending_once index. Inserts of other ones are skipped.
+const onPendingJobConflict = `ON CONFLICT (kind, target_id, payload) WHERE state = 'pending' DO NOTHING`
+
+// State of a job put back to pending. It's done instead if its target
+// got another pending job of the same kind and payload in the meantime,
+// which does the work.
+const requeuedJobState = `
+	CASE WHEN EXISTS (
+		SELECT 1 FROM jobs t
+		WHERE
+			t.kind = jobs.kind AND t.target_id = jobs.target_id AND t.payload = jobs.payload
+			AND t.state = 'pending' AND t.id <> jobs.id
+	) THEN 'done' ELSE 'pending' END`
+
+// SQLite serves a single node, where the workers are woken up directly.
+func NotifyJobs(kind string) error {
+	if Db.Dialect == DialectSqlite {
+		wakeup(kind)
+		return nil
+	}
+	_, err := Db.Exec(`SELECT pg_notify($1, $2)`, JobsNotifyChannel, kind)
+	return err
+}
+
+// Wakes up the requests of this node waiting for the derivative with
+// the given key and, through NOTIFY, the ones of the other web nodes.
+func NotifyDerivative(key string) error {
+	derivativeReady(key)
+	if Db.Dialect == DialectSqlite {
+		return nil
+	}
+	_, err := Db.Exec(`SELECT pg_notify($1, $2)`, DerivativesNotifyChannel, key)
+	return err
+}
+
+// Returns the expression of the end of a lease starting now, for the
+// parameter number n, and its argument.
+func jobLease(n int) (string, interface{}) {
+	if Db.Dialect == DialectSqlite {
+		return fmt.Sprintf("$%d", n), time.Now().Add(JobLeaseTimeout)
+	}
+	return fmt.Sprintf("NOW() + $%d * INTERVAL '1 second'", n), int64(JobLeaseTimeout / time.Second)
+}
+
+// ClaimJob locks the oldest runnable job of the given kind for the current
+// worker. Runnable jobs are pending ones whose run_at has come and running
+// ones whose lease has expired with attempts left, see BuryAbandonedJobs.
+// Returns nil, nil when there is nothing to do.
+func ClaimJob(kind string) (*Job, error) {
+	job := &Job{}
+
+	// SQLite runs one writer at a time, so the job needs no row lock there.
+	lockedUntil, lease := jobLease(3)
+	skipLocked := "FOR UPDATE SKIP LOCKED"
+	if Db.Dialect == DialectSqlite {
+		skipLocked = ""
+	}
+
+	err := Db.QueryRow(
+		`
+		UPDATE jobs
+		SET
+			state = $2,
+			attempts = attempts + 1,
+			locked_until = `+lockedUntil+`
+		WHERE id = (
+			SELECT id
+			FROM jobs
+			WHERE
+				kind = $1
+				AND (
+					(state = $4 AND run_at <= NOW())
+					OR (state = $2 AND locked_until < NOW() AND attempts < $5)
+				)
+			ORDER BY run_at, id
+			LIMIT 1
+			`+skipLocked+`
+		)
+		RETURNING id, kind, target_id, payload, state, attempts, last_error, run_at, locked_until, tm
+		`,
+		kind, JobStateRunning, lease, JobStatePending, JobMaxAttempts,
+	).Scan(
+		&job.Id, &job.Kind, &job.TargetId, &job.Payload, &job.State, &job.Attempts,
+		&job.LastError, &job.RunAt, &job.LockedUntil, &job.Tm,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// ExtendJobLease renews the lease of a running job, so that jobs running
+// longer than JobLeaseTimeout aren't taken for abandoned.
+func ExtendJobLease(id int64) error {
+	lockedUntil, lease := jobLease(2)
+	_, err := Db.Exec(
+		`UPDATE jobs SET locked_until = `+lockedUntil+` WHERE id = $1 AND state = $3`,
+		id, lease, JobStateRunning,
+	)
+	return err
+}
+
+// BuryAbandonedJobs moves the jobs of the given kind whose lease has expired
+// during their last attempt to the dead state. These are jobs that crash
+// or hang their workers, which never get to call FailJob. Returns the jobs
+// moved.
+func BuryAbandonedJobs(kind string) ([]*Job, error) {
+	result := make([]*Job, 0, 1)
+
+	rows, err := Db.Query(
+		`
+		UPDATE jobs
+		SET state = $1, last_error = $2, locked_until = NULL
+		WHERE kind = $3 AND state = $4 AND locked_until < NOW() AND attempts >= $5
+		RETURNING id, kind, target_id, payload, state, attempts, last_error, run_at, tm
+		`,
+		JobStateDead, "Abandoned by the worker on the last attempt",
+		kind, JobStateRunning, JobMaxAttempts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		job := &Job{}
+		err := rows.Scan(
+			&job.Id, &job.Kind, &job.TargetId, &job.Payload, &job.State, &job.Attempts,
+			&job.LastError, &job.RunAt, &job.Tm,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, job)
+	}
+	return result, rows.Err()
+}
+
+func CompleteJob(id int64) error {
+	_, err := Db.Exec(
+		`UPDATE jobs SET state = $1, locked_until = NULL WHERE id = $2`,
+		JobStateDone, id,
+	)
+	return err
+}
+
+// Returns the delay before the next run of a job that has failed
+// the given number of times.
+func JobBackoff(attempts int) time.Duration {
+	delay := JobBackoffBase
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= JobBackoffMax {
+			return JobBackoffMax
+		}
+	}
+	return delay
+}
+
+// RetryJob puts a failed job back to the pending state, to be run again
+// after a backoff delay.
+func RetryJob(id int64, lastError string, runAt time.Time) error {
+	_, err := Db.Exec(
+		`
+		UPDATE jobs
+		SET state = `+requeuedJobState+`, last_error = $1, run_at = $2, locked_until = NULL
+		WHERE id = $3
+		`,
+		lastError, runAt, id,
+	)
+	return err
+}
+
+// FailJob moves a job that keeps failing to the dead state. Dead jobs are
+// never claimed again unless requeued by an admin.
+func FailJob(id int64, lastError string) error {
+	_, err := Db.Exec(
+		`UPDATE jobs SET state = $1, last_error = $2, locked_until = NULL WHERE id = $3`,
+		JobStateDead, lastError, id,
+	)
+	return err
+}
+
+func RequeueJob(id int64) error {
+	result, err := Db.Exec(
+		`
+		UPDATE jobs
+		SET state = `+requeuedJobState+`, attempts = 0, last_error = '', run_at = NOW(), locked_until = NULL
+		WHERE id = $1 AND state = $2
+		`,
+		id, JobStateDead,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		return fmt.Errorf("Dead job not found: %d", id)
+	}
+
+	return nil
+}
+
+func GetJobById(id int64) (*Job, error) {
+	job := &Job{Id: id}
+
+	var lockedUntil pq.NullTime
+	err := Db.QueryRow(
+		`
+		SELECT kind, target_id, payload, state, attempts, last_error, run_at, locked_until, tm
+		FROM jobs
+		WHERE id = $1
+		`,
+		id,
+	).Scan(
+		&job.Kind, &job.TargetId, &job.Payload, &job.State, &job.Attempts,
+		&job.LastError, &job.RunAt, &lockedUntil, &job.Tm,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Job not found: %d", job.Id)
+	} else if err != nil {
+		return nil, err
+	}
+	job.LockedUntil = lockedUntil.Time
+	return job, nil
+}
+
+func GetDeadJobs() ([]*Job, error) {
+	result := make([]*Job, 0, 1)
+
+	rows, err := Db.Query(
+		`
+		SELECT id, kind, target_id, payload, state, attempts, last_error, run_at, tm
+		FROM jobs
+		WHERE state = $1
+		ORDER BY run_at DESC
+		`,
+		JobStateDead,
+	)
+
+	if err != nil {
+		return []*Job{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		job := &Job{}
+		err := rows.Scan(
+			&job.Id, &job.Kind, &job.TargetId, &job.Payload, &job.State, &job.Attempts,
+			&job.LastError, &job.RunAt, &job.Tm,
+		)
+		if err != nil {
+			return []*Job{}, err
+		}
+		result = append(result, job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return []*Job{}, err
+	}
+
+	return result, nil
+}
+
+// EnqueueUnprocessedPhotos creates jobs for photos that are still waiting
+// to be processed but have no unfinished job, e.g. photos uploaded before
+// the jobs table existed.
+func EnqueueUnprocessedPhotos() (int64, error) {
+	result, err := Db.Exec(
+		`
+		INSERT INTO jobs(kind, target_id, state, run_at, tm)
+		SELECT $1, p.id, $2, NOW(), NOW()
+		FROM photos p
+		WHERE
+			p.processed = 0
+			AND NOT EXISTS (
+				SELECT 1 FROM jobs j
+				WHERE j.kind = $1 AND j.target_id = p.id AND j.state NOT IN ($3, $4)
+			)
+		`+onPendingJobConflict+`
+		`,
+		JobKindPhoto, JobStatePending, JobStateDone, JobStateDead,
+	)
+
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// EnqueueUnprocessedAvatars creates jobs for avatars whose original is
+// newer than their derivatives and that have no unfinished job, e.g.
+// avatars uploaded before the jobs table existed. Avatars have no
+// processed flag, so the files in the storage tell.
+func EnqueueUnprocessedAvatars() (int64, error) {
+	userIds, err := GetUserIds()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, prefix := range []string{PathToOriginals + "avatars/", PathToAvatars} {
+		err := Store.List(prefix, func(info *StorageFileInfo) error {
+			name := path.Base(info.Key)
+			if !legacyAvatarOriginalRe.MatchString(name) {
+				return nil
+			}
+			userId, err := strconv.ParseInt(strings.TrimSuffix(name, "_o.jpg"), 10, 64)
+			if err != nil || !userIds[userId] {
+				return nil
+			}
+
+			user := &User{Id: userId}
+			largest := AvatarSizes[len(AvatarSizes)-1]
+			derivative, err := Store.Stat(GetAvatarPath(user, largest.Suffix))
+			if err == nil && !derivative.ModTime.Before(info.ModTime) {
+				return nil
+			} else if err != nil && !IsStorageNotFound(err) {
+				return err
+			}
+
+			created, err := CreateJobOnce(JobKindAvatar, userId, "")
+			if err != nil {
+				return err
+			}
+			if created {
+				count++
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// CreateJobOnce creates a job unless the target already has a pending
+// or running job of the same kind and payload. Returns false if no job
+// was created. Concurrent calls may all miss the pending job that another
+// one is creating, the jobs_pending_once index skips their inserts.
+func CreateJobOnce(kind string, targetId int64, payload string) (bool, error) {
+	result, err := Db.Exec(
+		`
+		INSERT INTO jobs(kind, target_id, payload, state, run_at, tm)
+		SELECT $1, $2, $5, $3, NOW(), NOW()
+		WHERE NOT EXISTS (
+			SELECT 1 FROM jobs
+			WHERE kind = $1 AND target_id = $2 AND payload = $5 AND state IN ($3, $4)
+		)
+		`+onPendingJobConflict+`
+		`,
+		kind, targetId, JobStatePending, JobStateRunning, payload,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Returns the number of pending and running jobs of the given kind.
+func GetUnfinishedJobsCount(kind string) (int, error) {
+	var count int
+	err := Db.QueryRow(
+		`SELECT COUNT(*) FROM jobs WHERE kind = $1 AND state IN ($2, $3)`,
+		kind, JobStatePending, JobStateRunning,
+	).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnqueueUnprocessedPhotos(t *testing.T) {
+	newTestDb(t)
+
+	user, err := CreatePersonaUser("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unprocessed, err := CreatePhoto(user.Id, "", "", "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed, err := CreatePhoto(user.Id, "", "", "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetPhotoProcessed(processed.Id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []int64{1, 0} {
+		n, err := EnqueueUnprocessedPhotos()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("run %d: enqueued %d photos, want %d", i+1, n, want)
+		}
+	}
+
+	job, err := ClaimJob(JobKindPhoto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.TargetId != unprocessed.Id {
+		t.Errorf("got job %+v, want one for photo %d", job, unprocessed.Id)
+	}
+}
+
+func TestEnqueueUnprocessedAvatars(t *testing.T) {
+	newTestDb(t)
+	newTestStorage(t)
+
+	users := make([]*User, 4)
+	for i := range users {
+		user, err := CreatePersonaUser(string(rune('a'+i)) + "@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[i] = user
+	}
+	put := func(key string) {
+		err := Store.Put(key, []byte("jpeg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 0 was uploaded and never processed, 1 was processed, 2 was uploaded
+	// again after it was processed, 3 was uploaded before the originals
+	// were private.
+	put(GetAvatarOriginalPath(users[0]))
+	put(GetAvatarOriginalPath(users[1]))
+	put(GetAvatarPath(users[2], "200"))
+	time.Sleep(10 * time.Millisecond)
+	put(GetAvatarOriginalPath(users[2]))
+	put(PathToAvatars + "4_o.jpg")
+	for _, sz := range AvatarSizes {
+		put(GetAvatarPath(users[1], sz.Suffix))
+	}
+	if users[3].Id != 4 {
+		t.Fatalf("got user %d, want 4", users[3].Id)
+	}
+
+	for i, want := range []int64{3, 0} {
+		n, err := EnqueueUnprocessedAvatars()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("run %d: enqueued %d avatars, want %d", i+1, n, want)
+		}
+	}
+
+	enqueued := make(map[int64]bool)
+	for {
+		job, err := ClaimJob(JobKindAvatar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil {
+			break
+		}
+		enqueued[job.TargetId] = true
+	}
+	for i, want := range []bool{true, false, true, true} {
+		if enqueued[users[i].Id] != want {
+			t.Errorf("avatar of user %d: enqueued %v, want %v", users[i].Id, enqueued[users[i].Id], want)
+		}
+	}
+}
+
+func TestGetDeadJobs(t *testing.T) {
+	newTestDb(t)
+
+	job, err := CreateJob(JobKindPhoto, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = FailJob(job.Id, "cannot decode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateJob(JobKindPhoto, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := GetDeadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Id != job.Id || jobs[0].LastError != "cannot decode" {
+		t.Fatalf("got %d dead jobs, want job %d", len(jobs), job.Id)
+	}
+}
+
+func TestCreateJobOnce(t *testing.T) {
+	newTestDb(t)
+
+	for i, want := range []bool{true, false} {
+		created, err := CreateJobOnce(JobKindDerivative, 1, "abc_t50.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created != want {
+			t.Errorf("run %d: created %v, want %v", i+1, created, want)
+		}
+	}
+
+	created, err := CreateJobOnce(JobKindDerivative, 1, "abc_t100.jpg")
+	if err != nil || !created {
+		t.Errorf("another payload: created %v, %v", created, err)
+	}
+
+	// Concurrent calls miss each other's job, the index skips the inserts.
+	_, err = Db.Exec(`DELETE FROM jobs`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Db.Exec(
+		`INSERT INTO jobs(kind, target_id, payload, state, run_at, tm) VALUES ($1, 1, 'abc_t50.jpg', $2, NOW(), NOW())`,
+		JobKindDerivative, JobStatePending,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Db.Exec(
+		`INSERT INTO jobs(kind, target_id, payload, state, run_at, tm) VALUES ($1, 1, 'abc_t50.jpg', $2, NOW(), NOW())`,
+		JobKindDerivative, JobStatePending,
+	)
+	if err == nil {
+		t.Error("a second pending job was inserted")
+	}
+	_, err = Db.Exec(
+		`INSERT INTO jobs(kind, target_id, payload, state, run_at, tm) VALUES ($1, 1, 'abc_t50.jpg', $2, NOW(), NOW()) `+onPendingJobConflict,
+		JobKindDerivative, JobStatePending,
+	)
+	if err != nil {
+		t.Errorf("insert on conflict: %v", err)
+	}
+	if n := countTestJobs(t, JobKindDerivative, 1); n != 1 {
+		t.Errorf("%d derivative jobs, want 1", n)
+	}
+}
+
+func TestCreateJob(t *testing.T) {
+	newTestDb(t)
+
+	first, err := CreateJob(JobKindPhoto, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := CreateJob(JobKindPhoto, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Id != first.Id {
+		t.Errorf("got job %d, want the pending job %d", second.Id, first.Id)
+	}
+
+	// Once claimed, the job may run on an older state of the photo.
+	claimed, err := ClaimJob(JobKindPhoto)
+	if err != nil || claimed == nil || claimed.Id != first.Id {
+		t.Fatalf("claimed %+v, %v", claimed, err)
+	}
+	third, err := CreateJob(JobKindPhoto, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Id == first.Id {
+		t.Error("no job was created for the claimed photo")
+	}
+
+	// The retry is left to the pending job.
+	err = RetryJob(first.Id, "cannot decode", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := GetJobById(first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobStateDone {
+		t.Errorf("retried job: got state %s, want %s", job.State, JobStateDone)
+	}
+
+	// So is the requeue of a dead job.
+	err = FailJob(first.Id, "cannot decode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RequeueJob(first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err = GetJobById(first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobStateDone {
+		t.Errorf("requeued job: got state %s, want %s", job.State, JobStateDone)
+	}
+	if n := countTestJobs(t, JobKindPhoto, 1); n != 2 {
+		t.Errorf("%d photo jobs, want 2", n)
+	}
+}
+
+func TestUniquePendingJobsMigration(t *testing.T) {
+	newTestDb(t)
+
+	_, err := MigrateDown(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []string{JobStatePending, JobStatePending, JobStateRunning, JobStatePending} {
+		_, err = Db.Exec(
+			`INSERT INTO jobs(kind, target_id, state, run_at, tm) VALUES ($1, 1, $2, NOW(), NOW())`,
+			JobKindPhoto, state,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = MigrateUp(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countTestJobs(t, JobKindPhoto, 1); n != 2 {
+		t.Errorf("%d photo jobs, want the first pending and the running ones", n)
+	}
+}
+
+func countTestJobs(t *testing.T, kind string, targetId int64) int {
+	var count int
+	err := Db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE kind = $1 AND target_id = $2`, kind, targetId).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
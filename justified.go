@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+)
+
+// Justified photostream layout: photos keep their aspect ratios and are
+// scaled so that every row fills the whole width, like on Flickr.
+const (
+	JustifiedWidth     = 1050 // width of #wrapper in quiet.css
+	JustifiedRowHeight = 220
+	JustifiedGap       = 6
+)
+
+type JustifiedPhoto struct {
+	Photo  *Photo
+	Width  int
+	Height int
+	Suffix string
+}
+
+type JustifiedRow struct {
+	Photos []*JustifiedPhoto
+}
+
+// Aspect ratio of a photo. Photos without stored dimensions are
+// shown as squares.
+func photoAspectRatio(photo *Photo) float64 {
+	if photo.Width == 0 || photo.Height == 0 {
+		return 1
+	}
+	return float64(photo.Width) / float64(photo.Height)
+}
+
+// Splits the photos into rows of the given width. Photos are added to
+// a row until it is wider than the width at rowHeight, then the row is
+// scaled down to fit. The last row keeps rowHeight.
+func JustifyPhotos(photos []*Photo, width int, rowHeight int, gap int) []*JustifiedRow {
+	rows := make([]*JustifiedRow, 0, 1)
+
+	start := 0
+	aspectSum := 0.0
+
+	for i, photo := range photos {
+		aspectSum += photoAspectRatio(photo)
+		n := i - start + 1
+
+		if aspectSum*float64(rowHeight)+float64(gap*(n-1)) >= float64(width) {
+			height := float64(width-gap*(n-1)) / aspectSum
+			rows = append(rows, justifyRow(photos[start:i+1], height, width-gap*(n-1)))
+			start = i + 1
+			aspectSum = 0
+		}
+	}
+
+	if start < len(photos) {
+		rows = append(rows, justifyRow(photos[start:], float64(rowHeight), 0))
+	}
+
+	return rows
+}
+
+// Makes a row of photos of the given height. If photosWidth is set,
+// the rounding error is given to the last photo, so that the photos
+// take exactly photosWidth pixels.
+func justifyRow(photos []*Photo, height float64, photosWidth int) *JustifiedRow {
+	row := &JustifiedRow{Photos: make([]*JustifiedPhoto, 0, len(photos))}
+	h := int(math.Floor(height))
+
+	total := 0
+	for i, photo := range photos {
+		w := int(math.Floor(photoAspectRatio(photo)*height + 0.5))
+		if photosWidth > 0 && i == len(photos)-1 {
+			w = photosWidth - total
+		}
+		total += w
+
+		row.Photos = append(row.Photos, &JustifiedPhoto{
+			Photo:  photo,
+			Width:  w,
+			Height: h,
+			Suffix: justifiedPhotoSuffix(photo, w, h),
+		})
+	}
+	return row
+}
+
+// Returns the smallest pre-generated derivative that covers the given
+// box, or the largest one.
+func justifiedPhotoSuffix(photo *Photo, width int, height int) string {
+	suffix := ""
+	for _, sz := range PhotoSizes {
+		if sz.Type != "fit" {
+			continue
+		}
+		suffix = sz.Suffix
+
+		size := photo.Size(sz.Suffix)
+		if size.Width == 0 {
+			size = ImageSize{sz.Width, sz.Height}
+		}
+		if size.Width >= width && size.Height >= height {
+			break
+		}
+	}
+	return suffix
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Limits of uploaded images. A small file can decode to a huge image,
+// so the dimensions are checked from the image header before decoding.
+const (
+	DefaultMaxUploadSize      = 50    // megabytes
+	DefaultMaxImageDimension  = 20000 // pixels
+	DefaultMaxImageMegapixels = 100
+
+	// Of all the frames of an animation together.
+	DefaultMaxAnimationMegapixels = 500
+)
+
+func getEnvLimit(name string, def int64) int64 {
+	if n, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// Maximum size of an uploaded file in bytes. Set in megabytes by
+// the MAX_UPLOAD_SIZE environment variable.
+func GetMaxUploadSize() int64 {
+	return getEnvLimit("MAX_UPLOAD_SIZE", DefaultMaxUploadSize) * 1024 * 1024
+}
+
+// Maximum width and height of an image in pixels. Set by the
+// MAX_IMAGE_DIMENSION environment variable.
+func GetMaxImageDimension() int64 {
+	return getEnvLimit("MAX_IMAGE_DIMENSION", DefaultMaxImageDimension)
+}
+
+// Maximum number of pixels of an image in millions. Set by the
+// MAX_IMAGE_MEGAPIXELS environment variable.
+func GetMaxImageMegapixels() int64 {
+	return getEnvLimit("MAX_IMAGE_MEGAPIXELS", DefaultMaxImageMegapixels)
+}
+
+// Maximum number of pixels of all the frames of an animated image,
+// in millions. Set by the MAX_ANIMATION_MEGAPIXELS environment variable.
+func GetMaxAnimationMegapixels() int64 {
+	return getEnvLimit("MAX_ANIMATION_MEGAPIXELS", DefaultMaxAnimationMegapixels)
+}
+
+// Returns an error if an image with the given header is too large
+// to be decoded.
+func CheckImageConfig(config image.Config) error {
+	w, h := int64(config.Width), int64(config.Height)
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("Invalid image size: %dx%d", w, h)
+	}
+
+	maxDimension := GetMaxImageDimension()
+	if w > maxDimension || h > maxDimension {
+		return fmt.Errorf(
+			"The image is too large: %dx%d pixels, the limit is %d pixels per side",
+			w, h, maxDimension,
+		)
+	}
+
+	maxMegapixels := GetMaxImageMegapixels()
+	if w*h > maxMegapixels*1000000 {
+		return fmt.Errorf(
+			"The image is too large: %.1f megapixels, the limit is %d megapixels",
+			float64(w*h)/1000000, maxMegapixels,
+		)
+	}
+
+	return nil
+}
+
+// Returns an error if an animation has too many pixels in all its
+// frames together to be processed. Frames are processed at the size
+// of the whole animation.
+func CheckAnimationSize(frames int, width int, height int) error {
+	pixels := int64(frames) * int64(width) * int64(height)
+
+	maxMegapixels := GetMaxAnimationMegapixels()
+	if pixels > maxMegapixels*1000000 {
+		return fmt.Errorf(
+			"The animation is too large: %d frames, %.1f megapixels, the limit is %d megapixels",
+			frames, float64(pixels)/1000000, maxMegapixels,
+		)
+	}
+	return nil
+}
+
+// Returned for uploads over the upload size limit.
+type UploadTooLargeError struct {
+	Limit int64
+}
+
+func (e *UploadTooLargeError) Error() string {
+	return fmt.Sprintf("The file is too large, the limit is %s", FormatSize(e.Limit))
+}
+
+// Whether an upload failed because of its size, either the file
+// or the whole request body, see limitUploadBody.
+func IsUploadTooLarge(err error) bool {
+	var tooLarge *UploadTooLargeError
+	var bodyTooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge) || errors.As(err, &bodyTooLarge)
+}
+
+// Reads an uploaded file, up to the upload size limit.
+func ReadUpload(r io.Reader) ([]byte, error) {
+	maxSize := GetMaxUploadSize()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, &UploadTooLargeError{Limit: maxSize}
+	}
+	return data, nil
+}
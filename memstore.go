@@ -0,0 +1,953 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// In-memory stores, for running the web handlers without a database.
+// They follow the database queries: listings return processed photos
+// only, in the same orders, and results are copies, so changing them
+// doesn't change the stores.
+type memData struct {
+	mu sync.Mutex
+
+	lastId    int64
+	users     map[int64]*User
+	photos    map[int64]*Photo
+	metadata  map[int64]*PhotoMetadata
+	comments  map[int64]*Comment
+	favorites map[int64]*Favorite
+	contacts  map[int64]*Contact
+	versions  map[int64]*PhotoVersion
+	jobs      map[int64]*Job
+}
+
+func NewMemoryStores() Stores {
+	data := &memData{
+		users:     make(map[int64]*User),
+		photos:    make(map[int64]*Photo),
+		metadata:  make(map[int64]*PhotoMetadata),
+		comments:  make(map[int64]*Comment),
+		favorites: make(map[int64]*Favorite),
+		contacts:  make(map[int64]*Contact),
+		versions:  make(map[int64]*PhotoVersion),
+		jobs:      make(map[int64]*Job),
+	}
+	return Stores{
+		Users:     &MemUserStore{data},
+		Photos:    &MemPhotoStore{data},
+		Comments:  &MemCommentStore{data},
+		Favorites: &MemFavoriteStore{data},
+		Contacts:  &MemContactStore{data},
+		Versions:  &MemVersionStore{data},
+		Jobs:      &MemJobStore{data},
+	}
+}
+
+func (d *memData) nextId() int64 {
+	d.lastId++
+	return d.lastId
+}
+
+func (d *memData) user(id int64) *User {
+	if user, ok := d.users[id]; ok {
+		return user
+	}
+	return &User{}
+}
+
+// Returns a copy of a photo with the fields the queries join in.
+func (d *memData) photo(p *Photo) *Photo {
+	photo := *p
+
+	photo.Sizes = make(map[string]ImageSize, len(p.Sizes))
+	for suffix, size := range p.Sizes {
+		photo.Sizes[suffix] = size
+	}
+	photo.Edits = append([]PhotoEdit{}, p.Edits...)
+
+	user := d.user(p.UserId)
+	photo.UserUsername = user.Username
+	photo.UserRealName = user.RealName
+
+	for _, c := range d.comments {
+		if c.PhotoId == p.Id {
+			photo.CommentsCount++
+		}
+	}
+	for _, f := range d.favorites {
+		if f.PhotoId == p.Id {
+			photo.FavoritesCount++
+		}
+	}
+	return &photo
+}
+
+// Returns the processed photos of the given color for which keep returns
+// true, in the order of photoSortKeyOf.
+func (d *memData) listPhotos(order string, color string, keep func(p *Photo) bool) []*Photo {
+	result := make([]*Photo, 0, 1)
+	for _, p := range d.photos {
+		if p.Processed == 1 && (color == "" || p.Color == color) && keep(p) {
+			result = append(result, p)
+		}
+	}
+	sortPhotos(result, memPhotoSortKey(order))
+	return result
+}
+
+// Returns the sort key of photos in an order, like photoSortKeyOf.
+func memPhotoSortKey(order string) func(p *Photo) time.Time {
+	return func(p *Photo) time.Time {
+		if order == PhotoOrderTaken && !p.TakenAt.IsZero() {
+			return p.TakenAt
+		}
+		return p.Tm
+	}
+}
+
+// Sorts photos by key and ID, newest first.
+func sortPhotos(photos []*Photo, key func(p *Photo) time.Time) {
+	sort.Slice(photos, func(i, j int) bool {
+		return PhotoCursor{Tm: key(photos[j]), Id: photos[j].Id}.IsNewer(key(photos[i]), photos[i].Id)
+	})
+}
+
+func (d *memData) slice(photos []*Photo, offset int, limit int) []*Photo {
+	result := make([]*Photo, 0, 1)
+	for i := offset; i < len(photos) && i < offset+limit; i++ {
+		result = append(result, d.photo(photos[i]))
+	}
+	return result
+}
+
+// Returns a page of photos sorted by sortPhotos, like queryPhotoPage.
+func (d *memData) page(photos []*Photo, key func(p *Photo) time.Time, cursor PhotoCursor, limit int) *PhotoPage {
+	result := make([]*Photo, 0, limit+1)
+	keys := make([]time.Time, 0, limit+1)
+
+	for i := range photos {
+		if len(result) > limit {
+			break
+		}
+		p := photos[i]
+		if cursor.Newer {
+			p = photos[len(photos)-1-i]
+		}
+		if !cursor.IsZero() && (p.Id == cursor.Id || cursor.IsNewer(key(p), p.Id) != cursor.Newer) {
+			continue
+		}
+		result = append(result, d.photo(p))
+		keys = append(keys, key(p))
+	}
+	return newPhotoPage(result, keys, cursor, limit)
+}
+
+// Returns the cursor of the photo at offset, like queryPhotoCursor.
+func (d *memData) cursorAt(photos []*Photo, key func(p *Photo) time.Time, offset int) PhotoCursor {
+	if offset < 0 || offset >= len(photos) {
+		return PhotoCursor{}
+	}
+	p := photos[offset]
+	return PhotoCursor{Tm: key(p), Id: p.Id}
+}
+
+func (d *memData) isContacted(userId int64, contactId int64) bool {
+	for _, c := range d.contacts {
+		if c.UserId == userId && c.ContactId == contactId {
+			return true
+		}
+	}
+	return false
+}
+
+type MemUserStore struct {
+	data *memData
+}
+
+func (s *MemUserStore) CreatePersona(persona string) (*User, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	for _, u := range s.data.users {
+		if u.Persona == persona {
+			return nil, fmt.Errorf("Persona already taken: %s", persona)
+		}
+	}
+
+	user := &User{
+		Id:              s.data.nextId(),
+		Persona:         persona,
+		Tm:              time.Now(),
+		MetadataPrivacy: PrivacyStripPrivate,
+		OriginalsAccess: OriginalsOwner,
+	}
+	s.data.users[user.Id] = user
+
+	result := *user
+	return &result, nil
+}
+
+func (s *MemUserStore) getBy(match func(u *User) bool) (*User, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	for _, u := range s.data.users {
+		if match(u) {
+			result := *u
+			return &result, nil
+		}
+	}
+	return nil, fmt.Errorf("User not found")
+}
+
+func (s *MemUserStore) GetById(id int64) (*User, error) {
+	return s.getBy(func(u *User) bool { return u.Id == id })
+}
+
+func (s *MemUserStore) GetByPersona(persona string) (*User, error) {
+	return s.getBy(func(u *User) bool { return persona != "" && u.Persona == persona })
+}
+
+func (s *MemUserStore) GetByUsername(username string) (*User, error) {
+	return s.getBy(func(u *User) bool { return username != "" && u.Username == username })
+}
+
+func (s *MemUserStore) Update(user *User) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.users[user.Id]; !ok {
+		return fmt.Errorf("User not found: %d", user.Id)
+	}
+	for _, u := range s.data.users {
+		if u.Id == user.Id {
+			continue
+		}
+		if user.Username != "" && u.Username == user.Username {
+			return fmt.Errorf("Username already taken: %s", user.Username)
+		}
+		if user.Persona != "" && u.Persona == user.Persona {
+			return fmt.Errorf("Persona already taken: %s", user.Persona)
+		}
+	}
+
+	updated := *user
+	s.data.users[user.Id] = &updated
+	return nil
+}
+
+type MemPhotoStore struct {
+	data *memData
+}
+
+func (s *MemPhotoStore) Create(userId int64, title string, description string, format string) (*Photo, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.users[userId]; !ok {
+		return nil, fmt.Errorf("User not found: %d", userId)
+	}
+
+	photo := &Photo{
+		Id:          s.data.nextId(),
+		UserId:      userId,
+		RandId:      GetRandId(20),
+		Tm:          time.Now(),
+		Processed:   0,
+		Title:       title,
+		Description: description,
+		ViewsCount:  0,
+		Format:      format,
+		Ext:         "jpg",
+		Frames:      1,
+		Edits:       []PhotoEdit{},
+	}
+	s.data.photos[photo.Id] = photo
+
+	return s.data.photo(photo), nil
+}
+
+func (s *MemPhotoStore) GetById(id int64) (*Photo, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photo, ok := s.data.photos[id]
+	if !ok {
+		return nil, fmt.Errorf("Photo not found: %d", id)
+	}
+	return s.data.photo(photo), nil
+}
+
+func (s *MemPhotoStore) Delete(id int64) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	delete(s.data.photos, id)
+	delete(s.data.metadata, id)
+	for vid, v := range s.data.versions {
+		if v.PhotoId == id {
+			delete(s.data.versions, vid)
+		}
+	}
+	for cid, c := range s.data.comments {
+		if c.PhotoId == id {
+			delete(s.data.comments, cid)
+		}
+	}
+	for fid, f := range s.data.favorites {
+		if f.PhotoId == id {
+			delete(s.data.favorites, fid)
+		}
+	}
+	return nil
+}
+
+func (s *MemPhotoStore) update(id int64, fn func(p *Photo)) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if photo, ok := s.data.photos[id]; ok {
+		fn(photo)
+	}
+	return nil
+}
+
+func (s *MemPhotoStore) IncViewsCount(id int64) error {
+	return s.update(id, func(p *Photo) { p.ViewsCount++ })
+}
+
+func (s *MemPhotoStore) SetPosterFrame(id int64, frame int, randId string) error {
+	return s.update(id, func(p *Photo) {
+		p.PosterFrame = frame
+		p.RandId = randId
+	})
+}
+
+func (s *MemPhotoStore) SetEdits(id int64, edits []PhotoEdit, randId string) error {
+	return s.update(id, func(p *Photo) {
+		p.Edits = append([]PhotoEdit{}, edits...)
+		p.RandId = randId
+	})
+}
+
+// Stands in for the workers, which don't run against the memory stores.
+func (s *MemPhotoStore) SetProcessed(id int64, processed int) error {
+	return s.update(id, func(p *Photo) { p.Processed = processed })
+}
+
+func (s *MemPhotoStore) GetByUserId(userId int64, order string, color string, cursor PhotoCursor, limit int) (*PhotoPage, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos := s.data.listPhotos(order, color, func(p *Photo) bool {
+		return p.UserId == userId
+	})
+	return s.data.page(photos, memPhotoSortKey(order), cursor, limit), nil
+}
+
+func (s *MemPhotoStore) CursorByUserId(userId int64, order string, color string, offset int) (PhotoCursor, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos := s.data.listPhotos(order, color, func(p *Photo) bool {
+		return p.UserId == userId
+	})
+	return s.data.cursorAt(photos, memPhotoSortKey(order), offset), nil
+}
+
+func (s *MemPhotoStore) CountByUserId(userId int64, color string) (int, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos := s.data.listPhotos("", color, func(p *Photo) bool {
+		return p.UserId == userId
+	})
+	return len(photos), nil
+}
+
+func (s *MemPhotoStore) GetContactsPhotos(userId int64, order string, color string, cursor PhotoCursor, limit int) (*PhotoPage, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos := s.data.listPhotos(order, color, func(p *Photo) bool {
+		return s.data.isContacted(userId, p.UserId)
+	})
+	return s.data.page(photos, memPhotoSortKey(order), cursor, limit), nil
+}
+
+func (s *MemPhotoStore) ContactsPhotosCursor(userId int64, order string, color string, offset int) (PhotoCursor, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos := s.data.listPhotos(order, color, func(p *Photo) bool {
+		return s.data.isContacted(userId, p.UserId)
+	})
+	return s.data.cursorAt(photos, memPhotoSortKey(order), offset), nil
+}
+
+func (s *MemPhotoStore) CountContactsPhotos(userId int64, color string) (int, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos := s.data.listPhotos("", color, func(p *Photo) bool {
+		return s.data.isContacted(userId, p.UserId)
+	})
+	return len(photos), nil
+}
+
+// Favorite photos are listed by the time they were favorited.
+func (d *memData) favoritePhotos(userId int64, color string) ([]*Photo, func(p *Photo) time.Time) {
+	favorited := make(map[int64]*Favorite)
+	for _, f := range d.favorites {
+		if f.UserId == userId {
+			favorited[f.PhotoId] = f
+		}
+	}
+
+	photos := d.listPhotos("", color, func(p *Photo) bool {
+		return favorited[p.Id] != nil
+	})
+	key := func(p *Photo) time.Time {
+		return favorited[p.Id].Tm
+	}
+	sortPhotos(photos, key)
+	return photos, key
+}
+
+func (s *MemPhotoStore) GetFavorites(userId int64, color string, cursor PhotoCursor, limit int) (*PhotoPage, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos, key := s.data.favoritePhotos(userId, color)
+	return s.data.page(photos, key, cursor, limit), nil
+}
+
+func (s *MemPhotoStore) FavoritesCursor(userId int64, color string, offset int) (PhotoCursor, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos, key := s.data.favoritePhotos(userId, color)
+	return s.data.cursorAt(photos, key, offset), nil
+}
+
+func (s *MemPhotoStore) GetLatest(color string, offset int, limit int) ([]*Photo, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos := s.data.listPhotos(PhotoOrderUploaded, color, func(p *Photo) bool {
+		return true
+	})
+	return s.data.slice(photos, offset, limit), nil
+}
+
+func (s *MemPhotoStore) GetMetadata(id int64) (*PhotoMetadata, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if m, ok := s.data.metadata[id]; ok {
+		metadata := *m
+		return &metadata, nil
+	}
+	return &PhotoMetadata{PhotoId: id}, nil
+}
+
+func (s *MemPhotoStore) GetDuplicates(photo *Photo) ([]*Photo, error) {
+	if !photo.HasHash {
+		return []*Photo{}, nil
+	}
+
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos := s.data.listPhotos(PhotoOrderUploaded, "", func(p *Photo) bool {
+		return p.UserId == photo.UserId && p.Id != photo.Id && p.HasHash &&
+			HashDistance(p.Hash, photo.Hash) <= DuplicateMaxDistance
+	})
+	return s.data.slice(photos, 0, len(photos)), nil
+}
+
+func (s *MemPhotoStore) GetDuplicatePairs(userId int64, since time.Time, limit int) ([]*DuplicatePair, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	photos := s.data.listPhotos(PhotoOrderUploaded, "", func(p *Photo) bool {
+		return p.UserId == userId && p.HasHash
+	})
+
+	result := make([]*DuplicatePair, 0, 1)
+	for i, a := range photos {
+		if a.Tm.Before(since) {
+			break
+		}
+		// The photos are sorted newest first, so the older ones follow.
+		for _, b := range photos[i+1:] {
+			if len(result) >= limit {
+				return result, nil
+			}
+			distance := HashDistance(a.Hash, b.Hash)
+			if distance <= DuplicateMaxDistance {
+				result = append(result, &DuplicatePair{s.data.photo(a), s.data.photo(b), distance})
+			}
+		}
+	}
+	return result, nil
+}
+
+type MemCommentStore struct {
+	data *memData
+}
+
+// Returns a copy of a comment with the author's names.
+func (d *memData) comment(c *Comment) *Comment {
+	cmt := *c
+	user := d.user(c.UserId)
+	cmt.UserUsername = user.Username
+	cmt.UserRealName = user.RealName
+	return &cmt
+}
+
+func (s *MemCommentStore) Create(userId int64, photoId int64, comment string) (*Comment, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.photos[photoId]; !ok {
+		return nil, fmt.Errorf("Photo not found: %d", photoId)
+	}
+
+	cmt := &Comment{
+		Id:      s.data.nextId(),
+		UserId:  userId,
+		PhotoId: photoId,
+		Comment: comment,
+		Tm:      time.Now(),
+	}
+	s.data.comments[cmt.Id] = cmt
+
+	result := *cmt
+	return &result, nil
+}
+
+func (s *MemCommentStore) GetById(id int64) (*Comment, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	cmt, ok := s.data.comments[id]
+	if !ok {
+		return nil, fmt.Errorf("Comment not found: %d", id)
+	}
+	return s.data.comment(cmt), nil
+}
+
+func (s *MemCommentStore) GetByPhotoId(photoId int64) ([]*Comment, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	result := make([]*Comment, 0, 10)
+	for _, c := range s.data.comments {
+		if c.PhotoId == photoId {
+			result = append(result, s.data.comment(c))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Tm.Equal(result[j].Tm) {
+			return result[i].Tm.Before(result[j].Tm)
+		}
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+func (s *MemCommentStore) Delete(id int64) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	delete(s.data.comments, id)
+	return nil
+}
+
+type MemFavoriteStore struct {
+	data *memData
+}
+
+func (s *MemFavoriteStore) Create(userId int64, photoId int64) (*Favorite, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.photos[photoId]; !ok {
+		return nil, fmt.Errorf("Photo not found: %d", photoId)
+	}
+	for _, f := range s.data.favorites {
+		if f.UserId == userId && f.PhotoId == photoId {
+			return nil, fmt.Errorf("Photo already favorited: %d", photoId)
+		}
+	}
+
+	fav := &Favorite{
+		Id:      s.data.nextId(),
+		UserId:  userId,
+		PhotoId: photoId,
+		Tm:      time.Now(),
+	}
+	s.data.favorites[fav.Id] = fav
+
+	result := *fav
+	return &result, nil
+}
+
+func (s *MemFavoriteStore) IsFavorited(userId int64, photoId int64) (bool, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	for _, f := range s.data.favorites {
+		if f.UserId == userId && f.PhotoId == photoId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemFavoriteStore) Delete(userId int64, photoId int64) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	for id, f := range s.data.favorites {
+		if f.UserId == userId && f.PhotoId == photoId {
+			delete(s.data.favorites, id)
+		}
+	}
+	return nil
+}
+
+// Unlike the listing, the count includes photos not processed yet,
+// as GetFavoritesCountByUserId does.
+func (s *MemFavoriteStore) CountByUserId(userId int64, color string) (int, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	count := 0
+	for _, f := range s.data.favorites {
+		p, ok := s.data.photos[f.PhotoId]
+		if f.UserId == userId && ok && (color == "" || p.Color == color) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+type MemContactStore struct {
+	data *memData
+}
+
+func (s *MemContactStore) Create(userId int64, contactId int64) (*Contact, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	if _, ok := s.data.users[contactId]; !ok {
+		return nil, fmt.Errorf("User not found: %d", contactId)
+	}
+	if s.data.isContacted(userId, contactId) {
+		return nil, fmt.Errorf("Contact already added: %d", contactId)
+	}
+
+	cnt := &Contact{
+		Id:        s.data.nextId(),
+		UserId:    userId,
+		ContactId: contactId,
+		Tm:        time.Now(),
+	}
+	s.data.contacts[cnt.Id] = cnt
+
+	result := *cnt
+	return &result, nil
+}
+
+func (s *MemContactStore) IsContacted(userId int64, contactId int64) (bool, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	return s.data.isContacted(userId, contactId), nil
+}
+
+func (s *MemContactStore) Delete(userId int64, contactId int64) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	for id, c := range s.data.contacts {
+		if c.UserId == userId && c.ContactId == contactId {
+			delete(s.data.contacts, id)
+		}
+	}
+	return nil
+}
+
+// Contacts are listed by username.
+func (s *MemContactStore) GetByUserId(userId int64) ([]*Contact, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	result := make([]*Contact, 0, 1)
+	for _, c := range s.data.contacts {
+		if c.UserId != userId {
+			continue
+		}
+		cnt := *c
+		user, contact := s.data.user(c.UserId), s.data.user(c.ContactId)
+		cnt.UserUsername, cnt.UserRealName = user.Username, user.RealName
+		cnt.ContactUsername, cnt.ContactRealName = contact.Username, contact.RealName
+		result = append(result, &cnt)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ContactUsername < result[j].ContactUsername
+	})
+	return result, nil
+}
+
+type MemVersionStore struct {
+	data *memData
+}
+
+// Returns a version as the photo as it is now, with the fields
+// the version keeps, like scanPhotoVersion.
+func (d *memData) version(v *PhotoVersion, photo *Photo) *PhotoVersion {
+	old := *photo
+	old.RandId = v.Photo.RandId
+	old.Format = v.Photo.Format
+	old.Ext = v.Photo.Ext
+	old.Frames = v.Photo.Frames
+	old.PosterFrame = v.Photo.PosterFrame
+	old.Edits = append([]PhotoEdit{}, v.Photo.Edits...)
+	old.Sizes = nil
+
+	version := *v
+	version.Photo = &old
+	return &version
+}
+
+// Records the current original of a photo as a version, like
+// savePhotoVersion.
+func (d *memData) saveVersion(p *Photo) {
+	old := *p
+	v := &PhotoVersion{Id: d.nextId(), PhotoId: p.Id, Tm: time.Now(), Photo: &old}
+	d.versions[v.Id] = v
+}
+
+func (s *MemVersionStore) GetByPhotoId(photo *Photo) ([]*PhotoVersion, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	result := make([]*PhotoVersion, 0, 1)
+	for _, v := range s.data.versions {
+		if v.PhotoId == photo.Id {
+			result = append(result, s.data.version(v, photo))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id > result[j].Id })
+	return result, nil
+}
+
+func (s *MemVersionStore) GetByRandId(photo *Photo, randId string) (*PhotoVersion, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	for _, v := range s.data.versions {
+		if v.PhotoId == photo.Id && v.Photo.RandId == randId {
+			return s.data.version(v, photo), nil
+		}
+	}
+	return nil, fmt.Errorf("Photo version not found: %d %s", photo.Id, randId)
+}
+
+func (s *MemVersionStore) Replace(photo *Photo, data []byte, format string) error {
+	return replacePhotoOriginal(photo, data, format, func(photoId int64, randId string, format string) error {
+		s.data.mu.Lock()
+		defer s.data.mu.Unlock()
+
+		p, ok := s.data.photos[photoId]
+		if !ok {
+			return fmt.Errorf("Photo not found: %d", photoId)
+		}
+		s.data.saveVersion(p)
+
+		*p = Photo{
+			Id:          p.Id,
+			UserId:      p.UserId,
+			RandId:      randId,
+			Tm:          p.Tm,
+			Processed:   p.Processed,
+			Title:       p.Title,
+			Description: p.Description,
+			ViewsCount:  p.ViewsCount,
+			TakenAt:     p.TakenAt,
+			Format:      format,
+			Ext:         "jpg",
+			Frames:      1,
+			Edits:       []PhotoEdit{},
+		}
+		return nil
+	})
+}
+
+func (s *MemVersionStore) Rollback(photo *Photo, versionId int64) error {
+	err := movePhotoOriginal(photo)
+	if err != nil {
+		return err
+	}
+
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	v, ok := s.data.versions[versionId]
+	if !ok || v.PhotoId != photo.Id {
+		return fmt.Errorf("Photo version not found: %d", versionId)
+	}
+	p, ok := s.data.photos[photo.Id]
+	if !ok {
+		return fmt.Errorf("Photo not found: %d", photo.Id)
+	}
+	delete(s.data.versions, versionId)
+	s.data.saveVersion(p)
+
+	restored := s.data.version(v, p).Photo
+	restored.Width, restored.Height = 0, 0
+	restored.Hash, restored.HasHash = 0, false
+	restored.BlurHash, restored.DominantColor, restored.Color = "", "", ""
+	*p = *restored
+	return nil
+}
+
+// Jobs are only recorded, no worker runs them.
+type MemJobStore struct {
+	data *memData
+}
+
+// Like the jobs_pending_once index, targets get at most one pending job
+// of each kind and payload.
+func (d *memData) pendingJob(kind string, targetId int64, payload string, except int64) *Job {
+	for _, job := range d.jobs {
+		if job.Kind == kind && job.TargetId == targetId && job.Payload == payload &&
+			job.State == JobStatePending && job.Id != except {
+			return job
+		}
+	}
+	return nil
+}
+
+func (d *memData) createJob(kind string, targetId int64, payload string) {
+	if d.pendingJob(kind, targetId, payload, 0) != nil {
+		return
+	}
+
+	now := time.Now()
+	job := &Job{
+		Id:       d.nextId(),
+		Kind:     kind,
+		TargetId: targetId,
+		Payload:  payload,
+		State:    JobStatePending,
+		RunAt:    now,
+		Tm:       now,
+	}
+	d.jobs[job.Id] = job
+}
+
+func (s *MemJobStore) EnqueuePhoto(photo *Photo) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	s.data.createJob(JobKindPhoto, photo.Id, "")
+	return nil
+}
+
+func (s *MemJobStore) EnqueueAvatar(user *User) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	s.data.createJob(JobKindAvatar, user.Id, "")
+	return nil
+}
+
+func (s *MemJobStore) EnqueuePhotoDerivative(photo *Photo, suffix string, format string) error {
+	payload := fmt.Sprintf("%s_%s.%s", photo.RandId, suffix, format)
+
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	// Like CreateJobOnce.
+	for _, job := range s.data.jobs {
+		if job.Kind == JobKindDerivative && job.TargetId == photo.Id && job.Payload == payload &&
+			(job.State == JobStatePending || job.State == JobStateRunning) {
+			return nil
+		}
+	}
+
+	s.data.createJob(JobKindDerivative, photo.Id, payload)
+	return nil
+}
+
+func (s *MemJobStore) GetById(id int64) (*Job, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	job, ok := s.data.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("Job not found: %d", id)
+	}
+	result := *job
+	return &result, nil
+}
+
+func (s *MemJobStore) GetDead() ([]*Job, error) {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	result := make([]*Job, 0, 1)
+	for _, job := range s.data.jobs {
+		if job.State == JobStateDead {
+			dead := *job
+			result = append(result, &dead)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].RunAt.After(result[j].RunAt) })
+	return result, nil
+}
+
+// Stands in for the workers, like MemPhotoStore.SetProcessed.
+func (s *MemJobStore) Fail(id int64, lastError string) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	job, ok := s.data.jobs[id]
+	if !ok {
+		return fmt.Errorf("Job not found: %d", id)
+	}
+	job.State = JobStateDead
+	job.LastError = lastError
+	return nil
+}
+
+func (s *MemJobStore) RequeueDead(job *Job) error {
+	s.data.mu.Lock()
+	defer s.data.mu.Unlock()
+
+	j, ok := s.data.jobs[job.Id]
+	if !ok || j.State != JobStateDead {
+		return fmt.Errorf("Dead job not found: %d", job.Id)
+	}
+	j.State = JobStatePending
+	if s.data.pendingJob(j.Kind, j.TargetId, j.Payload, j.Id) != nil {
+		j.State = JobStateDone
+	}
+	j.Attempts = 0
+	j.LastError = ""
+	j.RunAt = time.Now()
+
+	// Like RequeueDeadJob.
+	if p, ok := s.data.photos[j.TargetId]; ok && j.Kind == JobKindPhoto {
+		p.Processed = 0
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Camera metadata of a photo, taken from the EXIF data of the original.
+// Zero values mean the tag is missing.
+type PhotoMetadata struct {
+	PhotoId      int64
+	CameraMake   string
+	CameraModel  string
+	Lens         string
+	FocalLength  float64
+	Aperture     float64
+	ExposureTime string
+	Iso          int
+	TakenAt      time.Time
+}
+
+func (m *PhotoMetadata) IsEmpty() bool {
+	return m.CameraMake == "" && m.CameraModel == "" && m.Lens == "" &&
+		m.FocalLength == 0 && m.Aperture == 0 && m.ExposureTime == "" &&
+		m.Iso == 0 && m.TakenAt.IsZero()
+}
+
+// Camera returns the camera name, without the make repeated
+// when the model already includes it ("Canon Canon EOS 5D").
+func (m *PhotoMetadata) Camera() string {
+	if strings.HasPrefix(strings.ToLower(m.CameraModel), strings.ToLower(m.CameraMake)) {
+		return m.CameraModel
+	}
+	return strings.TrimSpace(m.CameraMake + " " + m.CameraModel)
+}
+
+// Parses the EXIF data of an image file. Returns an empty metadata
+// if the file has no EXIF data.
+func ExtractPhotoMetadata(data []byte) *PhotoMetadata {
+	m := &PhotoMetadata{}
+
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return m
+	}
+
+	m.CameraMake = exifString(x, exif.Make)
+	m.CameraModel = exifString(x, exif.Model)
+	m.Lens = exifString(x, exif.LensModel)
+
+	if tag, err := x.Get(exif.FocalLength); err == nil {
+		if r, err := tag.Rat(0); err == nil {
+			m.FocalLength, _ = r.Float64()
+		}
+	}
+
+	if tag, err := x.Get(exif.FNumber); err == nil {
+		if r, err := tag.Rat(0); err == nil {
+			m.Aperture, _ = r.Float64()
+		}
+	}
+
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && num > 0 && den > 0 {
+			if num >= den {
+				m.ExposureTime = fmt.Sprintf("%g", float64(num)/float64(den))
+			} else {
+				m.ExposureTime = fmt.Sprintf("1/%d", (den+num/2)/num)
+			}
+		}
+	}
+
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		m.Iso, _ = tag.Int(0)
+	}
+
+	if tm, err := x.DateTime(); err == nil {
+		m.TakenAt = tm
+	}
+
+	return m
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(s, "\x00"))
+}
+
+// Saves the metadata of a photo, replacing the previously saved one,
+// and copies the date taken to the photo.
+func SavePhotoMetadata(m *PhotoMetadata) error {
+	var takenAt pq.NullTime
+	if !m.TakenAt.IsZero() {
+		takenAt = pq.NullTime{Time: m.TakenAt, Valid: true}
+	}
+
+	_, err := Db.Exec(
+		`
+		INSERT INTO photo_metadata(
+			photo_id, camera_make, camera_model, lens, focal_length,
+			aperture, exposure_time, iso, taken_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (photo_id) DO UPDATE SET
+			camera_make = EXCLUDED.camera_make,
+			camera_model = EXCLUDED.camera_model,
+			lens = EXCLUDED.lens,
+			focal_length = EXCLUDED.focal_length,
+			aperture = EXCLUDED.aperture,
+			exposure_time = EXCLUDED.exposure_time,
+			iso = EXCLUDED.iso,
+			taken_at = EXCLUDED.taken_at
+		`,
+		m.PhotoId, m.CameraMake, m.CameraModel, m.Lens, m.FocalLength,
+		m.Aperture, m.ExposureTime, m.Iso, takenAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = Db.Exec(`UPDATE photos SET taken_at = $1 WHERE id = $2`, takenAt, m.PhotoId)
+	return err
+}
+
+func GetPhotoMetadataByPhotoId(photoId int64) (*PhotoMetadata, error) {
+	m := &PhotoMetadata{PhotoId: photoId}
+
+	var takenAt pq.NullTime
+	err := Db.QueryRow(
+		`
+		SELECT
+			camera_make, camera_model, lens, focal_length,
+			aperture, exposure_time, iso, taken_at
+		FROM photo_metadata
+		WHERE photo_id = $1
+		`,
+		photoId,
+	).Scan(
+		&m.CameraMake, &m.CameraModel, &m.Lens, &m.FocalLength,
+		&m.Aperture, &m.ExposureTime, &m.Iso, &takenAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m.TakenAt = takenAt.Time
+	return m, nil
+}
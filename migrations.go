@@ -0,0 +1,771 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Schema changes are numbered migrations. The versions applied to
+// a database are recorded in the schema_migrations table. New migrations
+// are added to the end of the list and never changed once released.
+//
+// The first migrations use IF NOT EXISTS, as they were applied to
+// existing databases by the schema setup they replace. SQLite databases
+// are migrated by the SqliteUp and SqliteDown statements.
+type Migration struct {
+	Version    int
+	Name       string
+	Up         string
+	Down       string
+	SqliteUp   string
+	SqliteDown string
+}
+
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: `
+			CREATE TABLE IF NOT EXISTS users (
+				id BIGSERIAL PRIMARY KEY,
+				persona CHARACTER VARYING(100) UNIQUE,
+				username CHARACTER VARYING(100) UNIQUE,
+				realname CHARACTER VARYING(100) DEFAULT '',
+				tm TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE TABLE IF NOT EXISTS contacts (
+				id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT REFERENCES users(id),
+				contact_id BIGINT REFERENCES users(id),
+				tm TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				CONSTRAINT unique_user_contact UNIQUE (user_id, contact_id)
+			);
+
+			CREATE TABLE IF NOT EXISTS photos (
+				id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT REFERENCES users(id),
+				rand_id CHARACTER VARYING(20) NOT NULL,
+				tm TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				processed NUMERIC(2) DEFAULT 0,
+				title CHARACTER VARYING(100) DEFAULT '',
+				description TEXT DEFAULT '',
+				views_count INTEGER DEFAULT 0
+			);
+
+			CREATE TABLE IF NOT EXISTS favorites (
+				id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT REFERENCES users(id),
+				photo_id BIGINT REFERENCES photos(id),
+				tm TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				CONSTRAINT unique_user_photo UNIQUE (user_id, photo_id)
+			);
+
+			CREATE TABLE IF NOT EXISTS comments (
+				id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT REFERENCES users(id),
+				photo_id BIGINT REFERENCES photos(id),
+				comment TEXT NOT NULL,
+				tm TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS comments;
+			DROP TABLE IF EXISTS favorites;
+			DROP TABLE IF EXISTS photos;
+			DROP TABLE IF EXISTS contacts;
+			DROP TABLE IF EXISTS users;
+		`,
+		SqliteUp: `
+			CREATE TABLE users (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				persona TEXT UNIQUE,
+				username TEXT UNIQUE,
+				realname TEXT DEFAULT '',
+				tm TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE TABLE contacts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER REFERENCES users(id),
+				contact_id INTEGER REFERENCES users(id),
+				tm TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				CONSTRAINT unique_user_contact UNIQUE (user_id, contact_id)
+			);
+
+			CREATE TABLE photos (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER REFERENCES users(id),
+				rand_id TEXT NOT NULL,
+				tm TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				processed INTEGER DEFAULT 0,
+				title TEXT DEFAULT '',
+				description TEXT DEFAULT '',
+				views_count INTEGER DEFAULT 0
+			);
+
+			CREATE TABLE favorites (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER REFERENCES users(id),
+				photo_id INTEGER REFERENCES photos(id),
+				tm TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				CONSTRAINT unique_user_photo UNIQUE (user_id, photo_id)
+			);
+
+			CREATE TABLE comments (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER REFERENCES users(id),
+				photo_id INTEGER REFERENCES photos(id),
+				comment TEXT NOT NULL,
+				tm TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+		`,
+		SqliteDown: `
+			DROP TABLE comments;
+			DROP TABLE favorites;
+			DROP TABLE photos;
+			DROP TABLE contacts;
+			DROP TABLE users;
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "processing jobs",
+		Up: `
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS processing_attempts INTEGER DEFAULT 0;
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS processing_error TEXT DEFAULT '';
+
+			CREATE TABLE IF NOT EXISTS jobs (
+				id BIGSERIAL PRIMARY KEY,
+				kind CHARACTER VARYING(20) NOT NULL,
+				target_id BIGINT NOT NULL,
+				state CHARACTER VARYING(20) NOT NULL DEFAULT 'pending',
+				attempts INTEGER DEFAULT 0,
+				last_error TEXT DEFAULT '',
+				run_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+				locked_until TIMESTAMP WITH TIME ZONE,
+				tm TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX IF NOT EXISTS jobs_kind_state_run_at ON jobs (kind, state, run_at);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS jobs;
+			ALTER TABLE photos DROP COLUMN IF EXISTS processing_error;
+			ALTER TABLE photos DROP COLUMN IF EXISTS processing_attempts;
+		`,
+		SqliteUp: `
+			ALTER TABLE photos ADD COLUMN processing_attempts INTEGER DEFAULT 0;
+			ALTER TABLE photos ADD COLUMN processing_error TEXT DEFAULT '';
+
+			CREATE TABLE jobs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				kind TEXT NOT NULL,
+				target_id INTEGER NOT NULL,
+				state TEXT NOT NULL DEFAULT 'pending',
+				attempts INTEGER DEFAULT 0,
+				last_error TEXT DEFAULT '',
+				run_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				locked_until TIMESTAMP,
+				tm TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX jobs_kind_state_run_at ON jobs (kind, state, run_at);
+		`,
+		SqliteDown: `
+			DROP TABLE jobs;
+			ALTER TABLE photos DROP COLUMN processing_error;
+			ALTER TABLE photos DROP COLUMN processing_attempts;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "photo metadata and formats",
+		Up: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata_privacy CHARACTER VARYING(20) DEFAULT 'strip_private';
+
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS taken_at TIMESTAMP WITH TIME ZONE;
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS format CHARACTER VARYING(10) DEFAULT 'jpeg';
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS ext CHARACTER VARYING(10) DEFAULT 'jpg';
+
+			CREATE TABLE IF NOT EXISTS photo_metadata (
+				photo_id BIGINT PRIMARY KEY REFERENCES photos(id),
+				camera_make CHARACTER VARYING(100) DEFAULT '',
+				camera_model CHARACTER VARYING(100) DEFAULT '',
+				lens CHARACTER VARYING(100) DEFAULT '',
+				focal_length REAL DEFAULT 0,
+				aperture REAL DEFAULT 0,
+				exposure_time CHARACTER VARYING(20) DEFAULT '',
+				iso INTEGER DEFAULT 0,
+				taken_at TIMESTAMP WITH TIME ZONE
+			);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS photo_metadata;
+			ALTER TABLE photos DROP COLUMN IF EXISTS ext;
+			ALTER TABLE photos DROP COLUMN IF EXISTS format;
+			ALTER TABLE photos DROP COLUMN IF EXISTS taken_at;
+			ALTER TABLE users DROP COLUMN IF EXISTS metadata_privacy;
+		`,
+		SqliteUp: `
+			ALTER TABLE users ADD COLUMN metadata_privacy TEXT DEFAULT 'strip_private';
+
+			ALTER TABLE photos ADD COLUMN taken_at TIMESTAMP;
+			ALTER TABLE photos ADD COLUMN format TEXT DEFAULT 'jpeg';
+			ALTER TABLE photos ADD COLUMN ext TEXT DEFAULT 'jpg';
+
+			CREATE TABLE photo_metadata (
+				photo_id INTEGER PRIMARY KEY REFERENCES photos(id),
+				camera_make TEXT DEFAULT '',
+				camera_model TEXT DEFAULT '',
+				lens TEXT DEFAULT '',
+				focal_length REAL DEFAULT 0,
+				aperture REAL DEFAULT 0,
+				exposure_time TEXT DEFAULT '',
+				iso INTEGER DEFAULT 0,
+				taken_at TIMESTAMP
+			);
+		`,
+		SqliteDown: `
+			DROP TABLE photo_metadata;
+			ALTER TABLE photos DROP COLUMN ext;
+			ALTER TABLE photos DROP COLUMN format;
+			ALTER TABLE photos DROP COLUMN taken_at;
+			ALTER TABLE users DROP COLUMN metadata_privacy;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "photo sizes",
+		Up: `
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS width INTEGER DEFAULT 0;
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS height INTEGER DEFAULT 0;
+
+			CREATE TABLE IF NOT EXISTS photo_sizes (
+				photo_id BIGINT REFERENCES photos(id),
+				suffix CHARACTER VARYING(10) NOT NULL,
+				width INTEGER NOT NULL,
+				height INTEGER NOT NULL,
+				PRIMARY KEY (photo_id, suffix)
+			);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS photo_sizes;
+			ALTER TABLE photos DROP COLUMN IF EXISTS height;
+			ALTER TABLE photos DROP COLUMN IF EXISTS width;
+		`,
+		SqliteUp: `
+			ALTER TABLE photos ADD COLUMN width INTEGER DEFAULT 0;
+			ALTER TABLE photos ADD COLUMN height INTEGER DEFAULT 0;
+
+			CREATE TABLE photo_sizes (
+				photo_id INTEGER REFERENCES photos(id),
+				suffix TEXT NOT NULL,
+				width INTEGER NOT NULL,
+				height INTEGER NOT NULL,
+				PRIMARY KEY (photo_id, suffix)
+			);
+		`,
+		SqliteDown: `
+			DROP TABLE photo_sizes;
+			ALTER TABLE photos DROP COLUMN height;
+			ALTER TABLE photos DROP COLUMN width;
+		`,
+	},
+	{
+		Version: 5,
+		Name:    "photo placeholders and colors",
+		Up: `
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS blurhash CHARACTER VARYING(100) DEFAULT '';
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS dominant_color CHARACTER VARYING(7) DEFAULT '';
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS color CHARACTER VARYING(10) DEFAULT '';
+
+			CREATE INDEX IF NOT EXISTS photos_color ON photos (color);
+		`,
+		Down: `
+			DROP INDEX IF EXISTS photos_color;
+			ALTER TABLE photos DROP COLUMN IF EXISTS color;
+			ALTER TABLE photos DROP COLUMN IF EXISTS dominant_color;
+			ALTER TABLE photos DROP COLUMN IF EXISTS blurhash;
+		`,
+		SqliteUp: `
+			ALTER TABLE photos ADD COLUMN blurhash TEXT DEFAULT '';
+			ALTER TABLE photos ADD COLUMN dominant_color TEXT DEFAULT '';
+			ALTER TABLE photos ADD COLUMN color TEXT DEFAULT '';
+
+			CREATE INDEX photos_color ON photos (color);
+		`,
+		SqliteDown: `
+			DROP INDEX photos_color;
+			ALTER TABLE photos DROP COLUMN color;
+			ALTER TABLE photos DROP COLUMN dominant_color;
+			ALTER TABLE photos DROP COLUMN blurhash;
+		`,
+	},
+	{
+		Version: 6,
+		Name:    "perceptual hashes",
+		Up: `
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS phash BIGINT;
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS phash_bands BIGINT[] DEFAULT '{}';
+
+			CREATE INDEX IF NOT EXISTS photos_phash_bands ON photos USING GIN (phash_bands);
+		`,
+		Down: `
+			DROP INDEX IF EXISTS photos_phash_bands;
+			ALTER TABLE photos DROP COLUMN IF EXISTS phash_bands;
+			ALTER TABLE photos DROP COLUMN IF EXISTS phash;
+		`,
+		SqliteUp: `
+			ALTER TABLE photos ADD COLUMN phash INTEGER;
+			ALTER TABLE photos ADD COLUMN phash_bands TEXT DEFAULT '{}';
+		`,
+		SqliteDown: `
+			ALTER TABLE photos DROP COLUMN phash_bands;
+			ALTER TABLE photos DROP COLUMN phash;
+		`,
+	},
+	{
+		Version: 7,
+		Name:    "animated photos",
+		Up: `
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS frames INTEGER NOT NULL DEFAULT 1;
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS poster_frame INTEGER NOT NULL DEFAULT 0;
+		`,
+		Down: `
+			ALTER TABLE photos DROP COLUMN IF EXISTS poster_frame;
+			ALTER TABLE photos DROP COLUMN IF EXISTS frames;
+		`,
+		SqliteUp: `
+			ALTER TABLE photos ADD COLUMN frames INTEGER NOT NULL DEFAULT 1;
+			ALTER TABLE photos ADD COLUMN poster_frame INTEGER NOT NULL DEFAULT 0;
+		`,
+		SqliteDown: `
+			ALTER TABLE photos DROP COLUMN poster_frame;
+			ALTER TABLE photos DROP COLUMN frames;
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "photo edits",
+		Up: `
+			ALTER TABLE photos ADD COLUMN IF NOT EXISTS edits TEXT NOT NULL DEFAULT '';
+		`,
+		Down: `
+			ALTER TABLE photos DROP COLUMN IF EXISTS edits;
+		`,
+		SqliteUp: `
+			ALTER TABLE photos ADD COLUMN edits TEXT NOT NULL DEFAULT '';
+		`,
+		SqliteDown: `
+			ALTER TABLE photos DROP COLUMN edits;
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "photo versions",
+		Up: `
+			CREATE TABLE IF NOT EXISTS photo_versions (
+				id BIGSERIAL PRIMARY KEY,
+				photo_id BIGINT REFERENCES photos(id),
+				rand_id CHARACTER VARYING(20) NOT NULL,
+				format CHARACTER VARYING(10) NOT NULL,
+				ext CHARACTER VARYING(10) NOT NULL,
+				frames INTEGER NOT NULL DEFAULT 1,
+				poster_frame INTEGER NOT NULL DEFAULT 0,
+				edits TEXT NOT NULL DEFAULT '',
+				tm TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX IF NOT EXISTS photo_versions_photo_id ON photo_versions (photo_id);
+		`,
+		Down: `
+			DROP TABLE IF EXISTS photo_versions;
+		`,
+		SqliteUp: `
+			CREATE TABLE photo_versions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				photo_id INTEGER REFERENCES photos(id),
+				rand_id TEXT NOT NULL,
+				format TEXT NOT NULL,
+				ext TEXT NOT NULL,
+				frames INTEGER NOT NULL DEFAULT 1,
+				poster_frame INTEGER NOT NULL DEFAULT 0,
+				edits TEXT NOT NULL DEFAULT '',
+				tm TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+
+			CREATE INDEX photo_versions_photo_id ON photo_versions (photo_id);
+		`,
+		SqliteDown: `
+			DROP TABLE photo_versions;
+		`,
+	},
+	{
+		Version: 10,
+		Name:    "photo counters",
+		Up: `
+			ALTER TABLE photos ADD COLUMN comments_count INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE photos ADD COLUMN favorites_count INTEGER NOT NULL DEFAULT 0;
+		` + recountPhotosQuery,
+		Down: `
+			ALTER TABLE photos DROP COLUMN favorites_count;
+			ALTER TABLE photos DROP COLUMN comments_count;
+		`,
+		SqliteUp: `
+			ALTER TABLE photos ADD COLUMN comments_count INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE photos ADD COLUMN favorites_count INTEGER NOT NULL DEFAULT 0;
+		` + recountPhotosQuery,
+		SqliteDown: `
+			ALTER TABLE photos DROP COLUMN favorites_count;
+			ALTER TABLE photos DROP COLUMN comments_count;
+		`,
+	},
+	{
+		Version: 11,
+		Name:    "job payloads",
+		Up: `
+			ALTER TABLE jobs ADD COLUMN payload TEXT NOT NULL DEFAULT '';
+		`,
+		Down: `
+			ALTER TABLE jobs DROP COLUMN payload;
+		`,
+		SqliteUp: `
+			ALTER TABLE jobs ADD COLUMN payload TEXT NOT NULL DEFAULT '';
+		`,
+		SqliteDown: `
+			ALTER TABLE jobs DROP COLUMN payload;
+		`,
+	},
+	{
+		Version: 12,
+		Name:    "originals access",
+		Up: `
+			ALTER TABLE users ADD COLUMN originals_access CHARACTER VARYING(20) NOT NULL DEFAULT 'owner';
+		`,
+		Down: `
+			ALTER TABLE users DROP COLUMN originals_access;
+		`,
+		SqliteUp: `
+			ALTER TABLE users ADD COLUMN originals_access TEXT NOT NULL DEFAULT 'owner';
+		`,
+		SqliteDown: `
+			ALTER TABLE users DROP COLUMN originals_access;
+		`,
+	},
+	{
+		Version:    13,
+		Name:       "unique pending jobs",
+		Up:         uniquePendingJobsQuery,
+		Down:       `DROP INDEX jobs_pending_once;`,
+		SqliteUp:   uniquePendingJobsQuery,
+		SqliteDown: `DROP INDEX jobs_pending_once;`,
+	},
+}
+
+// A target has at most one pending job of each kind and payload, see
+// CreateJobOnce. Running jobs are left out: a photo edited while its job
+// runs needs another run. Duplicates created before are deleted first.
+const uniquePendingJobsQuery = `
+	DELETE FROM jobs
+	WHERE state = 'pending' AND EXISTS (
+		SELECT 1 FROM jobs j
+		WHERE
+			j.kind = jobs.kind AND j.target_id = jobs.target_id AND j.payload = jobs.payload
+			AND j.state = 'pending' AND j.id < jobs.id
+	);
+	CREATE UNIQUE INDEX jobs_pending_once ON jobs (kind, target_id, payload) WHERE state = 'pending';
+`
+
+// Key of the advisory lock held while migrating, so that nodes starting
+// at the same time don't apply the same migrations.
+const migrationsLockKey = 7305846151
+
+// Applies the pending migrations at startup.
+func DbMigrate() {
+	applied, err := MigrateUp(0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %d: %s\n", m.Version, m.Name)
+	}
+}
+
+// Runs fn with a connection holding the migrations lock. Advisory locks
+// belong to a session, so all the statements go through this connection.
+// SQLite serves a single node, which needs no lock.
+func withMigrationsLock(fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := Db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if Db.Dialect == DialectPostgres {
+		_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationsLockKey)
+		if err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationsLockKey)
+	}
+
+	timestamp := "TIMESTAMP WITH TIME ZONE"
+	if Db.Dialect == DialectSqlite {
+		timestamp = "TIMESTAMP"
+	}
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name CHARACTER VARYING(100) NOT NULL,
+			applied_at `+timestamp+` DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	return fn(ctx, conn)
+}
+
+// Returns the times the applied migrations were applied at, by version.
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	result := make(map[int]time.Time)
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var tm time.Time
+		if err := rows.Scan(&version, &tm); err != nil {
+			return nil, err
+		}
+		result[version] = tm
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Runs a migration and records it in one transaction.
+func runMigration(ctx context.Context, conn *sql.Conn, m Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, m.Sql(up))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Migration %d (%s) failed: %v", m.Version, m.Name, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, Db.Rebind(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`), m.Version, m.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, Db.Rebind(`DELETE FROM schema_migrations WHERE version = $1`), m.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns the statements of the migration for the dialect of the database.
+func (m Migration) Sql(up bool) string {
+	switch {
+	case up && Db.Dialect == DialectSqlite:
+		return m.SqliteUp
+	case up:
+		return m.Up
+	case Db.Dialect == DialectSqlite:
+		return m.SqliteDown
+	}
+	return m.Down
+}
+
+func getMigration(version int) (Migration, bool) {
+	for _, m := range Migrations {
+		if m.Version == version {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+// Applies the pending migrations up to the given version, or all of them
+// if it is 0. Returns the applied migrations.
+func MigrateUp(to int) ([]Migration, error) {
+	result := make([]Migration, 0, 1)
+
+	err := withMigrationsLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range Migrations {
+			if to > 0 && m.Version > to {
+				break
+			}
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			err := runMigration(ctx, conn, m, true)
+			if err != nil {
+				return err
+			}
+			result = append(result, m)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Reverts the given number of the latest applied migrations.
+// Returns the reverted migrations.
+func MigrateDown(steps int) ([]Migration, error) {
+	result := make([]Migration, 0, 1)
+
+	err := withMigrationsLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		// Check all the applied versions first, as a database migrated
+		// by a newer release can't be reverted by this one.
+		for version := range applied {
+			if _, ok := getMigration(version); !ok {
+				return fmt.Errorf("Unknown migration applied: %d", version)
+			}
+		}
+
+		for i := len(Migrations) - 1; i >= 0 && len(result) < steps; i-- {
+			m := Migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			err := runMigration(ctx, conn, m, false)
+			if err != nil {
+				return err
+			}
+			result = append(result, m)
+		}
+		return nil
+	})
+	return result, err
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Returns all the known migrations and whether they are applied.
+func GetMigrationsStatus() ([]MigrationStatus, error) {
+	result := make([]MigrationStatus, 0, len(Migrations))
+
+	err := withMigrationsLock(func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range Migrations {
+			tm, ok := applied[m.Version]
+			result = append(result, MigrationStatus{m, ok, tm})
+			delete(applied, m.Version)
+		}
+
+		// Applied by a newer release.
+		for version, tm := range applied {
+			result = append(result, MigrationStatus{Migration{Version: version, Name: "unknown"}, true, tm})
+		}
+		return nil
+	})
+	return result, err
+}
+
+// RunMigrate implements the "migrate" command.
+func RunMigrate(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s migrate up [-to version] | down [-steps n] | status\n", os.Args[0])
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	switch args[0] {
+
+	case "up":
+
+		fs := flag.NewFlagSet("migrate up", flag.ExitOnError)
+		to := fs.Int("to", 0, "apply the migrations up to this version only")
+		fs.Parse(args[1:])
+
+		applied, err := MigrateUp(*to)
+		for _, m := range applied {
+			fmt.Printf("applied  %3d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot migrate: %v\n", err)
+			os.Exit(1)
+		}
+		if len(applied) == 0 {
+			fmt.Println("No pending migrations")
+		}
+
+	case "down":
+
+		fs := flag.NewFlagSet("migrate down", flag.ExitOnError)
+		steps := fs.Int("steps", 1, "number of migrations to revert")
+		fs.Parse(args[1:])
+
+		reverted, err := MigrateDown(*steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %3d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot migrate: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "status":
+
+		status, err := GetMigrationsStatus()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot get migrations: %v\n", err)
+			os.Exit(1)
+		}
+		for _, s := range status {
+			if s.Applied {
+				fmt.Printf("applied  %3d %s (%s)\n", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Printf("pending  %3d %s\n", s.Version, s.Name)
+			}
+		}
+
+	default:
+
+		usage()
+
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Photostreams are paged by the sort key and ID of photos rather than by
+// offset, so that deep pages are as fast as the first one and new uploads
+// don't shift photos between pages.
+
+// Number of photos on a page of a photostream.
+const PhotostreamPageSize = 30
+
+// Position in a photostream: the sort key and ID of a photo. Older pages
+// start after the photo, newer pages end before it. The zero cursor is
+// the first page.
+type PhotoCursor struct {
+	Tm    time.Time
+	Id    int64
+	Newer bool
+}
+
+func (c PhotoCursor) IsZero() bool {
+	return c.Id == 0
+}
+
+// Returns the cursor as a token for URLs, which doesn't hold the direction.
+func (c PhotoCursor) Token() string {
+	s := fmt.Sprintf("%d.%d.%d", c.Tm.Unix(), c.Tm.Nanosecond(), c.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func ParsePhotoCursor(token string) (PhotoCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return PhotoCursor{}, fmt.Errorf("Invalid cursor: %s", token)
+	}
+
+	parts := strings.Split(string(data), ".")
+	if len(parts) != 3 {
+		return PhotoCursor{}, fmt.Errorf("Invalid cursor: %s", token)
+	}
+	var values [3]int64
+	for i, part := range parts {
+		values[i], err = strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return PhotoCursor{}, fmt.Errorf("Invalid cursor: %s", token)
+		}
+	}
+	if values[2] <= 0 {
+		return PhotoCursor{}, fmt.Errorf("Invalid cursor: %s", token)
+	}
+
+	return PhotoCursor{Tm: time.Unix(values[0], values[1]).UTC(), Id: values[2]}, nil
+}
+
+// Whether the photo with the sort key tm and the ID id is newer than
+// the photo of the cursor.
+func (c PhotoCursor) IsNewer(tm time.Time, id int64) bool {
+	if !tm.Equal(c.Tm) {
+		return tm.After(c.Tm)
+	}
+	return id > c.Id
+}
+
+// A page of a photostream, with the tokens of the cursors of the newer
+// and older pages, or "" if there are none.
+type PhotoPage struct {
+	Photos []*Photo
+	Newer  string
+	Older  string
+}
+
+// Makes a page out of the photos read for a cursor and their sort keys.
+// They are in the direction of the cursor, one more than limit if there
+// are more.
+func newPhotoPage(photos []*Photo, keys []time.Time, cursor PhotoCursor, limit int) *PhotoPage {
+	more := len(photos) > limit
+	if more {
+		photos, keys = photos[:limit], keys[:limit]
+	}
+
+	if cursor.Newer {
+		for i, j := 0, len(photos)-1; i < j; i, j = i+1, j-1 {
+			photos[i], photos[j] = photos[j], photos[i]
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	page := &PhotoPage{Photos: photos}
+	if len(photos) == 0 {
+		return page
+	}
+
+	hasNewer, hasOlder := !cursor.IsZero(), more
+	if cursor.Newer {
+		hasNewer, hasOlder = more, true
+	}
+	if hasNewer {
+		page.Newer = PhotoCursor{Tm: keys[0], Id: photos[0].Id}.Token()
+	}
+	if hasOlder {
+		last := len(photos) - 1
+		page.Older = PhotoCursor{Tm: keys[last], Id: photos[last].Id}.Token()
+	}
+	return page
+}
+
+// Sort key of a photo read with it. SQLite returns the times computed
+// by expressions as text.
+type photoSortKey struct {
+	time.Time
+}
+
+func (k *photoSortKey) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case time.Time:
+		k.Time = v
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("Cannot scan sort key: %T", value)
+	}
+
+	s = strings.TrimSuffix(s, "Z")
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			k.Time = t
+			return nil
+		}
+	}
+	return fmt.Errorf("Cannot parse sort key: %s", s)
+}
+
+// Reads the sort key before the columns of a photo.
+type sortKeyScanner struct {
+	row scanner
+	key *photoSortKey
+}
+
+func (s sortKeyScanner) Scan(dest ...interface{}) error {
+	return s.row.Scan(append([]interface{}{s.key}, dest...)...)
+}
+
+// Reads a page of a photostream. from holds the FROM and WHERE clauses
+// of the query, with args, and key the expression the photos are sorted
+// by. Ties are broken by the photo ID.
+func queryPhotoPage(from string, key string, cursor PhotoCursor, limit int, args ...interface{}) (*PhotoPage, error) {
+	cmp, dir := "<", "DESC"
+	if cursor.Newer {
+		cmp, dir = ">", "ASC"
+	}
+
+	if !cursor.IsZero() {
+		args = append(args, cursor.Tm, cursor.Id)
+		from += fmt.Sprintf(" AND (%s, p.id) %s ($%d, $%d)", key, cmp, len(args)-1, len(args))
+	}
+	args = append(args, limit+1)
+
+	rows, err := Db.Query(
+		fmt.Sprintf(
+			"SELECT %s, %s %s ORDER BY %s %s, p.id %s LIMIT $%d",
+			key, photoColumns, from, key, dir, dir, len(args),
+		),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	photos := make([]*Photo, 0, limit+1)
+	keys := make([]time.Time, 0, limit+1)
+	for rows.Next() {
+		var key photoSortKey
+		photo, err := scanPhoto(sortKeyScanner{rows, &key})
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+		keys = append(keys, key.Time)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = loadPhotoSizes(photos)
+	if err != nil {
+		return nil, err
+	}
+	return newPhotoPage(photos, keys, cursor, limit), nil
+}
+
+// Returns the cursor of the photo at offset in a photostream read like
+// queryPhotoPage, from the newest photo, or the zero cursor if there are
+// not as many photos.
+func queryPhotoCursor(from string, key string, offset int, args ...interface{}) (PhotoCursor, error) {
+	args = append(args, offset)
+
+	var sortKey photoSortKey
+	var cursor PhotoCursor
+	err := Db.QueryRow(
+		fmt.Sprintf(
+			"SELECT %s, p.id %s ORDER BY %s DESC, p.id DESC LIMIT 1 OFFSET $%d",
+			key, from, key, len(args),
+		),
+		args...,
+	).Scan(&sortKey, &cursor.Id)
+	if err == sql.ErrNoRows {
+		return PhotoCursor{}, nil
+	} else if err != nil {
+		return PhotoCursor{}, err
+	}
+
+	cursor.Tm = sortKey.Time
+	return cursor, nil
+}
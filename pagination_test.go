@@ -0,0 +1,219 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Creates processed photos of the user uploaded at the given times,
+// or taken at them if taken is set.
+func createTestPhotos(t *testing.T, userId int64, times []time.Time, taken bool) []*Photo {
+	photos := make([]*Photo, len(times))
+	for i, tm := range times {
+		photo, err := CreatePhoto(userId, "", "", "jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		column := "tm"
+		if taken {
+			column = "taken_at"
+		}
+		_, err = Db.Exec(`UPDATE photos SET processed = 1, `+column+` = $1 WHERE id = $2`, tm, photo.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		photos[i] = photo
+	}
+	return photos
+}
+
+// Checks the IDs of the photos of a page and returns the cursors
+// of the pages around it.
+func checkPhotoPage(t *testing.T, name string, page *PhotoPage, want ...*Photo) (PhotoCursor, PhotoCursor) {
+	t.Helper()
+
+	ok := len(page.Photos) == len(want)
+	for i := 0; ok && i < len(want); i++ {
+		ok = page.Photos[i].Id == want[i].Id
+	}
+	if !ok {
+		got := []int64{}
+		for _, p := range page.Photos {
+			got = append(got, p.Id)
+		}
+		ids := []int64{}
+		for _, p := range want {
+			ids = append(ids, p.Id)
+		}
+		t.Errorf("%s: got photos %v, want %v", name, got, ids)
+	}
+
+	cursor := func(token string) PhotoCursor {
+		if token == "" {
+			return PhotoCursor{}
+		}
+		c, err := ParsePhotoCursor(token)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return c
+	}
+	return cursor(page.Newer), cursor(page.Older)
+}
+
+func TestQueryPhotoPage(t *testing.T) {
+	newTestDb(t)
+
+	user, err := CreatePersonaUser("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The three photos in the middle were uploaded at the same time,
+	// their order is the order of their IDs.
+	base := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	p := createTestPhotos(t, user.Id, []time.Time{
+		base, base.Add(time.Hour), base.Add(time.Hour), base.Add(time.Hour), base.Add(2 * time.Hour),
+	}, false)
+
+	key := photoSortKeyOf(PhotoOrderUploaded)
+	page, err := queryPhotoPage(userPhotosFrom, key, PhotoCursor{}, 2, user.Id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, older := checkPhotoPage(t, "first page", page, p[4], p[3])
+	if !newer.IsZero() || older.IsZero() {
+		t.Errorf("first page: got newer %+v and older %+v", newer, older)
+	}
+
+	page, err = queryPhotoPage(userPhotosFrom, key, older, 2, user.Id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, older = checkPhotoPage(t, "second page", page, p[2], p[1])
+	if newer.IsZero() || older.IsZero() {
+		t.Errorf("second page: got newer %+v and older %+v", newer, older)
+	}
+
+	last, err := queryPhotoPage(userPhotosFrom, key, older, 2, user.Id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, older := checkPhotoPage(t, "last page", last, p[0]); !older.IsZero() {
+		t.Errorf("last page: got older %+v", older)
+	}
+
+	newer.Newer = true
+	page, err = queryPhotoPage(userPhotosFrom, key, newer, 2, user.Id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newer, _ := checkPhotoPage(t, "newer page", page, p[4], p[3]); !newer.IsZero() {
+		t.Errorf("newer page: got newer %+v", newer)
+	}
+
+	for offset, want := range []*Photo{p[4], p[3], p[2], p[1], p[0]} {
+		cursor, err := queryPhotoCursor(userPhotosFrom, key, offset, user.Id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor.Id != want.Id {
+			t.Errorf("cursor at %d: got photo %d, want %d", offset, cursor.Id, want.Id)
+		}
+	}
+	cursor, err := queryPhotoCursor(userPhotosFrom, key, 5, user.Id, "")
+	if err != nil || !cursor.IsZero() {
+		t.Errorf("cursor after the last photo: got %+v, %v", cursor, err)
+	}
+}
+
+func TestPhotostreamCursors(t *testing.T) {
+	newTestDb(t)
+
+	alice, err := CreatePersonaUser("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := CreatePersonaUser("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	uploaded := createTestPhotos(t, alice.Id, []time.Time{base, base.Add(time.Hour)}, false)
+
+	// Taken before the uploaded ones, and sorted among them by the time
+	// they were taken, which SQLite returns as text.
+	taken := createTestPhotos(t, alice.Id, []time.Time{base.Add(-time.Hour), base.Add(30 * time.Minute)}, true)
+	_, err = Db.Exec(`UPDATE photos SET tm = $1 WHERE id IN ($2, $3)`, base.Add(2*time.Hour), taken[0].Id, taken[1].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := []*Photo{uploaded[1], taken[1], uploaded[0], taken[0]}
+	for offset, want := range order {
+		cursor, err := GetPhotosCursorByUserId(alice.Id, PhotoOrderTaken, "", offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor.Id != want.Id {
+			t.Errorf("taken, cursor at %d: got photo %d, want %d", offset, cursor.Id, want.Id)
+		}
+	}
+
+	// The page of a numbered page starts after the cursor of the photo
+	// before it.
+	cursor, err := GetPhotosCursorByUserId(alice.Id, PhotoOrderTaken, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := GetPhotosByUserId(alice.Id, PhotoOrderTaken, "", cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPhotoPage(t, "taken, second page", page, order[2], order[3])
+
+	// Photos of contacts.
+	_, err = CreateContact(bob.Id, alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err = GetContactsPhotosCursorByUserId(bob.Id, PhotoOrderUploaded, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = GetContactsPhotosByUserId(bob.Id, PhotoOrderUploaded, "", cursor, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPhotoPage(t, "contacts", page, uploaded[1], uploaded[0])
+
+	// Favorites are sorted by the time they were favorited.
+	for i, photo := range []*Photo{uploaded[0], taken[0], uploaded[1]} {
+		_, err = CreateFavorite(bob.Id, photo.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Db.Exec(`UPDATE favorites SET tm = $1 WHERE photo_id = $2`, base.Add(time.Duration(i)*time.Hour), photo.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor, err = GetFavoritePhotosCursorByUserId(bob.Id, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor.Id != uploaded[1].Id {
+		t.Errorf("favorites, cursor at 0: got photo %d, want %d", cursor.Id, uploaded[1].Id)
+	}
+	page, err = GetFavoritePhotosByUserId(bob.Id, "", cursor, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPhotoPage(t, "favorites", page, taken[0], uploaded[0])
+
+	cursor, err = GetFavoritePhotosCursorByUserId(bob.Id, "", 3)
+	if err != nil || !cursor.IsZero() {
+		t.Errorf("favorites, cursor after the last photo: got %+v, %v", cursor, err)
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type Photo struct {
@@ -15,6 +18,36 @@ type Photo struct {
 	Title       string
 	Description string
 	ViewsCount  int
+	TakenAt     time.Time
+	Format      string
+	Ext         string
+
+	// Dimensions of the original, after the EXIF orientation is applied,
+	// and of the derivatives by suffix. Zero until the photo is processed.
+	Width  int
+	Height int
+	Sizes  map[string]ImageSize
+
+	// Placeholder shown while the photo loads, and the name of
+	// the dominant color from PhotoColors.
+	BlurHash      string
+	DominantColor string
+	Color         string
+
+	// Perceptual hash, see PerceptualHash.
+	Hash    uint64
+	HasHash bool
+
+	// Number of frames of an animated GIF, 1 for other photos, and
+	// the frame used for thumbnails.
+	Frames      int
+	PosterFrame int
+
+	// Edits applied to the original when the derivatives are made.
+	Edits []PhotoEdit
+
+	ProcessingAttempts int
+	ProcessingError    string
 
 	UserUsername   string
 	UserRealName   string
@@ -22,7 +55,152 @@ type Photo struct {
 	FavoritesCount int
 }
 
-func CreatePhoto(userId int64, title string, description string) (*Photo, error) {
+// Photostream orders.
+const (
+	PhotoOrderUploaded = "uploaded"
+	PhotoOrderTaken    = "taken"
+)
+
+// Columns selected by all photo queries, in the order scanPhoto expects.
+// The queries must name the photos table "p" and join users as "u".
+const photoColumns = `
+	p.id,
+	u.id,
+	COALESCE(u.username, ''),
+	u.realname,
+	p.rand_id,
+	p.tm,
+	p.processed,
+	p.title,
+	p.description,
+	p.views_count,
+	p.taken_at,
+	p.format,
+	p.ext,
+	p.width,
+	p.height,
+	p.blurhash,
+	p.dominant_color,
+	p.color,
+	p.phash,
+	p.frames,
+	p.poster_frame,
+	p.edits,
+	p.processing_attempts,
+	p.processing_error,
+	p.comments_count,
+	p.favorites_count
+`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPhoto(row scanner) (*Photo, error) {
+	photo := &Photo{}
+	var takenAt pq.NullTime
+	var hash sql.NullInt64
+	var edits string
+
+	err := row.Scan(
+		&photo.Id,
+		&photo.UserId, &photo.UserUsername, &photo.UserRealName,
+		&photo.RandId, &photo.Tm, &photo.Processed, &photo.Title,
+		&photo.Description, &photo.ViewsCount, &takenAt,
+		&photo.Format, &photo.Ext, &photo.Width, &photo.Height,
+		&photo.BlurHash, &photo.DominantColor, &photo.Color, &hash,
+		&photo.Frames, &photo.PosterFrame, &edits,
+		&photo.ProcessingAttempts, &photo.ProcessingError,
+		&photo.CommentsCount, &photo.FavoritesCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	photo.TakenAt = takenAt.Time
+	photo.Hash = uint64(hash.Int64)
+	photo.HasHash = hash.Valid
+
+	photo.Edits, err = ParsePhotoEdits(edits)
+	if err != nil {
+		return nil, err
+	}
+	return photo, nil
+}
+
+// Returns the photos with the given IDs by ID. Missing photos are left out.
+func getPhotosByIds(ids []int64) (map[int64]*Photo, error) {
+	result := make(map[int64]*Photo, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	params := make([]string, 0, len(ids))
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+		params = append(params, fmt.Sprintf("$%d", len(args)))
+	}
+
+	photos, err := queryPhotos(
+		`
+		SELECT `+photoColumns+`
+		FROM
+			photos p
+			JOIN users u ON u.id = p.user_id
+		WHERE p.id IN (`+strings.Join(params, ", ")+`)
+		`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, photo := range photos {
+		result[photo.Id] = photo
+	}
+	return result, nil
+}
+
+func queryPhotos(query string, args ...interface{}) ([]*Photo, error) {
+	result := make([]*Photo, 0, 1)
+
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return []*Photo{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		photo, err := scanPhoto(rows)
+		if err != nil {
+			return []*Photo{}, err
+		}
+		result = append(result, photo)
+	}
+
+	if err := rows.Err(); err != nil {
+		return []*Photo{}, err
+	}
+
+	err = loadPhotoSizes(result)
+	if err != nil {
+		return []*Photo{}, err
+	}
+
+	return result, nil
+}
+
+// Returns the sort key of a photostream order, see queryPhotoPage. Photos
+// without a date taken are sorted by their upload date.
+func photoSortKeyOf(order string) string {
+	if order == PhotoOrderTaken {
+		return "COALESCE(p.taken_at, p.tm)"
+	}
+	return "p.tm"
+}
+
+func CreatePhoto(userId int64, title string, description string, format string) (*Photo, error) {
 	photo := &Photo{
 		UserId:      userId,
 		RandId:      GetRandId(20),
@@ -31,16 +209,19 @@ func CreatePhoto(userId int64, title string, description string) (*Photo, error)
 		Title:       title,
 		Description: description,
 		ViewsCount:  0,
+		Format:      format,
+		Ext:         "jpg",
 	}
 
 	err := Db.QueryRow(
 		`
-		INSERT INTO photos(user_id, rand_id, tm, processed, title, description, views_count) 
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO photos(user_id, rand_id, tm, processed, title, description, views_count, format, ext) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		RETURNING id
 		`,
 		photo.UserId, photo.RandId, photo.Tm, photo.Processed,
 		photo.Title, photo.Description, photo.ViewsCount,
+		photo.Format, photo.Ext,
 	).Scan(&photo.Id)
 
 	if err != nil {
@@ -50,40 +231,27 @@ func CreatePhoto(userId int64, title string, description string) (*Photo, error)
 }
 
 func GetPhotoById(id int64) (*Photo, error) {
-	photo := &Photo{Id: id}
-
-	err := Db.QueryRow(
+	photo, err := scanPhoto(Db.QueryRow(
 		`
-		SELECT
-			u.id,
-			COALESCE(u.username, ''),
-			u.realname,
-			p.rand_id,
-			p.tm,
-			p.processed,
-			p.title,
-			p.description,
-			p.views_count,
-			(SELECT COUNT(*) FROM comments c WHERE c.photo_id = p.id),
-			(SELECT COUNT(*) FROM favorites f WHERE f.photo_id = p.id) 
+		SELECT `+photoColumns+`
 		FROM 
 			photos p 
 			JOIN users u ON u.id = p.user_id
-		WHERE p.id=$1
+		WHERE p.id = $1
 		`,
 		id,
-	).Scan(
-		&photo.UserId, &photo.UserUsername, &photo.UserRealName,
-		&photo.RandId, &photo.Tm, &photo.Processed, &photo.Title,
-		&photo.Description, &photo.ViewsCount,
-		&photo.CommentsCount, &photo.FavoritesCount,
-	)
+	))
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("Photo not found: %d", photo.Id)
+		return nil, fmt.Errorf("Photo not found: %d", id)
 	} else if err != nil {
 		return nil, err
 	}
+
+	err = loadPhotoSizes([]*Photo{photo})
+	if err != nil {
+		return nil, err
+	}
 	return photo, nil
 }
 
@@ -97,18 +265,191 @@ func SetPhotoDescription(id int64, description string) error {
 	return err
 }
 
+// Sets the file extension of the photo derivatives.
+func SetPhotoExt(id int64, ext string) error {
+	_, err := Db.Exec(`UPDATE photos SET ext = $1 WHERE id = $2`, ext, id)
+	return err
+}
+
 func SetPhotoProcessed(id int64, processed int) error {
 	_, err := Db.Exec(`UPDATE photos SET processed = $1 WHERE id = $2`, processed, id)
 	return err
 }
 
+// Stores the outcome of the latest processing attempt of a photo.
+func SetPhotoProcessingStatus(id int64, processed int, attempts int, lastError string) error {
+	_, err := Db.Exec(
+		`
+		UPDATE photos 
+		SET processed = $1, processing_attempts = $2, processing_error = $3 
+		WHERE id = $4
+		`,
+		processed, attempts, lastError, id,
+	)
+	return err
+}
+
+// Stores the dimensions of the original and of the derivatives.
+// Derivatives not in sizes keep their previously stored dimensions.
+func SetPhotoSizes(id int64, width int, height int, sizes map[string]ImageSize) error {
+	_, err := Db.Exec(
+		`UPDATE photos SET width = $1, height = $2 WHERE id = $3`,
+		width, height, id,
+	)
+	if err != nil {
+		return err
+	}
+
+	for suffix, size := range sizes {
+		_, err := Db.Exec(
+			`
+			INSERT INTO photo_sizes(photo_id, suffix, width, height)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (photo_id, suffix) DO UPDATE SET
+				width = EXCLUDED.width,
+				height = EXCLUDED.height
+			`,
+			id, suffix, size.Width, size.Height,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func SetPhotoPlaceholder(id int64, blurHash string, dominantColor string, color string) error {
+	_, err := Db.Exec(
+		`UPDATE photos SET blurhash = $1, dominant_color = $2, color = $3 WHERE id = $4`,
+		blurHash, dominantColor, color, id,
+	)
+	return err
+}
+
+// Reads the dimensions of the derivatives of the photos in one query.
+func loadPhotoSizes(photos []*Photo) error {
+	if len(photos) == 0 {
+		return nil
+	}
+
+	byId := make(map[int64]*Photo, len(photos))
+	params := make([]string, 0, len(photos))
+	ids := make([]interface{}, 0, len(photos))
+	for _, photo := range photos {
+		photo.Sizes = make(map[string]ImageSize)
+		byId[photo.Id] = photo
+		ids = append(ids, photo.Id)
+		params = append(params, fmt.Sprintf("$%d", len(ids)))
+	}
+
+	// A list of parameters rather than an array, which SQLite lacks.
+	rows, err := Db.Query(
+		`SELECT photo_id, suffix, width, height FROM photo_sizes WHERE photo_id IN (`+strings.Join(params, ", ")+`)`,
+		ids...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var photoId int64
+		var suffix string
+		var size ImageSize
+		if err := rows.Scan(&photoId, &suffix, &size.Width, &size.Height); err != nil {
+			return err
+		}
+		byId[photoId].Sizes[suffix] = size
+	}
+	return rows.Err()
+}
+
+// Returns the dimensions of a derivative. Derivatives made on demand,
+// and those of photos processed before the dimensions were stored,
+// are computed from the dimensions of the original. Returns zeros when
+// these are unknown too.
+func (photo *Photo) Size(suffix string) ImageSize {
+	if size, ok := photo.Sizes[suffix]; ok {
+		return size
+	}
+	sz, ok := GetPhotoSize(suffix)
+	if !ok || photo.Width == 0 || photo.Height == 0 {
+		return ImageSize{}
+	}
+	return sz.Dimensions(photo.Width, photo.Height)
+}
+
+func (photo *Photo) IsAnimated() bool {
+	return photo.Frames > 1
+}
+
+// Returns the extension of a derivative. The "fit" derivatives
+// of animated photos are GIFs.
+func (photo *Photo) SuffixExt(suffix string) string {
+	if photo.IsAnimated() {
+		if sz, ok := GetPhotoSize(suffix); ok && sz.Type == "fit" {
+			return "gif"
+		}
+	}
+	if photo.Ext == "" {
+		return "jpg"
+	}
+	return photo.Ext
+}
+
+// Frame numbers of an animated photo, for choosing the poster frame.
+func (photo *Photo) FrameNumbers() []int {
+	result := make([]int, photo.Frames)
+	for i := range result {
+		result[i] = i
+	}
+	return result
+}
+
+func SetPhotoFrames(id int64, frames int) error {
+	_, err := Db.Exec(`UPDATE photos SET frames = $1 WHERE id = $2`, frames, id)
+	return err
+}
+
+func SetPhotoPosterFrame(id int64, frame int, randId string) error {
+	_, err := Db.Exec(
+		`UPDATE photos SET poster_frame = $1, rand_id = $2 WHERE id = $3`,
+		frame, randId, id,
+	)
+	return err
+}
+
+func SetPhotoEdits(id int64, edits []PhotoEdit, randId string) error {
+	data, err := FormatPhotoEdits(edits)
+	if err != nil {
+		return err
+	}
+	_, err = Db.Exec(
+		`UPDATE photos SET edits = $1, rand_id = $2 WHERE id = $3`,
+		data, randId, id,
+	)
+	return err
+}
+
 func IncPhotoViewsCount(id int64) error {
 	_, err := Db.Exec(`UPDATE photos SET views_count = views_count + 1 WHERE id = $1`, id)
 	return err
 }
 
 func DelPhotoById(id int64) error {
-	_, err := Db.Exec(`DELETE FROM favorites WHERE photo_id = $1`, id)
+	_, err := Db.Exec(`DELETE FROM photo_metadata WHERE photo_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	_, err = Db.Exec(`DELETE FROM photo_sizes WHERE photo_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	_, err = Db.Exec(`DELETE FROM photo_versions WHERE photo_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	_, err = Db.Exec(`DELETE FROM favorites WHERE photo_id = $1`, id)
 	if err != nil {
 		return err
 	}
@@ -120,12 +461,19 @@ func DelPhotoById(id int64) error {
 	return err
 }
 
-func GetPhotosCountByUserId(userId int64) (int, error) {
+func GetPhotosCountByUserId(userId int64, color string) (int, error) {
 	var count int
 
 	err := Db.QueryRow(
-		`SELECT COUNT(*) FROM photos p WHERE user_id = $1 AND p.processed = 1`,
-		userId,
+		`
+		SELECT COUNT(*) 
+		FROM photos p 
+		WHERE 
+			user_id = $1 
+			AND p.processed = 1
+			AND ($2 = '' OR p.color = $2)
+		`,
+		userId, color,
 	).Scan(&count)
 
 	if err != nil {
@@ -134,7 +482,7 @@ func GetPhotosCountByUserId(userId int64) (int, error) {
 	return count, nil
 }
 
-func GetContactsPhotosCountByUserId(userId int64) (int, error) {
+func GetContactsPhotosCountByUserId(userId int64, color string) (int, error) {
 	var count int
 
 	err := Db.QueryRow(
@@ -145,8 +493,9 @@ func GetContactsPhotosCountByUserId(userId int64) (int, error) {
 			c.user_id = $1 
 			AND c.contact_id = p.user_id
 			AND p.processed = 1
+			AND ($2 = '' OR p.color = $2)
 		`,
-		userId,
+		userId, color,
 	).Scan(&count)
 
 	if err != nil {
@@ -155,81 +504,21 @@ func GetContactsPhotosCountByUserId(userId int64) (int, error) {
 	return count, nil
 }
 
-func GetPhotosByUserId(userId int64, offset int, limit int) ([]*Photo, error) {
-	result := make([]*Photo, 0, 1)
-
-	rows, err := Db.Query(
-		`
-		SELECT
-			p.id,
-			u.id,
-			COALESCE(u.username, ''),
-			u.realname,
-			p.rand_id,
-			p.tm,
-			p.processed,
-			p.title,
-			p.description,
-			p.views_count,
-			(SELECT COUNT(*) FROM comments c WHERE c.photo_id = p.id),
-			(SELECT COUNT(*) FROM favorites f WHERE f.photo_id = p.id) 
+// Photo listings take the name of a color from PhotoColors to return
+// only the photos of that dominant color, or "" for all photos. Their
+// FROM clauses take the user ID and the color.
+const (
+	userPhotosFrom = `
 		FROM 
 			photos p 
-			JOIN users u ON u.id=p.user_id
+			JOIN users u ON u.id = p.user_id
 		WHERE 
 			p.user_id = $1
 			AND p.processed = 1
-		ORDER BY p.tm DESC
-		OFFSET $2
-		LIMIT $3
-		`,
-		userId, offset, limit,
-	)
-
-	if err != nil {
-		return []*Photo{}, err
-	}
-
-	for rows.Next() {
-		photo := &Photo{}
-		err := rows.Scan(
-			&photo.Id,
-			&photo.UserId, &photo.UserUsername, &photo.UserRealName,
-			&photo.RandId, &photo.Tm, &photo.Processed, &photo.Title,
-			&photo.Description, &photo.ViewsCount,
-			&photo.CommentsCount, &photo.FavoritesCount,
-		)
-		if err != nil {
-			return []*Photo{}, err
-		}
-		result = append(result, photo)
-	}
-
-	if err := rows.Err(); err != nil {
-		return []*Photo{}, err
-	}
-
-	return result, nil
-}
-
-func GetContactsPhotosByUserId(userId int64, offset int, limit int) ([]*Photo, error) {
-	result := make([]*Photo, 0, 1)
-
-	rows, err := Db.Query(
+			AND ($2 = '' OR p.color = $2)
 		`
-		SELECT
-			p.id,
-			u.id,
-			COALESCE(u.username, ''),
-			u.realname,
-			p.rand_id,
-			p.tm,
-			p.processed,
-			p.title,
-			p.description,
-			p.views_count,
-			(SELECT COUNT(*) FROM comments c WHERE c.photo_id=p.id),
-			(SELECT COUNT(*) FROM favorites f WHERE f.photo_id=p.id) 
+
+	contactsPhotosFrom = `
 		FROM 
 			photos p 
 			JOIN users u ON u.id = p.user_id,
@@ -238,57 +527,10 @@ func GetContactsPhotosByUserId(userId int64, offset int, limit int) ([]*Photo, e
 			c.user_id = $1
 			AND c.contact_id = p.user_id
 			AND p.processed = 1
-		ORDER BY p.tm DESC
-		OFFSET $2
-		LIMIT $3
-		`,
-		userId, offset, limit,
-	)
-
-	if err != nil {
-		return []*Photo{}, err
-	}
-
-	for rows.Next() {
-		photo := &Photo{}
-		err := rows.Scan(
-			&photo.Id,
-			&photo.UserId, &photo.UserUsername, &photo.UserRealName,
-			&photo.RandId, &photo.Tm, &photo.Processed, &photo.Title,
-			&photo.Description, &photo.ViewsCount,
-			&photo.CommentsCount, &photo.FavoritesCount,
-		)
-		if err != nil {
-			return []*Photo{}, err
-		}
-		result = append(result, photo)
-	}
-
-	if err := rows.Err(); err != nil {
-		return []*Photo{}, err
-	}
-
-	return result, nil
-}
-
-func GetFavoritePhotosByUserId(userId int64, offset int, limit int) ([]*Photo, error) {
-	result := make([]*Photo, 0, 1)
-
-	rows, err := Db.Query(
+			AND ($2 = '' OR p.color = $2)
 		`
-		SELECT
-			p.id,
-			u.id,
-			COALESCE(u.username, ''),
-			u.realname,
-			p.rand_id,
-			p.tm,
-			p.processed,
-			p.title,
-			p.description,
-			p.views_count,
-			(SELECT COUNT(*) FROM comments c WHERE c.photo_id = p.id),
-			(SELECT COUNT(*) FROM favorites f WHERE f.photo_id = p.id) 
+
+	favoritePhotosFrom = `
 		FROM 
 			photos p 
 			JOIN users u ON u.id = p.user_id,
@@ -297,91 +539,76 @@ func GetFavoritePhotosByUserId(userId int64, offset int, limit int) ([]*Photo, e
 			f.user_id = $1
 			AND f.photo_id = p.id
 			AND p.processed = 1
-		ORDER BY f.tm DESC
-		OFFSET $2
-		LIMIT $3
-		`,
-		userId, offset, limit,
-	)
+			AND ($2 = '' OR p.color = $2)
+		`
+)
 
-	if err != nil {
-		return []*Photo{}, err
-	}
+func GetPhotosByUserId(userId int64, order string, color string, cursor PhotoCursor, limit int) (*PhotoPage, error) {
+	return queryPhotoPage(userPhotosFrom, photoSortKeyOf(order), cursor, limit, userId, color)
+}
 
-	for rows.Next() {
-		photo := &Photo{}
-		err := rows.Scan(
-			&photo.Id,
-			&photo.UserId, &photo.UserUsername, &photo.UserRealName,
-			&photo.RandId, &photo.Tm, &photo.Processed, &photo.Title,
-			&photo.Description, &photo.ViewsCount,
-			&photo.CommentsCount, &photo.FavoritesCount,
-		)
-		if err != nil {
-			return []*Photo{}, err
-		}
-		result = append(result, photo)
-	}
+// Returns the cursor of the photo at offset in the photostream, see
+// queryPhotoCursor.
+func GetPhotosCursorByUserId(userId int64, order string, color string, offset int) (PhotoCursor, error) {
+	return queryPhotoCursor(userPhotosFrom, photoSortKeyOf(order), offset, userId, color)
+}
 
-	if err := rows.Err(); err != nil {
-		return []*Photo{}, err
-	}
+func GetContactsPhotosByUserId(userId int64, order string, color string, cursor PhotoCursor, limit int) (*PhotoPage, error) {
+	return queryPhotoPage(contactsPhotosFrom, photoSortKeyOf(order), cursor, limit, userId, color)
+}
 
-	return result, nil
+func GetContactsPhotosCursorByUserId(userId int64, order string, color string, offset int) (PhotoCursor, error) {
+	return queryPhotoCursor(contactsPhotosFrom, photoSortKeyOf(order), offset, userId, color)
 }
 
-func GetLatestPhotos(offset int, limit int) ([]*Photo, error) {
-	result := make([]*Photo, 0, 1)
+// Favorite photos are listed by the time they were favorited.
+func GetFavoritePhotosByUserId(userId int64, color string, cursor PhotoCursor, limit int) (*PhotoPage, error) {
+	return queryPhotoPage(favoritePhotosFrom, "f.tm", cursor, limit, userId, color)
+}
 
-	rows, err := Db.Query(
+func GetFavoritePhotosCursorByUserId(userId int64, color string, offset int) (PhotoCursor, error) {
+	return queryPhotoCursor(favoritePhotosFrom, "f.tm", offset, userId, color)
+}
+
+func GetLatestPhotos(color string, offset int, limit int) ([]*Photo, error) {
+	return queryPhotos(
 		`
-		SELECT
-			p.id,
-			u.id,
-			COALESCE(u.username, ''),
-			u.realname,
-			p.rand_id,
-			p.tm,
-			p.processed,
-			p.title,
-			p.description,
-			p.views_count,
-			(SELECT COUNT(*) FROM comments c WHERE c.photo_id = p.id),
-			(SELECT COUNT(*) FROM favorites f WHERE f.photo_id = p.id) 
+		SELECT `+photoColumns+`
 		FROM 
 			photos p 
-			JOIN users u ON u.id=p.user_id
+			JOIN users u ON u.id = p.user_id
 		WHERE 
 			p.processed = 1
+			AND ($3 = '' OR p.color = $3)
 		ORDER BY p.tm DESC
-		OFFSET $1
 		LIMIT $2
+		OFFSET $1
 		`,
-		offset, limit,
+		offset, limit, color,
 	)
+}
 
+// Returns every photo by photo ID, with the fields that make the names
+// of its files only: RandId, Ext and Frames.
+func GetPhotoFileNames() (map[int64]*Photo, error) {
+	result := make(map[int64]*Photo)
+
+	rows, err := Db.Query(`SELECT id, rand_id, ext, frames FROM photos`)
 	if err != nil {
-		return []*Photo{}, err
+		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		photo := &Photo{}
-		err := rows.Scan(
-			&photo.Id,
-			&photo.UserId, &photo.UserUsername, &photo.UserRealName,
-			&photo.RandId, &photo.Tm, &photo.Processed, &photo.Title,
-			&photo.Description, &photo.ViewsCount,
-			&photo.CommentsCount, &photo.FavoritesCount,
-		)
-		if err != nil {
-			return []*Photo{}, err
+		if err := rows.Scan(&photo.Id, &photo.RandId, &photo.Ext, &photo.Frames); err != nil {
+			return nil, err
 		}
-		result = append(result, photo)
+		result[photo.Id] = photo
 	}
 
 	if err := rows.Err(); err != nil {
-		return []*Photo{}, err
+		return nil, err
 	}
-
 	return result, nil
 }
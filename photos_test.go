@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSetPhotoEdits(t *testing.T) {
+	newTestDb(t)
+
+	user, err := CreatePersonaUser("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo, err := CreatePhoto(user.Id, "", "", "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edits := []PhotoEdit{{Op: EditRotate, Value: 90}}
+	err = SetPhotoEdits(photo.Id, edits, "renewed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited, err := GetPhotoById(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edited.Edits) != 1 || edited.Edits[0] != edits[0] || edited.RandId != "renewed" {
+		t.Errorf("got edits %+v and RandId %s, want %+v and renewed", edited.Edits, edited.RandId, edits)
+	}
+}
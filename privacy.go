@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+)
+
+// Metadata privacy settings of a user. They control what metadata other
+// users get in the originals of the user's photos. Derivatives are
+// re-encoded and never carry any metadata but the color profile.
+const (
+	PrivacyKeepAll      = "keep_all"
+	PrivacyStripPrivate = "strip_private"
+	PrivacyStripAll     = "strip_all"
+)
+
+type MetadataPrivacyName struct {
+	Value string
+	Title string
+}
+
+var MetadataPrivacyNames = []MetadataPrivacyName{
+	{PrivacyStripPrivate, "Remove location, serial numbers and owner name"},
+	{PrivacyStripAll, "Remove all metadata"},
+	{PrivacyKeepAll, "Keep all metadata"},
+}
+
+func IsValidMetadataPrivacy(privacy string) bool {
+	for _, p := range MetadataPrivacyNames {
+		if p.Value == privacy {
+			return true
+		}
+	}
+	return false
+}
+
+// Who may download the originals of a user's photos, besides the user.
+// Contacts are the users the owner added as contacts.
+const (
+	OriginalsOwner    = "owner"
+	OriginalsContacts = "contacts"
+	OriginalsEveryone = "everyone"
+)
+
+type OriginalsAccessName struct {
+	Value string
+	Title string
+}
+
+var OriginalsAccessNames = []OriginalsAccessName{
+	{OriginalsOwner, "Only me"},
+	{OriginalsContacts, "My contacts"},
+	{OriginalsEveryone, "Everyone"},
+}
+
+func IsValidOriginalsAccess(access string) bool {
+	for _, a := range OriginalsAccessNames {
+		if a.Value == access {
+			return true
+		}
+	}
+	return false
+}
+
+// EXIF tags that identify the photographer or the camera.
+// The GPS IFD is wiped as a whole.
+var exifPrivateTags = map[uint16]bool{
+	0x013B: true, // Artist
+	0x927C: true, // MakerNote, contains serial numbers for most cameras
+	0xA420: true, // ImageUniqueID
+	0xA430: true, // CameraOwnerName
+	0xA431: true, // BodySerialNumber
+	0xA435: true, // LensSerialNumber
+}
+
+const (
+	exifTagOrientation = 0x0112
+	exifTagExifIfd     = 0x8769
+	exifTagGpsIfd      = 0x8825
+)
+
+var exifTypeSizes = map[uint16]uint64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegXmpHeader  = []byte("http://ns.adobe.com/xap/1.0/")
+)
+
+// SanitizeMetadata returns a copy of an image file with metadata removed
+// according to the privacy setting, and the format of the returned file.
+// TIFF keeps its metadata in the same structure as the image data, so it
+// is converted to PNG.
+func SanitizeMetadata(data []byte, format string, privacy string) ([]byte, string, error) {
+	if privacy == PrivacyKeepAll {
+		return data, format, nil
+	}
+
+	switch format {
+	case "jpeg":
+		return sanitizeJpeg(data, privacy), format, nil
+	case "png":
+		return sanitizePng(data), format, nil
+	case "webp":
+		return sanitizeWebp(data), format, nil
+	case "tiff":
+		img, err := DecodeImage(data)
+		if err != nil {
+			return nil, "", err
+		}
+		var buf bytes.Buffer
+		err = png.Encode(&buf, img)
+		if err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "png", nil
+	}
+
+	// GIF and BMP don't carry camera metadata.
+	return data, format, nil
+}
+
+// Removes metadata from a JPEG file. Image data, ICC profiles and the
+// orientation are kept.
+func sanitizeJpeg(data []byte, privacy string) []byte {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			// Not a marker, the file is broken. Keep the rest as is.
+			break
+		}
+		marker := data[pos+1]
+
+		// Start of scan: the rest is the compressed image data.
+		if marker == 0xDA {
+			break
+		}
+
+		// Markers without a payload.
+		if marker == 0xFF || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		}
+
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			break
+		}
+		segment := data[pos:end]
+		payload := segment[4:]
+
+		switch {
+
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegExifHeader):
+			tiff := append([]byte{}, payload[len(jpegExifHeader):]...)
+			if privacy == PrivacyStripAll {
+				orientation := exifOrientation(tiff)
+				if orientation > 1 {
+					writeJpegSegment(out, 0xE1, append(append([]byte{}, jpegExifHeader...), exifWithOrientation(orientation)...))
+				}
+			} else {
+				exifWipe(tiff)
+				writeJpegSegment(out, 0xE1, append(append([]byte{}, jpegExifHeader...), tiff...))
+			}
+
+		case marker == 0xE1 && bytes.HasPrefix(payload, jpegXmpHeader):
+			// XMP may repeat the location and the owner, drop it.
+
+		case marker == 0xED:
+			// Photoshop IRB with IPTC: creator, location, contacts.
+
+		case marker == 0xFE && privacy == PrivacyStripAll:
+			// Comment.
+
+		default:
+			out.Write(segment)
+
+		}
+
+		pos = end
+	}
+
+	out.Write(data[pos:])
+	return out.Bytes()
+}
+
+// PNG chunks that may hold metadata.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"iTXt": true,
+	"zTXt": true,
+	"tIME": true,
+}
+
+// Removes metadata chunks from a PNG file.
+func sanitizePng(data []byte) []byte {
+	if len(data) < 8 || string(data[1:4]) != "PNG" {
+		return data
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:8])
+
+	pos := 8
+	for pos+12 <= len(data) {
+		end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+		if end > len(data) || end < pos {
+			break
+		}
+		if !pngMetadataChunks[string(data[pos+4:pos+8])] {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	out.Write(data[pos:])
+	return out.Bytes()
+}
+
+// Removes the EXIF and XMP chunks from a WebP file.
+func sanitizeWebp(data []byte) []byte {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return data
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2
+		if end > len(data) || end < pos {
+			end = len(data)
+		}
+
+		switch string(data[pos : pos+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, data[pos:end]...)
+			if len(chunk) > 8 {
+				// Clear the EXIF and XMP flags.
+				chunk[8] &^= 0x08 | 0x04
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(result)-8))
+	return result
+}
+
+func writeJpegSegment(out *bytes.Buffer, marker byte, payload []byte) {
+	out.Write([]byte{0xFF, marker})
+	binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+}
+
+func exifByteOrder(tiff []byte) binary.ByteOrder {
+	if len(tiff) < 8 {
+		return nil
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		return binary.LittleEndian
+	case "MM":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// Returns the orientation tag from IFD0, or 0 if there is none.
+func exifOrientation(tiff []byte) uint16 {
+	bo := exifByteOrder(tiff)
+	if bo == nil {
+		return 0
+	}
+
+	off := uint64(bo.Uint32(tiff[4:]))
+	if off+2 > uint64(len(tiff)) {
+		return 0
+	}
+
+	n := uint64(bo.Uint16(tiff[off:]))
+	for i := uint64(0); i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > uint64(len(tiff)) {
+			break
+		}
+		if bo.Uint16(tiff[e:]) == exifTagOrientation {
+			return bo.Uint16(tiff[e+8:])
+		}
+	}
+	return 0
+}
+
+// Returns a minimal TIFF structure with the orientation tag only.
+func exifWithOrientation(orientation uint16) []byte {
+	var b bytes.Buffer
+	bo := binary.BigEndian
+	b.WriteString("MM")
+	binary.Write(&b, bo, uint16(42))
+	binary.Write(&b, bo, uint32(8)) // IFD0 offset
+	binary.Write(&b, bo, uint16(1)) // entries count
+	binary.Write(&b, bo, uint16(exifTagOrientation))
+	binary.Write(&b, bo, uint16(3)) // SHORT
+	binary.Write(&b, bo, uint32(1)) // values count
+	binary.Write(&b, bo, orientation)
+	binary.Write(&b, bo, uint16(0)) // padding of the value
+	binary.Write(&b, bo, uint32(0)) // no next IFD
+	return b.Bytes()
+}
+
+// Zeroes the values of private tags and of the whole GPS IFD in place.
+// The structure is kept, so all the offsets stay valid.
+func exifWipe(tiff []byte) {
+	bo := exifByteOrder(tiff)
+	if bo == nil {
+		return
+	}
+	exifWipeIfd(tiff, bo, uint64(bo.Uint32(tiff[4:])), false, 0)
+}
+
+func exifWipeIfd(tiff []byte, bo binary.ByteOrder, off uint64, wipeAll bool, depth int) {
+	if depth > 4 || off+2 > uint64(len(tiff)) {
+		return
+	}
+
+	n := uint64(bo.Uint16(tiff[off:]))
+	for i := uint64(0); i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > uint64(len(tiff)) {
+			break
+		}
+
+		tag := bo.Uint16(tiff[e:])
+		switch {
+		case wipeAll || exifPrivateTags[tag]:
+			exifWipeValue(tiff, bo, e)
+		case tag == exifTagExifIfd:
+			exifWipeIfd(tiff, bo, uint64(bo.Uint32(tiff[e+8:])), false, depth+1)
+		case tag == exifTagGpsIfd:
+			exifWipeIfd(tiff, bo, uint64(bo.Uint32(tiff[e+8:])), true, depth+1)
+		}
+	}
+
+	if wipeAll {
+		for i := off; i < off+2+n*12 && i < uint64(len(tiff)); i++ {
+			tiff[i] = 0
+		}
+	}
+}
+
+func exifWipeValue(tiff []byte, bo binary.ByteOrder, e uint64) {
+	typ := bo.Uint16(tiff[e+2:])
+	count := uint64(bo.Uint32(tiff[e+4:]))
+	size := exifTypeSizes[typ] * count
+
+	if size <= 4 {
+		copy(tiff[e+8:e+12], []byte{0, 0, 0, 0})
+		return
+	}
+
+	off := uint64(bo.Uint32(tiff[e+8:]))
+	if off+size > uint64(len(tiff)) {
+		return
+	}
+	for i := off; i < off+size; i++ {
+		tiff[i] = 0
+	}
+}
@@ -1,20 +1,51 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"image"
-	"io"
+	"image/color"
+	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
+	"github.com/lib/pq"
+	_ "golang.org/x/image/webp"
 )
 
-const PathToPhotos = "static/photos/"
-const PathToAvatars = "static/avatars/"
+const PathToPhotos = "photos/"
+const PathToAvatars = "avatars/"
 
-var PhotoProcessingQueue chan *Photo
-var AvatarProcessingQueue chan *User
+// Originals keep all the metadata of the uploaded files, so they are
+// stored apart from the public files and only served by HandleOriginal.
+const PathToOriginals = "originals/"
+
+// Sizes made on demand are kept here until they expire or the cache is
+// full, see CollectGarbage and ImageCache.
+const PathToCache = "cache/"
+
+// Default avatars are shipped with the static files, they are copied
+// to the storage for every new user.
+const PathToDefaultAvatars = "static/avatars/"
+
+// How often idle workers look for new jobs in the database.
+const JobPollInterval = 5 * time.Second
+
+// Wakeup signals for the workers, so that jobs enqueued by this process
+// don't have to wait for the next poll.
+var photoJobsWakeup chan bool
+var avatarJobsWakeup chan bool
+var derivativeJobsWakeup chan bool
 
 type ResizeMode struct {
 	Width  int
@@ -34,6 +65,51 @@ var PhotoSizes = []ResizeMode{
 	{2000, 2000, "fit", "f2000"},
 }
 
+type ImageSize struct {
+	Width  int
+	Height int
+}
+
+// Returns the dimensions of the result of Resize for a source image
+// of the given dimensions.
+func (sz ResizeMode) Dimensions(width, height int) ImageSize {
+	if sz.Type != "fit" {
+		return ImageSize{sz.Width, sz.Height}
+	}
+
+	// Same as imaging.Fit.
+	if width <= sz.Width && height <= sz.Height {
+		return ImageSize{width, height}
+	}
+	srcAspectRatio := float64(width) / float64(height)
+	if srcAspectRatio > float64(sz.Width)/float64(sz.Height) {
+		return ImageSize{sz.Width, int(float64(sz.Width) / srcAspectRatio)}
+	}
+	return ImageSize{int(float64(sz.Height) * srcAspectRatio), sz.Height}
+}
+
+// Sizes that are not pre-generated, but made by the workers when HandleImage
+// first asks for them, and kept under PathToCache.
+var OnDemandPhotoSizes = []ResizeMode{
+	{75, 75, "thumbnail", "t75"},
+	{150, 150, "thumbnail", "t150"},
+	{400, 400, "thumbnail", "t400"},
+	{800, 800, "fit", "f800"},
+	{1600, 1600, "fit", "f1600"},
+}
+
+// Returns the size with the given suffix, pre-generated or on-demand.
+func GetPhotoSize(suffix string) (ResizeMode, bool) {
+	for _, sizes := range [][]ResizeMode{PhotoSizes, OnDemandPhotoSizes} {
+		for _, sz := range sizes {
+			if sz.Suffix == suffix {
+				return sz, true
+			}
+		}
+	}
+	return ResizeMode{}, false
+}
+
 var AvatarSizes = []ResizeMode{
 	{25, 25, "thumbnail", "25"},
 	{50, 50, "thumbnail", "50"},
@@ -41,97 +117,770 @@ var AvatarSizes = []ResizeMode{
 	{200, 200, "thumbnail", "200"},
 }
 
-func EnqueuePhoto(photo *Photo) {
-	go func() { PhotoProcessingQueue <- photo }()
+func EnqueuePhoto(photo *Photo) error {
+	_, err := CreateJob(JobKindPhoto, photo.Id)
+	if err != nil {
+		return err
+	}
+	wakeupWorkers(JobKindPhoto)
+	return nil
+}
+
+func EnqueueAvatar(user *User) error {
+	_, err := CreateJob(JobKindAvatar, user.Id)
+	if err != nil {
+		return err
+	}
+	wakeupWorkers(JobKindAvatar)
+	return nil
 }
 
-func EnqueueAvatar(user *User) {
-	go func() { AvatarProcessingQueue <- user }()
+// Asks the workers for a size of a photo, or of one of its versions,
+// that is not pre-generated. format is the extension of the file.
+func EnqueuePhotoDerivative(photo *Photo, suffix string, format string) error {
+	payload := fmt.Sprintf("%s_%s.%s", photo.RandId, suffix, format)
+	created, err := CreateJobOnce(JobKindDerivative, photo.Id, payload)
+	if err != nil {
+		return err
+	}
+	if created {
+		wakeupWorkers(JobKindDerivative)
+	}
+	return nil
+}
+
+// Wakes up the workers of this process and, through NOTIFY, the workers
+// running on other nodes.
+func wakeupWorkers(kind string) {
+	wakeup(kind)
+
+	err := NotifyJobs(kind)
+	if err != nil {
+		log.Printf("ERROR: cannot notify %s workers: %v\n", kind, err)
+	}
+}
+
+func wakeup(kind string) {
+	var ch chan bool
+
+	switch kind {
+	case JobKindPhoto:
+		ch = photoJobsWakeup
+	case JobKindAvatar:
+		ch = avatarJobsWakeup
+	case JobKindDerivative:
+		ch = derivativeJobsWakeup
+	}
+
+	select {
+	case ch <- true:
+	default:
+	}
+}
+
+// LISTEN/NOTIFY can be disabled with JOBS_NOTIFY=off, e.g. behind
+// a connection pooler that doesn't support it. SQLite has none, see
+// NotifyJobs and NotifyDerivative.
+func notifyEnabled() bool {
+	return os.Getenv("JOBS_NOTIFY") != "off" && Db.Dialect == DialectPostgres
+}
+
+// Calls handle with the payloads of the notifications sent to channel.
+// Returns false if the channel cannot be listened to. If the connection
+// is lost, handle is called with an empty payload once it's re-established,
+// as some notifications may have been missed.
+func listen(channel string, handle func(payload string)) bool {
+	listener := pq.NewListener(DbConnStr, 10*time.Second, time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("ERROR: %s listener: %v\n", channel, err)
+			}
+		},
+	)
+
+	err := listener.Listen(channel)
+	if err != nil {
+		log.Printf("ERROR: cannot listen to %s: %v\n", channel, err)
+		listener.Close()
+		return false
+	}
+
+	go func() {
+		for n := range listener.Notify {
+			if n == nil {
+				handle("")
+				continue
+			}
+			handle(n.Extra)
+		}
+	}()
+	return true
+}
+
+// Listens for job notifications from other nodes. Polling still runs,
+// so workers keep going if the listener connection is lost.
+func listenJobs() {
+	listen(JobsNotifyChannel, func(kind string) {
+		if kind == "" {
+			wakeup(JobKindPhoto)
+			wakeup(JobKindAvatar)
+			wakeup(JobKindDerivative)
+			return
+		}
+		wakeup(kind)
+	})
+}
+
+// Requests waiting for derivatives made on demand, by storage key.
+var derivativeWaiters = map[string][]chan bool{}
+var derivativeWaitersMu sync.Mutex
+
+// Set once derivatives can be waited for: either the workers run in this
+// process, or the other nodes notify this one, see ListenDerivatives.
+var derivativesNotified int32
+
+func CanWaitForDerivatives() bool {
+	return atomic.LoadInt32(&derivativesNotified) == 1
+}
+
+// Returns a channel that receives a value once the derivative with the
+// given key is stored, and the function to stop watching it.
+func watchDerivative(key string) (chan bool, func()) {
+	ch := make(chan bool, 1)
+
+	derivativeWaitersMu.Lock()
+	derivativeWaiters[key] = append(derivativeWaiters[key], ch)
+	derivativeWaitersMu.Unlock()
+
+	return ch, func() {
+		derivativeWaitersMu.Lock()
+		defer derivativeWaitersMu.Unlock()
+
+		waiters := derivativeWaiters[key]
+		for i, c := range waiters {
+			if c == ch {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(derivativeWaiters, key)
+		} else {
+			derivativeWaiters[key] = waiters
+		}
+	}
+}
+
+// Wakes up the requests waiting for the derivative with the given key,
+// or all of them if key is empty.
+func derivativeReady(key string) {
+	derivativeWaitersMu.Lock()
+	defer derivativeWaitersMu.Unlock()
+
+	for k, waiters := range derivativeWaiters {
+		if key != "" && k != key {
+			continue
+		}
+		for _, ch := range waiters {
+			select {
+			case ch <- true:
+			default:
+			}
+		}
+	}
+}
+
+// Listens for the derivatives stored by the workers of other nodes.
+// Without it, web nodes don't wait for the derivatives they request,
+// see HandleImage.
+func ListenDerivatives() {
+	if notifyEnabled() && listen(DerivativesNotifyChannel, derivativeReady) {
+		atomic.StoreInt32(&derivativesNotified, 1)
+	}
 }
 
 func StartProcessing() {
-	PhotoProcessingQueue = make(chan *Photo, 100)
-	AvatarProcessingQueue = make(chan *User, 100)
+	photoJobsWakeup = make(chan bool, 1)
+	avatarJobsWakeup = make(chan bool, 1)
+	derivativeJobsWakeup = make(chan bool, 1)
+
+	ImageCacheConnect()
+
+	// Pick up photos and avatars left unprocessed by a previous run.
+	// Unfinished jobs are already in the jobs table and running ones with
+	// an expired lease are claimed again by the workers.
+	n, err := EnqueueUnprocessedPhotos()
+	if err != nil {
+		log.Printf("ERROR: cannot enqueue unprocessed photos: %v\n", err)
+	} else if n > 0 {
+		log.Printf("Enqueued %d unprocessed photos\n", n)
+	}
+
+	n, err = EnqueueUnprocessedAvatars()
+	if err != nil {
+		log.Printf("ERROR: cannot enqueue unprocessed avatars: %v\n", err)
+	} else if n > 0 {
+		log.Printf("Enqueued %d unprocessed avatars\n", n)
+	}
+
+	if notifyEnabled() {
+		listenJobs()
+	}
+	atomic.StoreInt32(&derivativesNotified, 1)
+
+	workers := GetWorkersCount()
+	for i := 0; i < workers; i++ {
+		go worker(JobKindPhoto, photoJobsWakeup, processPhotoJob)
+		go worker(JobKindDerivative, derivativeJobsWakeup, processDerivativeJob)
+	}
+	go worker(JobKindAvatar, avatarJobsWakeup, processAvatarJob)
+}
 
-	go workerProcessPhotos()
-	go workerProcessAvatars()
+// Number of concurrent photo processing workers. Set by the WORKERS
+// environment variable, defaults to the number of CPUs.
+func GetWorkersCount() int {
+	if n, err := strconv.Atoi(os.Getenv("WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
 }
 
-func workerProcessPhotos() {
-	for photo := range PhotoProcessingQueue {
-		err := ProcessPhoto(photo)
+func worker(kind string, wakeupCh chan bool, process func(job *Job) error) {
+	for {
+		job, err := ClaimJob(kind)
+		if err != nil {
+			log.Printf("ERROR: cannot claim %s job: %v\n", kind, err)
+		}
+
+		if job == nil {
+			buryAbandonedJobs(kind)
+			select {
+			case <-wakeupCh:
+			case <-time.After(JobPollInterval):
+			}
+			continue
+		}
+
+		done := make(chan bool)
+		go extendJobLease(job.Id, done)
+		err = process(job)
+		close(done)
 		if err != nil {
-			SetPhotoProcessed(photo.Id, -1)
-			log.Printf("ERROR: cannot process photo %d: %v\n", photo.Id, err)
+			log.Printf("ERROR: cannot process %s %d (attempt %d): %v\n", kind, job.TargetId, job.Attempts, err)
+			if job.Attempts >= JobMaxAttempts {
+				err = FailJob(job.Id, err.Error())
+			} else {
+				err = RetryJob(job.Id, err.Error(), time.Now().Add(JobBackoff(job.Attempts)))
+			}
 		} else {
-			SetPhotoProcessed(photo.Id, 1)
+			err = CompleteJob(job.Id)
+		}
+		if err != nil {
+			log.Printf("ERROR: cannot update job %d: %v\n", job.Id, err)
+		}
+	}
+}
+
+// Renews the lease of a running job until done is closed.
+func extendJobLease(id int64, done chan bool) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(JobLeaseTimeout / 3):
+			err := ExtendJobLease(id)
+			if err != nil {
+				log.Printf("ERROR: cannot extend the lease of job %d: %v\n", id, err)
+			}
+		}
+	}
+}
+
+// Moves the jobs that were abandoned on their last attempt to the dead
+// state, and marks their photos as failed like processPhotoJob does.
+func buryAbandonedJobs(kind string) {
+	jobs, err := BuryAbandonedJobs(kind)
+	if err != nil {
+		log.Printf("ERROR: cannot bury abandoned %s jobs: %v\n", kind, err)
+		return
+	}
+
+	for _, job := range jobs {
+		log.Printf("ERROR: %s %d abandoned after %d attempts\n", kind, job.TargetId, job.Attempts)
+		if kind == JobKindPhoto {
+			err := SetPhotoProcessingStatus(job.TargetId, -1, job.Attempts, job.LastError)
+			if err != nil {
+				log.Printf("ERROR: cannot update photo %d: %v\n", job.TargetId, err)
+			}
+		}
+	}
+}
+
+func processPhotoJob(job *Job) error {
+	photo, err := GetPhotoById(job.TargetId)
+	if err != nil {
+		return err
+	}
+
+	err = ProcessPhoto(photo)
+	if err != nil {
+		processed := 0
+		if job.Attempts >= JobMaxAttempts {
+			processed = -1
 		}
+		SetPhotoProcessingStatus(photo.Id, processed, job.Attempts, err.Error())
+		return err
+	}
+	return SetPhotoProcessingStatus(photo.Id, 1, job.Attempts, "")
+}
+
+// RequeueDeadJob gives a dead job a new set of attempts.
+func RequeueDeadJob(job *Job) error {
+	err := RequeueJob(job.Id)
+	if err != nil {
+		return err
 	}
+
+	switch job.Kind {
+	case JobKindPhoto:
+		err = SetPhotoProcessed(job.TargetId, 0)
+	}
+	wakeupWorkers(job.Kind)
+	return err
+}
+
+func processAvatarJob(job *Job) error {
+	user, err := GetUserById(job.TargetId)
+	if err != nil {
+		return err
+	}
+
+	// Users who never uploaded an avatar get the default one again,
+	// e.g. when avatars are reprocessed after a change of AvatarSizes.
+	err = ProcessAvatar(user)
+	if IsStorageNotFound(err) {
+		return SetDefaultAvatar(user)
+	}
+	return err
 }
 
-func workerProcessAvatars() {
-	for user := range AvatarProcessingQueue {
-		err := ProcessAvatar(user)
+var derivativePayloadRe = regexp.MustCompile(`^([a-z0-9]+)_([a-z0-9]+)\.([a-z]+)$`)
+
+func processDerivativeJob(job *Job) error {
+	m := derivativePayloadRe.FindStringSubmatch(job.Payload)
+	if m == nil {
+		return fmt.Errorf("Invalid derivative: %s", job.Payload)
+	}
+	randId, suffix, format := m[1], m[2], m[3]
+
+	sz, ok := GetPhotoSize(suffix)
+	if !ok {
+		return fmt.Errorf("Unknown photo size: %s", suffix)
+	}
+
+	photo, err := GetPhotoById(job.TargetId)
+	if err != nil {
+		return err
+	}
+	if photo.RandId != randId {
+		version, err := GetPhotoVersionByRandId(photo, randId)
 		if err != nil {
-			log.Printf("ERROR: cannot process avatar %d: %v\n", user.Id, err)
+			return err
 		}
+		photo = version.Photo
 	}
+
+	data, err := GeneratePhotoDerivative(photo, sz, format)
+	if err != nil {
+		return err
+	}
+
+	key := GetPhotoCachePath(photo, suffix, format)
+	err = Store.Put(key, data)
+	if err != nil {
+		return err
+	}
+	if ImgCache != nil {
+		ImgCache.Add(key, int64(len(data)))
+	}
+
+	err = NotifyDerivative(key)
+	if err != nil {
+		log.Printf("ERROR: cannot notify about %s: %v\n", key, err)
+	}
+	return nil
 }
 
+// Storage keys of photo and avatar files.
+
 func GetPhotoPath(photo *Photo, suffix string) string {
-	return PathToPhotos + fmt.Sprintf("%d_%s_%s.jpg", photo.Id, photo.RandId, suffix)
+	return PathToPhotos + fmt.Sprintf("%d_%s_%s.%s", photo.Id, photo.RandId, suffix, photo.SuffixExt(suffix))
+}
+
+// WebP version of a derivative, served to the browsers that support it.
+func GetPhotoWebpPath(photo *Photo, suffix string) string {
+	return PathToPhotos + fmt.Sprintf("%d_%s_%s.webp", photo.Id, photo.RandId, suffix)
+}
+
+// A size made on demand, see OnDemandPhotoSizes.
+func GetPhotoCachePath(photo *Photo, suffix string, format string) string {
+	return PathToCache + fmt.Sprintf("photos/%d_%s_%s.%s", photo.Id, photo.RandId, suffix, format)
 }
 
 func GetAvatarPath(user *User, suffix string) string {
 	return PathToAvatars + fmt.Sprintf("%d_%s.jpg", user.Id, suffix)
 }
 
+func GetPhotoOriginalPath(photo *Photo) string {
+	ext, ok := ImageFormatExts[photo.Format]
+	if !ok {
+		ext = "jpg"
+	}
+	return PathToOriginals + fmt.Sprintf("photos/%d_%s_o.%s", photo.Id, photo.RandId, ext)
+}
+
+func GetAvatarOriginalPath(user *User) string {
+	return PathToOriginals + fmt.Sprintf("avatars/%d_o.jpg", user.Id)
+}
+
+// Reads the original of a photo. Originals of photos uploaded before
+// they were made private are moved out of the public photos on first read.
+func ReadPhotoOriginal(photo *Photo) ([]byte, error) {
+	legacyPath := PathToPhotos + fmt.Sprintf("%d_%s_o.jpg", photo.Id, photo.RandId)
+	return readOriginal(GetPhotoOriginalPath(photo), legacyPath)
+}
+
+// Same as ReadPhotoOriginal, for avatars.
+func ReadAvatarOriginal(user *User) ([]byte, error) {
+	legacyPath := PathToAvatars + fmt.Sprintf("%d_o.jpg", user.Id)
+	return readOriginal(GetAvatarOriginalPath(user), legacyPath)
+}
+
+// Reads the original stored under key, moving it there from legacyPath
+// first if it's still there.
+func readOriginal(key string, legacyPath string) ([]byte, error) {
+	data, err := StorageReadFile(key)
+	if err == nil {
+		return data, nil
+	}
+
+	if _, statErr := Store.Stat(legacyPath); statErr != nil {
+		return nil, err
+	}
+
+	data, err = StorageReadFile(legacyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = Store.Put(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, Store.Delete(legacyPath)
+}
+
+// Originals of photos and avatars uploaded before they were made private.
+var (
+	legacyPhotoOriginalRe  = regexp.MustCompile(`^\d+_[a-z0-9]+_o\.jpg$`)
+	legacyAvatarOriginalRe = regexp.MustCompile(`^\d+_o\.jpg$`)
+)
+
+// MoveLegacyOriginals moves all the originals that are still public to
+// where they are kept now: the originals of photos and avatars uploaded
+// before originals were private, which ReadPhotoOriginal only moves when
+// it reads them, and with SplitStorage the originals kept in the public
+// storage before the split. report is called for every file, which is
+// only moved if dryRun is not set. Returns the number of files.
+func MoveLegacyOriginals(dryRun bool, report func(from string, to string)) (int, error) {
+	type move struct {
+		src, dst Storage
+		from, to string
+	}
+	moves := make([]move, 0, 1)
+
+	// List first, so that the listings don't see the moves.
+	for _, p := range []struct {
+		prefix string
+		re     *regexp.Regexp
+	}{
+		{PathToPhotos, legacyPhotoOriginalRe},
+		{PathToAvatars, legacyAvatarOriginalRe},
+	} {
+		err := Store.List(p.prefix, func(info *StorageFileInfo) error {
+			if p.re.MatchString(path.Base(info.Key)) {
+				moves = append(moves, move{Store, Store, info.Key, PathToOriginals + info.Key})
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if split, ok := Store.(*SplitStorage); ok {
+		err := split.Public.List(split.Prefix, func(info *StorageFileInfo) error {
+			moves = append(moves, move{split.Public, split.Private, info.Key, info.Key})
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, m := range moves {
+		report(m.from, m.to)
+		if dryRun {
+			continue
+		}
+		err := moveStorageFile(m.src, m.dst, m.from, m.to)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(moves), nil
+}
+
+func moveStorageFile(src Storage, dst Storage, from string, to string) error {
+	f, err := src.Get(from)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = dst.Put(to, data)
+	if err != nil {
+		return err
+	}
+	return src.Delete(from)
+}
+
+// Gives the photo a new RandId after a change of its derivatives, so that
+// they get new URLs and the cached ones are not used. The original is moved
+// to the new key. The old derivatives are left to the garbage collector.
+// update saves the new RandId, with the change if it can, so that no
+// derivative of the change is ever made under the old RandId.
+func RenewPhotoRandId(photo *Photo, update func(randId string) error) error {
+	data, err := ReadPhotoOriginal(photo)
+	if err != nil {
+		return err
+	}
+
+	renewed := *photo
+	renewed.RandId = GetRandId(20)
+
+	err = Store.Put(GetPhotoOriginalPath(&renewed), data)
+	if err != nil {
+		return err
+	}
+
+	err = update(renewed.RandId)
+	if err != nil {
+		Store.Delete(GetPhotoOriginalPath(&renewed))
+		return err
+	}
+
+	err = Store.Delete(GetPhotoOriginalPath(photo))
+	if err != nil {
+		log.Printf("ERROR: cannot delete the original of photo %d: %v\n", photo.Id, err)
+	}
+
+	photo.RandId = renewed.RandId
+	return nil
+}
+
 func ProcessPhoto(photo *Photo) error {
-	origImg, err := imaging.Open(GetPhotoPath(photo, "o"))
+	data, err := ReadPhotoOriginal(photo)
+	if err != nil {
+		return err
+	}
+
+	origImg, profile, err := DecodePhotoOriginal(data)
 	if err != nil {
 		return err
 	}
 
-	src := imaging.Clone(origImg)
+	anim, err := DecodeAnimation(photo.Format, data)
+	if err != nil {
+		return err
+	}
+
+	metadata := ExtractPhotoMetadata(data)
+	metadata.PhotoId = photo.Id
+	err = SavePhotoMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	frames := 1
+	if anim != nil {
+		frames = len(anim.Image)
+		origImg = AnimationFrame(anim, photo.PosterFrame)
+	}
+	origImg = ApplyPhotoEdits(origImg, photo.Edits)
+
+	src, ext := PreparePhotoSource(origImg)
+
+	derivative := *photo
+	derivative.Ext = ext
+	derivative.Frames = frames
+
+	sizes := make(map[string]ImageSize)
 
 	for _, sz := range PhotoSizes {
-		var dst image.Image
+		if anim != nil && sz.Type == "fit" {
+			resized := ResizeAnimation(anim, sz)
+			sizes[sz.Suffix] = ImageSize{resized.Config.Width, resized.Config.Height}
 
-		switch sz.Type {
-		case "thumbnail":
-			dst = imaging.Thumbnail(src, sz.Width, sz.Height, imaging.Lanczos)
-		case "fit":
-			dst = imaging.Fit(src, sz.Width, sz.Height, imaging.Lanczos)
+			data, err := EncodeAnimation(resized)
+			if err != nil {
+				return err
+			}
+			err = Store.Put(GetPhotoPath(&derivative, sz.Suffix), data)
+			if err != nil {
+				return err
+			}
+			continue
 		}
 
-		err := imaging.Save(dst, GetPhotoPath(photo, sz.Suffix))
+		dst := Resize(src, sz)
+		sizes[sz.Suffix] = ImageSize{dst.Bounds().Dx(), dst.Bounds().Dy()}
+
+		for _, key := range []string{GetPhotoPath(&derivative, sz.Suffix), GetPhotoWebpPath(&derivative, sz.Suffix)} {
+			data, err := EncodePhotoImage(dst, strings.TrimPrefix(path.Ext(key), "."), profile)
+			if err != nil {
+				return err
+			}
+			err = Store.Put(key, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	bounds := src.Bounds()
+	err = SetPhotoSizes(photo.Id, bounds.Dx(), bounds.Dy(), sizes)
+	if err != nil {
+		return err
+	}
+
+	// Placeholders are shown as sRGB.
+	placeholderSrc := src
+	if profile != nil {
+		placeholderSrc = profile.ToSRGB(src)
+	}
+	blurHash, dominantColor, color := ComputePhotoPlaceholder(placeholderSrc)
+	err = SetPhotoPlaceholder(photo.Id, blurHash, dominantColor, color)
+	if err != nil {
+		return err
+	}
+
+	err = SetPhotoHash(photo.Id, PerceptualHash(src))
+	if err != nil {
+		return err
+	}
+
+	if photo.Frames != frames {
+		err = SetPhotoFrames(photo.Id, frames)
 		if err != nil {
 			return err
 		}
+		photo.Frames = frames
+	}
+
+	if photo.Ext != ext {
+		err = SetPhotoExt(photo.Id, ext)
+		if err != nil {
+			return err
+		}
+		photo.Ext = ext
 	}
 
 	return nil
 }
 
+// Returns the image the photo derivatives are made from and the extension
+// of the derivatives. Transparent images get PNG derivatives, unless
+// a background to flatten them onto is configured.
+func PreparePhotoSource(img image.Image) (*image.NRGBA, string) {
+	src := imaging.Clone(img)
+
+	ext := "jpg"
+	if !src.Opaque() {
+		if bg, ok := GetFlattenBackground(); ok {
+			src = Flatten(src, bg)
+		} else {
+			ext = "png"
+		}
+	}
+	return src, ext
+}
+
+func Resize(src image.Image, sz ResizeMode) image.Image {
+	switch sz.Type {
+	case "thumbnail":
+		return imaging.Thumbnail(src, sz.Width, sz.Height, imaging.Lanczos)
+	case "fit":
+		return imaging.Fit(src, sz.Width, sz.Height, imaging.Lanczos)
+	}
+	return src
+}
+
+// Makes a photo derivative from the original, for the sizes generated
+// on demand. The extension must be the one of the photo derivatives,
+// or "webp". For "gif", the whole animation is resized.
+func GeneratePhotoDerivative(photo *Photo, sz ResizeMode, ext string) ([]byte, error) {
+	data, err := ReadPhotoOriginal(photo)
+	if err != nil {
+		return nil, err
+	}
+
+	origImg, profile, err := DecodePhotoOriginal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	anim, err := DecodeAnimation(photo.Format, data)
+	if err != nil {
+		return nil, err
+	}
+	if anim != nil {
+		if ext == "gif" {
+			return EncodeAnimation(ResizeAnimation(anim, sz))
+		}
+		origImg = AnimationFrame(anim, photo.PosterFrame)
+	}
+	origImg = ApplyPhotoEdits(origImg, photo.Edits)
+
+	src, _ := PreparePhotoSource(origImg)
+	return EncodePhotoImage(Resize(src, sz), ext, profile)
+}
+
 func ProcessAvatar(user *User) error {
-	origImg, err := imaging.Open(GetAvatarPath(user, "o"))
+	data, err := ReadAvatarOriginal(user)
+	if err != nil {
+		return err
+	}
+	origImg, err := DecodeImage(data)
 	if err != nil {
 		return err
 	}
 
-	src := imaging.Clone(origImg)
+	// Avatars are always JPEG.
+	bg, ok := GetFlattenBackground()
+	if !ok {
+		bg = color.White
+	}
+	src := Flatten(imaging.Clone(origImg), bg)
 
 	for _, sz := range AvatarSizes {
-		var dst image.Image
-
-		switch sz.Type {
-		case "thumbnail":
-			dst = imaging.Thumbnail(src, sz.Width, sz.Height, imaging.Lanczos)
-		case "fit":
-			dst = imaging.Fit(src, sz.Width, sz.Height, imaging.Lanczos)
-		}
+		dst := Resize(src, sz)
 
-		err := imaging.Save(dst, GetAvatarPath(user, sz.Suffix))
+		err := SaveImage(dst, GetAvatarPath(user, sz.Suffix))
 		if err != nil {
 			return err
 		}
@@ -142,10 +891,14 @@ func ProcessAvatar(user *User) error {
 
 func SetDefaultAvatar(user *User) error {
 	for _, sz := range AvatarSizes {
-		defaultPath := PathToAvatars + fmt.Sprintf("default_%s.jpg", sz.Suffix)
-		newPath := GetAvatarPath(user, sz.Suffix)
+		defaultPath := PathToDefaultAvatars + fmt.Sprintf("default_%s.jpg", sz.Suffix)
 
-		err := CopyFile(defaultPath, newPath)
+		data, err := ioutil.ReadFile(defaultPath)
+		if err != nil {
+			return err
+		}
+
+		err = Store.Put(GetAvatarPath(user, sz.Suffix), data)
 		if err != nil {
 			return err
 		}
@@ -153,19 +906,177 @@ func SetDefaultAvatar(user *User) error {
 	return nil
 }
 
-func CopyFile(src, dst string) error {
-	srcf, err := os.Open(src)
+// File extensions of the supported upload formats,
+// by the format names registered in the image package.
+var ImageFormatExts = map[string]string{
+	"jpeg": "jpg",
+	"png":  "png",
+	"gif":  "gif",
+	"bmp":  "bmp",
+	"tiff": "tif",
+	"webp": "webp",
+}
+
+var ImageFormatMimeTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"bmp":  "image/bmp",
+	"tiff": "image/tiff",
+	"webp": "image/webp",
+}
+
+// Returns the format name of a supported image file, reading the header only.
+// Images over the size limits are rejected as well.
+func DetectImageFormat(data []byte) (string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		return err
+		return "", fmt.Errorf("Unsupported image format")
+	}
+	if _, ok := ImageFormatExts[format]; !ok {
+		return "", fmt.Errorf("Unsupported image format: %s", format)
+	}
+	err = CheckImageConfig(config)
+	if err != nil {
+		return "", err
+	}
+	return format, nil
+}
+
+// Background color for transparent images, set by the FLATTEN_BACKGROUND
+// environment variable as "#rrggbb". When it's not set, transparent photos
+// keep their transparency in PNG derivatives.
+func GetFlattenBackground() (color.Color, bool) {
+	var r, g, b uint8
+	_, err := fmt.Sscanf(os.Getenv("FLATTEN_BACKGROUND"), "#%02x%02x%02x", &r, &g, &b)
+	if err != nil {
+		return nil, false
+	}
+	return color.NRGBA{r, g, b, 255}, true
+}
+
+// Draws the image over a solid background.
+func Flatten(img *image.NRGBA, bg color.Color) *image.NRGBA {
+	if img.Opaque() {
+		return img
 	}
-	defer srcf.Close()
+	dst := imaging.New(img.Bounds().Dx(), img.Bounds().Dy(), bg)
+	return imaging.Overlay(dst, img, image.Pt(0, 0), 1.0)
+}
+
+// Decodes the image stored under the given key. The EXIF orientation tag
+// is applied, so photos taken with a rotated camera come out upright.
+func OpenImage(key string) (image.Image, error) {
+	data, err := StorageReadFile(key)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeImage(data)
+}
+
+// Same as OpenImage, for an image file already read into memory.
+// Images over the size limits are rejected before decoding. Images with
+// a color profile other than sRGB are converted to sRGB.
+func DecodeImage(data []byte) (image.Image, error) {
+	img, profile, err := DecodeImageProfile(data)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		return profile.ToSRGB(img), nil
+	}
+	return img, nil
+}
 
-	dstf, err := os.Create(dst)
+// Same as DecodeImage, without the conversion to sRGB. Returns the color
+// profile of the image, or nil if the image is sRGB or has no supported
+// profile.
+func DecodeImageProfile(data []byte) (image.Image, *ColorProfile, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	err = CheckImageConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	profile, err := ReadColorProfile(data)
+	if err != nil {
+		// The colors may be off, but the image is still usable.
+		log.Printf("ERROR: cannot read color profile: %v\n", err)
+		return img, nil, nil
+	}
+	if profile == nil || profile.IsSRGB() {
+		return img, nil, nil
+	}
+	return img, profile, nil
+}
+
+// Decodes the original of a photo. The returned color profile is the one
+// the derivatives keep, nil if they are converted to sRGB.
+func DecodePhotoOriginal(data []byte) (image.Image, *ColorProfile, error) {
+	if KeepColorProfiles() {
+		return DecodeImageProfile(data)
+	}
+	img, err := DecodeImage(data)
+	return img, nil, err
+}
+
+// Quality of the lossy WebP derivatives, 0-100.
+const WebpQuality = 80
+
+// Encodes the image in the format given by the key extension and stores it.
+func SaveImage(img image.Image, key string) error {
+	data, err := EncodeImage(img, strings.TrimPrefix(path.Ext(key), "."))
 	if err != nil {
 		return err
 	}
-	defer dstf.Close()
+	return Store.Put(key, data)
+}
 
-	_, err = io.Copy(dstf, srcf)
-	return err
+// Encodes a photo derivative with the color profile kept from the original,
+// which may be nil. Formats that can't carry the profile are converted
+// to sRGB.
+func EncodePhotoImage(img image.Image, ext string, profile *ColorProfile) ([]byte, error) {
+	if profile == nil {
+		return EncodeImage(img, ext)
+	}
+	if ext != "jpg" && ext != "png" {
+		return EncodeImage(profile.ToSRGB(img), ext)
+	}
+	data, err := EncodeImage(img, ext)
+	if err != nil {
+		return nil, err
+	}
+	return EmbedColorProfile(data, ext, profile)
+}
+
+// Encodes the image in the format given by the file extension.
+func EncodeImage(img image.Image, ext string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if ext == "webp" {
+		err := webp.Encode(&buf, img, &webp.Options{Quality: WebpQuality})
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	format, err := imaging.FormatFromExtension(ext)
+	if err != nil {
+		return nil, err
+	}
+
+	err = imaging.Encode(&buf, img, format)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
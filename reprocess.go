@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// Number of targets read from the database at once.
+const ReprocessBatchSize = 100
+
+// Selects the photos or users to reprocess. Zero values match everything.
+type ReprocessFilter struct {
+	Avatars  bool
+	Username string
+	FromId   int64
+	ToId     int64
+	Failed   bool
+}
+
+// Returns the WHERE condition and its arguments for targets with IDs
+// greater than afterId.
+func (f *ReprocessFilter) where(afterId int64) (string, []interface{}) {
+	table := "p"
+	if f.Avatars {
+		table = "u"
+	}
+
+	conds := []string{table + ".id > $1"}
+	args := []interface{}{afterId}
+
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.Username != "" {
+		add("u.username = $%d", f.Username)
+	}
+	if f.FromId > 0 {
+		add(table+".id >= $%d", f.FromId)
+	}
+	if f.ToId > 0 {
+		add(table+".id <= $%d", f.ToId)
+	}
+	if f.Failed && !f.Avatars {
+		add("p.processed = $%d", -1)
+	}
+
+	return strings.Join(conds, " AND "), args
+}
+
+func (f *ReprocessFilter) from() string {
+	if f.Avatars {
+		return "users u"
+	}
+	return "photos p JOIN users u ON u.id = p.user_id"
+}
+
+func (f *ReprocessFilter) Count(afterId int64) (int, error) {
+	where, args := f.where(afterId)
+
+	var count int
+	err := Db.QueryRow(
+		fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, f.from(), where),
+		args...,
+	).Scan(&count)
+	return count, err
+}
+
+// Returns the next batch of target IDs after afterId, in ascending order.
+func (f *ReprocessFilter) Ids(afterId int64, limit int) ([]int64, error) {
+	where, args := f.where(afterId)
+	table := "p"
+	if f.Avatars {
+		table = "u"
+	}
+
+	rows, err := Db.Query(
+		fmt.Sprintf(
+			`SELECT %[1]s.id FROM %[2]s WHERE %[3]s ORDER BY %[1]s.id LIMIT %[4]d`,
+			table, f.from(), where, limit,
+		),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0, limit)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// RunReprocess implements the "reprocess" command. It creates processing
+// jobs for existing photos or avatars, e.g. after PhotoSizes or AvatarSizes
+// have changed, and leaves the work to the workers. Targets are visited
+// in ID order, so an interrupted run can be continued with -after.
+// -originals moves the originals that are still public instead.
+func RunReprocess(args []string) {
+	fs := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	all := fs.Bool("all", false, "reprocess all photos or avatars")
+	avatars := fs.Bool("avatars", false, "reprocess avatars instead of photos")
+	username := fs.String("user", "", "reprocess photos or the avatar of this user only")
+	fromId := fs.Int64("from", 0, "first photo or user ID")
+	toId := fs.Int64("to", 0, "last photo or user ID")
+	failed := fs.Bool("failed", false, "reprocess photos that failed processing only")
+	afterId := fs.Int64("after", 0, "resume after this photo or user ID")
+	maxPending := fs.Int("max-pending", 100, "wait while there are this many unfinished jobs")
+	dryRun := fs.Bool("dry-run", false, "show what would be reprocessed")
+	originals := fs.Bool("originals", false, "move the originals that are still public to the private storage instead")
+	fs.Parse(args)
+
+	if *originals {
+		n, err := MoveLegacyOriginals(*dryRun, func(from string, to string) {
+			fmt.Printf("%s -> %s\n", from, to)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot move originals: %v\n", err)
+			os.Exit(1)
+		}
+		if *dryRun {
+			fmt.Printf("Dry run: %d originals would be moved\n", n)
+			return
+		}
+		fmt.Printf("Done: %d originals moved\n", n)
+		return
+	}
+
+	filter := &ReprocessFilter{
+		Avatars:  *avatars,
+		Username: *username,
+		FromId:   *fromId,
+		ToId:     *toId,
+		Failed:   *failed,
+	}
+
+	if !*all && filter.Username == "" && filter.FromId == 0 && filter.ToId == 0 && !filter.Failed {
+		fmt.Fprintln(os.Stderr, "Select what to reprocess with -all, -user, -from, -to or -failed")
+		os.Exit(2)
+	}
+	if filter.Avatars && filter.Failed {
+		fmt.Fprintln(os.Stderr, "-failed applies to photos only")
+		os.Exit(2)
+	}
+
+	kind := JobKindPhoto
+	if filter.Avatars {
+		kind = JobKindAvatar
+	}
+
+	total, err := filter.Count(*afterId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot count %ss: %v\n", kind, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d %ss to reprocess\n", total, kind)
+
+	// Stop after the current target on Ctrl-C, so that the last ID
+	// printed is the one to resume after.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	done, enqueued, skipped := 0, 0, 0
+	lastId := *afterId
+	lastReport := time.Now()
+
+	for {
+		ids, err := filter.Ids(lastId, ReprocessBatchSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read %ss: %v\n", kind, err)
+			fmt.Fprintf(os.Stderr, "Resume with -after %d\n", lastId)
+			os.Exit(1)
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, id := range ids {
+			select {
+			case <-interrupt:
+				fmt.Printf("Interrupted at %d/%d, resume with -after %d\n", done, total, lastId)
+				os.Exit(1)
+			default:
+			}
+
+			if *dryRun {
+				fmt.Printf("%s %d\n", kind, id)
+			} else {
+				err := waitForJobs(kind, *maxPending, interrupt)
+				if err == nil {
+					var created bool
+					created, err = CreateJobOnce(kind, id, "")
+					if created {
+						enqueued++
+					} else if err == nil {
+						skipped++
+					}
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Cannot enqueue %s %d: %v\n", kind, id, err)
+					fmt.Fprintf(os.Stderr, "Resume with -after %d\n", lastId)
+					os.Exit(1)
+				}
+			}
+
+			done++
+			lastId = id
+
+			if time.Since(lastReport) >= 5*time.Second {
+				fmt.Printf("%d/%d, last ID %d\n", done, total, lastId)
+				lastReport = time.Now()
+			}
+		}
+
+		if !*dryRun {
+			wakeupWorkers(kind)
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run: %d %ss would be reprocessed\n", done, kind)
+		return
+	}
+	fmt.Printf("Done: %d jobs created, %d %ss already had a job\n", enqueued, skipped, kind)
+}
+
+// Throttles the reprocessing: waits while the number of unfinished jobs
+// is at the limit, so that new uploads don't wait behind all of them.
+func waitForJobs(kind string, maxPending int, interrupt chan os.Signal) error {
+	if maxPending <= 0 {
+		return nil
+	}
+
+	for {
+		count, err := GetUnfinishedJobsCount(kind)
+		if err != nil {
+			return err
+		}
+		if count < maxPending {
+			return nil
+		}
+
+		select {
+		case sig := <-interrupt:
+			// Let the caller handle it.
+			interrupt <- sig
+			return nil
+		case <-time.After(JobPollInterval):
+		}
+	}
+}
@@ -29,6 +29,11 @@ function changeLayout(layout) {
 	window.location.reload();
 }
 
+function changeOrder(order) {
+	document.cookie = 'order=' + order + '; path=/';
+	window.location.reload();
+}
+
 function addContact(username) {
 	$.ajax({ 
 		type: 'POST',
@@ -76,6 +81,16 @@ function delPhoto(username, photoId) {
 	}
 }
 
+function setPosterFrame(username, photoId, frame) {
+	$.ajax({ 
+		type: 'POST',
+		url: '/photos/' + username + '/' + photoId + '/poster/',
+		data: { frame: frame },
+		success: function(res, status, xhr) { window.location.reload(); },
+		error: function(xhr, status, err) { console.log('ajax error: ' + status +  ' | ' + err); }
+	});
+}
+
 function addComment(username, photoId) {
 	$.ajax({ 
 		type: 'POST',
@@ -98,4 +113,97 @@ function delComment(username, photoId, commentId) {
 			error: function(xhr, status, err) { console.log('ajax error: ' + status +  ' | ' + err); }
 		});
 	}
-}
\ No newline at end of file
+}
+
+function requeueJob(jobId) {
+	$.ajax({ 
+		type: 'POST',
+		url: '/admin/jobs/' + jobId + '/requeue/',
+		success: function(res, status, xhr) { window.location.reload(); },
+		error: function(xhr, status, err) { console.log('ajax error: ' + status +  ' | ' + err); }
+	});
+}
+
+// Paints the BlurHash placeholders of the images (data-blurhash)
+// as their backgrounds, until the images load.
+function decodeBlurHash(hash, width, height) {
+	var chars = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~';
+	var decode83 = function(s) {
+		var value = 0;
+		for (var i = 0; i < s.length; i++) {
+			value = value * 83 + chars.indexOf(s[i]);
+		}
+		return value;
+	};
+	var srgbToLinear = function(v) {
+		v = v / 255;
+		return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+	};
+	var linearToSrgb = function(v) {
+		v = Math.max(0, Math.min(1, v));
+		return v <= 0.0031308 ? Math.round(v * 12.92 * 255) : Math.round((1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255);
+	};
+	var signPow = function(v, exp) {
+		return (v < 0 ? -1 : 1) * Math.pow(Math.abs(v), exp);
+	};
+
+	var sizeFlag = decode83(hash[0]);
+	var numX = sizeFlag % 9 + 1;
+	var numY = Math.floor(sizeFlag / 9) + 1;
+	var maxValue = (decode83(hash[1]) + 1) / 166;
+
+	var colors = [];
+	var dc = decode83(hash.substring(2, 6));
+	colors.push([srgbToLinear(dc >> 16), srgbToLinear((dc >> 8) & 255), srgbToLinear(dc & 255)]);
+	for (var i = 1; i < numX * numY; i++) {
+		var ac = decode83(hash.substring(4 + i * 2, 6 + i * 2));
+		colors.push([
+			signPow((Math.floor(ac / 361) - 9) / 9, 2) * maxValue,
+			signPow((Math.floor(ac / 19) % 19 - 9) / 9, 2) * maxValue,
+			signPow((ac % 19 - 9) / 9, 2) * maxValue
+		]);
+	}
+
+	var pixels = new Uint8ClampedArray(width * height * 4);
+	for (var y = 0; y < height; y++) {
+		for (var x = 0; x < width; x++) {
+			var r = 0, g = 0, b = 0;
+			for (var j = 0; j < numY; j++) {
+				for (var i = 0; i < numX; i++) {
+					var basis = Math.cos(Math.PI * x * i / width) * Math.cos(Math.PI * y * j / height);
+					var color = colors[i + j * numX];
+					r += color[0] * basis;
+					g += color[1] * basis;
+					b += color[2] * basis;
+				}
+			}
+			var p = 4 * (x + y * width);
+			pixels[p] = linearToSrgb(r);
+			pixels[p + 1] = linearToSrgb(g);
+			pixels[p + 2] = linearToSrgb(b);
+			pixels[p + 3] = 255;
+		}
+	}
+	return pixels;
+}
+
+$(function() {
+	$('img[data-blurhash]').each(function() {
+		var img = this;
+		if (img.complete) {
+			return;
+		}
+		try {
+			var canvas = document.createElement('canvas');
+			canvas.width = 32;
+			canvas.height = 32;
+			var ctx = canvas.getContext('2d');
+			var imageData = ctx.createImageData(32, 32);
+			imageData.data.set(decodeBlurHash($(img).data('blurhash'), 32, 32));
+			ctx.putImageData(imageData, 0, 0);
+			$(img).css({'background-image': 'url(' + canvas.toDataURL() + ')', 'background-size': '100% 100%'});
+		} catch (e) {
+			console.log('blurhash error: ' + e);
+		}
+	});
+});
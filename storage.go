@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage keeps original photos and avatars and their derivatives.
+// Keys are slash-separated paths like "photos/1_abc_o.jpg".
+type Storage interface {
+	Put(key string, data []byte) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	Stat(key string) (*StorageFileInfo, error)
+	URL(key string) string
+
+	// List calls fn for every file whose key starts with prefix.
+	// Listing stops at the first error returned by fn.
+	List(prefix string, fn func(info *StorageFileInfo) error) error
+}
+
+type StorageFileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+var Store Storage
+
+// Returned by the storage backends for missing files, besides the errors
+// of the os package.
+type StorageNotFoundError struct {
+	Key string
+}
+
+func (e *StorageNotFoundError) Error() string {
+	return fmt.Sprintf("File not found: %s", e.Key)
+}
+
+func IsStorageNotFound(err error) bool {
+	_, ok := err.(*StorageNotFoundError)
+	return ok || os.IsNotExist(err)
+}
+
+// StorageConnect selects the storage backend with the STORAGE environment
+// variable: "local" (default) keeps files under the static/ directory,
+// "s3" keeps them in an S3-compatible bucket configured by the S3_*
+// variables.
+func StorageConnect() {
+	switch os.Getenv("STORAGE") {
+
+	case "", "local":
+
+		Store = &LocalStorage{Dir: "static/", UrlPrefix: "/static/"}
+
+	case "s3":
+
+		// Keys in the public bucket can be guessed from the URLs of
+		// the derivatives, so originals go to a bucket of their own.
+		if os.Getenv("S3_PRIVATE_BUCKET") == "" {
+			log.Fatal("S3_PRIVATE_BUCKET is required for the originals")
+		}
+
+		buckets := make([]*S3Storage, 2)
+		for i, bucket := range []string{os.Getenv("S3_BUCKET"), os.Getenv("S3_PRIVATE_BUCKET")} {
+			s3, err := NewS3Storage(
+				os.Getenv("S3_ENDPOINT"),
+				os.Getenv("S3_REGION"),
+				bucket,
+				os.Getenv("S3_ACCESS_KEY"),
+				os.Getenv("S3_SECRET_KEY"),
+				os.Getenv("S3_PUBLIC_URL"),
+			)
+			if err != nil {
+				log.Fatal(err)
+			}
+			buckets[i] = s3
+		}
+		Store = &SplitStorage{Public: buckets[0], Private: buckets[1], Prefix: PathToOriginals}
+
+	default:
+
+		log.Fatalf("Unknown storage: %s", os.Getenv("STORAGE"))
+
+	}
+}
+
+// LocalStorage keeps files in a directory on the local filesystem,
+// served by StaticFileHandler under UrlPrefix.
+type LocalStorage struct {
+	Dir       string
+	UrlPrefix string
+}
+
+func (s *LocalStorage) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s *LocalStorage) Put(key string, data []byte) error {
+	pth := s.path(key)
+
+	err := os.MkdirAll(filepath.Dir(pth), 0777)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that readers never see
+	// a partially written file. Each writer has its own, the last one
+	// to finish wins.
+	f, err := ioutil.TempFile(filepath.Dir(pth), filepath.Base(pth)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, pth)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) Stat(key string) (*StorageFileInfo, error) {
+	stat, err := os.Stat(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return nil, fmt.Errorf("Not a regular file: %s", key)
+	}
+	return &StorageFileInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *LocalStorage) URL(key string) string {
+	return s.UrlPrefix + key
+}
+
+func (s *LocalStorage) List(prefix string, fn func(info *StorageFileInfo) error) error {
+	// Walk the directory the prefix is in and filter by the whole prefix.
+	root := s.path(path.Dir(prefix + "x"))
+
+	err := filepath.Walk(root, func(pth string, stat os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && pth == root {
+				return nil
+			}
+			return err
+		}
+		if !stat.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Dir, pth)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		return fn(&StorageFileInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()})
+	})
+	return err
+}
+
+// SplitStorage keeps the files whose keys start with Prefix in Private and
+// the others in Public. Files under Prefix that are still in Public, from
+// before the split, are found there too; see MoveLegacyOriginals.
+type SplitStorage struct {
+	Public  Storage
+	Private Storage
+	Prefix  string
+}
+
+func (s *SplitStorage) isPrivate(key string) bool {
+	return strings.HasPrefix(key, s.Prefix)
+}
+
+func (s *SplitStorage) Put(key string, data []byte) error {
+	if s.isPrivate(key) {
+		return s.Private.Put(key, data)
+	}
+	return s.Public.Put(key, data)
+}
+
+func (s *SplitStorage) Get(key string) (io.ReadCloser, error) {
+	if !s.isPrivate(key) {
+		return s.Public.Get(key)
+	}
+	f, err := s.Private.Get(key)
+	if IsStorageNotFound(err) {
+		return s.Public.Get(key)
+	}
+	return f, err
+}
+
+func (s *SplitStorage) Delete(key string) error {
+	if !s.isPrivate(key) {
+		return s.Public.Delete(key)
+	}
+	err := s.Private.Delete(key)
+	if err != nil {
+		return err
+	}
+	return s.Public.Delete(key)
+}
+
+func (s *SplitStorage) Stat(key string) (*StorageFileInfo, error) {
+	if !s.isPrivate(key) {
+		return s.Public.Stat(key)
+	}
+	info, err := s.Private.Stat(key)
+	if IsStorageNotFound(err) {
+		return s.Public.Stat(key)
+	}
+	return info, err
+}
+
+// Private files have no public URL, they are served by HandleOriginal.
+func (s *SplitStorage) URL(key string) string {
+	return s.Public.URL(key)
+}
+
+func (s *SplitStorage) List(prefix string, fn func(info *StorageFileInfo) error) error {
+	if strings.HasPrefix(prefix, s.Prefix) || strings.HasPrefix(s.Prefix, prefix) {
+		err := s.Private.List(prefix, fn)
+		if err != nil {
+			return err
+		}
+	}
+	if s.isPrivate(prefix) {
+		return nil
+	}
+	return s.Public.List(prefix, fn)
+}
+
+// Reads the whole file stored under the given key.
+func StorageReadFile(key string) ([]byte, error) {
+	f, err := Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
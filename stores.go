@@ -0,0 +1,305 @@
+package main
+
+import (
+	"time"
+)
+
+// The web handlers reach the data through the stores, so that they can run
+// against the in-memory stores as well as against the database. Workers
+// and admin commands use the package functions directly.
+
+type UserStore interface {
+	CreatePersona(persona string) (*User, error)
+	GetById(id int64) (*User, error)
+	GetByPersona(persona string) (*User, error)
+	GetByUsername(username string) (*User, error)
+	Update(user *User) error
+}
+
+// Photo listings return processed photos only, see GetPhotosByUserId
+// and the other package functions for the orders and filters. Photostreams
+// are paged with cursors, see PhotoCursor; the Cursor methods return
+// the cursor of the photo at an offset, or the zero cursor.
+type PhotoStore interface {
+	Create(userId int64, title string, description string, format string) (*Photo, error)
+	GetById(id int64) (*Photo, error)
+	Delete(id int64) error
+	IncViewsCount(id int64) error
+	// Set the poster frame and the edits together with the RandId the new
+	// derivatives are made under, see RenewPhotoRandId.
+	SetPosterFrame(id int64, frame int, randId string) error
+	SetEdits(id int64, edits []PhotoEdit, randId string) error
+
+	GetByUserId(userId int64, order string, color string, cursor PhotoCursor, limit int) (*PhotoPage, error)
+	CursorByUserId(userId int64, order string, color string, offset int) (PhotoCursor, error)
+	CountByUserId(userId int64, color string) (int, error)
+	GetContactsPhotos(userId int64, order string, color string, cursor PhotoCursor, limit int) (*PhotoPage, error)
+	ContactsPhotosCursor(userId int64, order string, color string, offset int) (PhotoCursor, error)
+	CountContactsPhotos(userId int64, color string) (int, error)
+	GetFavorites(userId int64, color string, cursor PhotoCursor, limit int) (*PhotoPage, error)
+	FavoritesCursor(userId int64, color string, offset int) (PhotoCursor, error)
+	GetLatest(color string, offset int, limit int) ([]*Photo, error)
+
+	GetMetadata(id int64) (*PhotoMetadata, error)
+	GetDuplicates(photo *Photo) ([]*Photo, error)
+	GetDuplicatePairs(userId int64, since time.Time, limit int) ([]*DuplicatePair, error)
+}
+
+type CommentStore interface {
+	Create(userId int64, photoId int64, comment string) (*Comment, error)
+	GetById(id int64) (*Comment, error)
+	GetByPhotoId(photoId int64) ([]*Comment, error)
+	Delete(id int64) error
+}
+
+type FavoriteStore interface {
+	Create(userId int64, photoId int64) (*Favorite, error)
+	IsFavorited(userId int64, photoId int64) (bool, error)
+	Delete(userId int64, photoId int64) error
+	CountByUserId(userId int64, color string) (int, error)
+}
+
+type ContactStore interface {
+	Create(userId int64, contactId int64) (*Contact, error)
+	IsContacted(userId int64, contactId int64) (bool, error)
+	Delete(userId int64, contactId int64) error
+	GetByUserId(userId int64) ([]*Contact, error)
+}
+
+// Previous versions of photos, see PhotoVersion. Replace and Rollback
+// keep the originals in the storage, and the photo must be processed
+// again after them.
+type VersionStore interface {
+	GetByPhotoId(photo *Photo) ([]*PhotoVersion, error)
+	GetByRandId(photo *Photo, randId string) (*PhotoVersion, error)
+	Replace(photo *Photo, data []byte, format string) error
+	Rollback(photo *Photo, versionId int64) error
+}
+
+// The jobs of the workers, see jobs.go.
+type JobStore interface {
+	EnqueuePhoto(photo *Photo) error
+	EnqueueAvatar(user *User) error
+	EnqueuePhotoDerivative(photo *Photo, suffix string, format string) error
+	GetById(id int64) (*Job, error)
+	GetDead() ([]*Job, error)
+	RequeueDead(job *Job) error
+}
+
+type Stores struct {
+	Users     UserStore
+	Photos    PhotoStore
+	Comments  CommentStore
+	Favorites FavoriteStore
+	Contacts  ContactStore
+	Versions  VersionStore
+	Jobs      JobStore
+}
+
+// Returns the stores backed by the database, PostgreSQL or SQLite,
+// see DbConnect.
+func NewSqlStores() Stores {
+	return Stores{
+		Users:     SqlUserStore{},
+		Photos:    SqlPhotoStore{},
+		Comments:  SqlCommentStore{},
+		Favorites: SqlFavoriteStore{},
+		Contacts:  SqlContactStore{},
+		Versions:  SqlVersionStore{},
+		Jobs:      SqlJobStore{},
+	}
+}
+
+type SqlUserStore struct{}
+
+func (SqlUserStore) CreatePersona(persona string) (*User, error) {
+	return CreatePersonaUser(persona)
+}
+
+func (SqlUserStore) GetById(id int64) (*User, error) {
+	return GetUserById(id)
+}
+
+func (SqlUserStore) GetByPersona(persona string) (*User, error) {
+	return GetUserByPersona(persona)
+}
+
+func (SqlUserStore) GetByUsername(username string) (*User, error) {
+	return GetUserByUsername(username)
+}
+
+func (SqlUserStore) Update(user *User) error {
+	return UpdateUser(user)
+}
+
+type SqlPhotoStore struct{}
+
+func (SqlPhotoStore) Create(userId int64, title string, description string, format string) (*Photo, error) {
+	return CreatePhoto(userId, title, description, format)
+}
+
+func (SqlPhotoStore) GetById(id int64) (*Photo, error) {
+	return GetPhotoById(id)
+}
+
+func (SqlPhotoStore) Delete(id int64) error {
+	return DelPhotoById(id)
+}
+
+func (SqlPhotoStore) IncViewsCount(id int64) error {
+	return IncPhotoViewsCount(id)
+}
+
+func (SqlPhotoStore) SetPosterFrame(id int64, frame int, randId string) error {
+	return SetPhotoPosterFrame(id, frame, randId)
+}
+
+func (SqlPhotoStore) SetEdits(id int64, edits []PhotoEdit, randId string) error {
+	return SetPhotoEdits(id, edits, randId)
+}
+
+func (SqlPhotoStore) GetByUserId(userId int64, order string, color string, cursor PhotoCursor, limit int) (*PhotoPage, error) {
+	return GetPhotosByUserId(userId, order, color, cursor, limit)
+}
+
+func (SqlPhotoStore) CursorByUserId(userId int64, order string, color string, offset int) (PhotoCursor, error) {
+	return GetPhotosCursorByUserId(userId, order, color, offset)
+}
+
+func (SqlPhotoStore) CountByUserId(userId int64, color string) (int, error) {
+	return GetPhotosCountByUserId(userId, color)
+}
+
+func (SqlPhotoStore) GetContactsPhotos(userId int64, order string, color string, cursor PhotoCursor, limit int) (*PhotoPage, error) {
+	return GetContactsPhotosByUserId(userId, order, color, cursor, limit)
+}
+
+func (SqlPhotoStore) ContactsPhotosCursor(userId int64, order string, color string, offset int) (PhotoCursor, error) {
+	return GetContactsPhotosCursorByUserId(userId, order, color, offset)
+}
+
+func (SqlPhotoStore) CountContactsPhotos(userId int64, color string) (int, error) {
+	return GetContactsPhotosCountByUserId(userId, color)
+}
+
+func (SqlPhotoStore) GetFavorites(userId int64, color string, cursor PhotoCursor, limit int) (*PhotoPage, error) {
+	return GetFavoritePhotosByUserId(userId, color, cursor, limit)
+}
+
+func (SqlPhotoStore) FavoritesCursor(userId int64, color string, offset int) (PhotoCursor, error) {
+	return GetFavoritePhotosCursorByUserId(userId, color, offset)
+}
+
+func (SqlPhotoStore) GetLatest(color string, offset int, limit int) ([]*Photo, error) {
+	return GetLatestPhotos(color, offset, limit)
+}
+
+func (SqlPhotoStore) GetMetadata(id int64) (*PhotoMetadata, error) {
+	return GetPhotoMetadataByPhotoId(id)
+}
+
+func (SqlPhotoStore) GetDuplicates(photo *Photo) ([]*Photo, error) {
+	return GetDuplicatesOfPhoto(photo)
+}
+
+func (SqlPhotoStore) GetDuplicatePairs(userId int64, since time.Time, limit int) ([]*DuplicatePair, error) {
+	return GetDuplicatePairsByUserId(userId, since, limit)
+}
+
+type SqlCommentStore struct{}
+
+func (SqlCommentStore) Create(userId int64, photoId int64, comment string) (*Comment, error) {
+	return CreateComment(userId, photoId, comment)
+}
+
+func (SqlCommentStore) GetById(id int64) (*Comment, error) {
+	return GetCommentById(id)
+}
+
+func (SqlCommentStore) GetByPhotoId(photoId int64) ([]*Comment, error) {
+	return GetCommentsByPhotoId(photoId)
+}
+
+func (SqlCommentStore) Delete(id int64) error {
+	return DelCommentById(id)
+}
+
+type SqlFavoriteStore struct{}
+
+func (SqlFavoriteStore) Create(userId int64, photoId int64) (*Favorite, error) {
+	return CreateFavorite(userId, photoId)
+}
+
+func (SqlFavoriteStore) IsFavorited(userId int64, photoId int64) (bool, error) {
+	return IsFavorited(userId, photoId)
+}
+
+func (SqlFavoriteStore) Delete(userId int64, photoId int64) error {
+	return DelFavorite(userId, photoId)
+}
+
+func (SqlFavoriteStore) CountByUserId(userId int64, color string) (int, error) {
+	return GetFavoritesCountByUserId(userId, color)
+}
+
+type SqlContactStore struct{}
+
+func (SqlContactStore) Create(userId int64, contactId int64) (*Contact, error) {
+	return CreateContact(userId, contactId)
+}
+
+func (SqlContactStore) IsContacted(userId int64, contactId int64) (bool, error) {
+	return IsContacted(userId, contactId)
+}
+
+func (SqlContactStore) Delete(userId int64, contactId int64) error {
+	return DelContact(userId, contactId)
+}
+
+func (SqlContactStore) GetByUserId(userId int64) ([]*Contact, error) {
+	return GetContactsByUserId(userId)
+}
+
+type SqlVersionStore struct{}
+
+func (SqlVersionStore) GetByPhotoId(photo *Photo) ([]*PhotoVersion, error) {
+	return GetPhotoVersions(photo)
+}
+
+func (SqlVersionStore) GetByRandId(photo *Photo, randId string) (*PhotoVersion, error) {
+	return GetPhotoVersionByRandId(photo, randId)
+}
+
+func (SqlVersionStore) Replace(photo *Photo, data []byte, format string) error {
+	return ReplacePhotoOriginal(photo, data, format)
+}
+
+func (SqlVersionStore) Rollback(photo *Photo, versionId int64) error {
+	return RollbackPhotoVersion(photo, versionId)
+}
+
+type SqlJobStore struct{}
+
+func (SqlJobStore) EnqueuePhoto(photo *Photo) error {
+	return EnqueuePhoto(photo)
+}
+
+func (SqlJobStore) EnqueueAvatar(user *User) error {
+	return EnqueueAvatar(user)
+}
+
+func (SqlJobStore) EnqueuePhotoDerivative(photo *Photo, suffix string, format string) error {
+	return EnqueuePhotoDerivative(photo, suffix, format)
+}
+
+func (SqlJobStore) GetById(id int64) (*Job, error) {
+	return GetJobById(id)
+}
+
+func (SqlJobStore) GetDead() ([]*Job, error) {
+	return GetDeadJobs()
+}
+
+func (SqlJobStore) RequeueDead(job *Job) error {
+	return RequeueDeadJob(job)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+)
+
+// The handlers run against the memory stores, see newTestApp. These are
+// the database stores on SQLite.
+func TestSqlStores(t *testing.T) {
+	newTestDb(t)
+	newTestStorage(t)
+	s := NewSqlStores()
+
+	alice, err := s.Users.CreatePersona("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Username = "alice"
+	alice.OriginalsAccess = OriginalsContacts
+	err = s.Users.Update(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.Users.GetByUsername("alice")
+	if err != nil || user.Id != alice.Id || user.OriginalsAccess != OriginalsContacts {
+		t.Errorf("got user %+v, %v", user, err)
+	}
+	if user, err := s.Users.GetByPersona("alice@example.com"); err != nil || user.Id != alice.Id {
+		t.Errorf("by persona: got user %+v, %v", user, err)
+	}
+	bob, err := s.Users.CreatePersona("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Username = "bob"
+	err = s.Users.Update(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Photos
+	photo, err := s.Photos.Create(alice.Id, "title", "description", "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Store.Put(GetPhotoOriginalPath(photo), testPng(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Photos.SetEdits(photo.Id, []PhotoEdit{{Op: EditRotate, Value: 90}}, "edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Photos.SetPosterFrame(photo.Id, 2, "posterframe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Photos.IncViewsCount(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Photos.GetById(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "title" || len(got.Edits) != 1 || got.PosterFrame != 2 || got.RandId != "posterframe" || got.ViewsCount != 1 {
+		t.Errorf("got photo %+v", got)
+	}
+	err = Store.Put(GetPhotoOriginalPath(got), testPng(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = SetPhotoProcessed(photo.Id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Photos.CountByUserId(alice.Id, ""); err != nil || n != 1 {
+		t.Errorf("got %d photos, %v", n, err)
+	}
+
+	// Comments, favorites and contacts
+	comment, err := s.Comments.Create(bob.Id, photo.Id, "nice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments, err := s.Comments.GetByPhotoId(photo.Id)
+	if err != nil || len(comments) != 1 || comments[0].Comment != "nice" {
+		t.Errorf("got %d comments, %v", len(comments), err)
+	}
+	err = s.Comments.Delete(comment.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Comments.GetById(comment.Id); err == nil {
+		t.Error("the comment was not deleted")
+	}
+
+	_, err = s.Favorites.Create(bob.Id, photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Favorites.IsFavorited(bob.Id, photo.Id); err != nil || !ok {
+		t.Errorf("favorited: got %v, %v", ok, err)
+	}
+	if n, err := s.Favorites.CountByUserId(bob.Id, ""); err != nil || n != 1 {
+		t.Errorf("got %d favorites, %v", n, err)
+	}
+
+	_, err = s.Contacts.Create(bob.Id, alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Contacts.IsContacted(bob.Id, alice.Id); err != nil || !ok {
+		t.Errorf("contacted: got %v, %v", ok, err)
+	}
+	if n, err := s.Photos.CountContactsPhotos(bob.Id, ""); err != nil || n != 1 {
+		t.Errorf("got %d photos of contacts, %v", n, err)
+	}
+	err = s.Contacts.Delete(bob.Id, alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contacts, err := s.Contacts.GetByUserId(bob.Id); err != nil || len(contacts) != 0 {
+		t.Errorf("got %d contacts after the delete, %v", len(contacts), err)
+	}
+
+	// Versions
+	err = s.Versions.Replace(got, testPng(t), "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := s.Versions.GetByPhotoId(got)
+	if err != nil || len(versions) != 1 || versions[0].Photo.RandId != "posterframe" {
+		t.Fatalf("got %d versions, %v", len(versions), err)
+	}
+	if v, err := s.Versions.GetByRandId(got, "posterframe"); err != nil || v.Id != versions[0].Id {
+		t.Errorf("by RandId: got %+v, %v", v, err)
+	}
+	err = s.Versions.Rollback(got, versions[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.Photos.GetById(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RandId != "posterframe" || len(got.Edits) != 1 {
+		t.Errorf("rollback: got RandId %s and %d edits", got.RandId, len(got.Edits))
+	}
+
+	// Jobs
+	err = s.Jobs.EnqueuePhoto(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := ClaimJob(JobKindPhoto)
+	if err != nil || job == nil {
+		t.Fatalf("claimed %+v, %v", job, err)
+	}
+	err = FailJob(job.Id, "cannot decode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := s.Jobs.GetDead()
+	if err != nil || len(dead) != 1 || dead[0].LastError != "cannot decode" {
+		t.Fatalf("got %d dead jobs, %v", len(dead), err)
+	}
+	err = s.Jobs.RequeueDead(dead[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, err := s.Jobs.GetById(job.Id); err != nil || job.State != JobStatePending {
+		t.Errorf("requeued job: got %+v, %v", job, err)
+	}
+
+	err = s.Photos.Delete(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Photos.GetById(photo.Id); err == nil {
+		t.Error("the photo was not deleted")
+	}
+	if ok, err := s.Favorites.IsFavorited(bob.Id, photo.Id); err != nil || ok {
+		t.Errorf("favorite of the deleted photo: got %v, %v", ok, err)
+	}
+}
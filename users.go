@@ -3,6 +3,8 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -12,21 +14,26 @@ type User struct {
 	Username string
 	RealName string
 	Tm       time.Time
+
+	MetadataPrivacy string
+	OriginalsAccess string
 }
 
 func CreatePersonaUser(persona string) (*User, error) {
 	user := &User{
-		Persona: persona,
-		Tm:      time.Now(),
+		Persona:         persona,
+		Tm:              time.Now(),
+		MetadataPrivacy: PrivacyStripPrivate,
+		OriginalsAccess: OriginalsOwner,
 	}
 
 	err := Db.QueryRow(
 		`
-		INSERT INTO users(persona, tm) 
-		VALUES ($1, $2)
+		INSERT INTO users(persona, tm, metadata_privacy, originals_access) 
+		VALUES ($1, $2, $3, $4)
 		RETURNING id
 		`,
-		user.Persona, user.Tm,
+		user.Persona, user.Tm, user.MetadataPrivacy, user.OriginalsAccess,
 	).Scan(&user.Id)
 
 	if err != nil {
@@ -40,7 +47,7 @@ func getUserByKey(key string, val interface{}) (*User, error) {
 
 	query := fmt.Sprintf(
 		`
-		SELECT id, COALESCE(persona, ''), COALESCE(username, ''), realname, tm
+		SELECT id, COALESCE(persona, ''), COALESCE(username, ''), realname, tm, metadata_privacy, originals_access
 		FROM users
 		WHERE %s = $1
 		`,
@@ -49,6 +56,7 @@ func getUserByKey(key string, val interface{}) (*User, error) {
 
 	err := Db.QueryRow(query, val).Scan(
 		&user.Id, &user.Persona, &user.Username, &user.RealName, &user.Tm,
+		&user.MetadataPrivacy, &user.OriginalsAccess,
 	)
 
 	if err == sql.ErrNoRows {
@@ -78,10 +86,13 @@ func UpdateUser(user *User) error {
 	result, err := Db.Exec(
 		`
 		UPDATE users 
-		SET persona = NULLIF($1, ''), username = NULLIF($2, ''), realname = $3, tm = $4
-		WHERE id = $5
+		SET 
+			persona = NULLIF($1, ''), username = NULLIF($2, ''), realname = $3, tm = $4,
+			metadata_privacy = $5, originals_access = $6
+		WHERE id = $7
 		`,
-		user.Persona, user.Username, user.RealName, user.Tm, user.Id,
+		user.Persona, user.Username, user.RealName, user.Tm,
+		user.MetadataPrivacy, user.OriginalsAccess, user.Id,
 	)
 
 	if err != nil {
@@ -95,3 +106,40 @@ func UpdateUser(user *User) error {
 
 	return nil
 }
+
+// Admins are listed by username in the ADMINS environment variable,
+// separated by commas.
+func (user *User) IsAdmin() bool {
+	if user.Username == "" {
+		return false
+	}
+	for _, username := range strings.Split(os.Getenv("ADMINS"), ",") {
+		if strings.TrimSpace(username) == user.Username {
+			return true
+		}
+	}
+	return false
+}
+
+func GetUserIds() (map[int64]bool, error) {
+	result := make(map[int64]bool)
+
+	rows, err := Db.Query(`SELECT id FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		result[id] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// When the owner replaces the original of a photo, the previous original
+// stays in the storage under its RandId and is recorded as a version,
+// with the edits made to it. The photo gets a new RandId, so its URLs
+// change, and keeps its ID, comments, favorites and views. Rolling back
+// swaps the photo with one of its versions.
+type PhotoVersion struct {
+	Id      int64
+	PhotoId int64
+	Tm      time.Time // when the version was replaced
+
+	// The photo as it was, for the URLs of its derivatives.
+	Photo *Photo
+}
+
+const photoVersionColumns = `v.id, v.photo_id, v.rand_id, v.format, v.ext, v.frames, v.poster_frame, v.edits, v.tm`
+
+func scanPhotoVersion(row scanner, photo *Photo) (*PhotoVersion, error) {
+	v := &PhotoVersion{}
+	old := *photo
+	var edits string
+
+	err := row.Scan(
+		&v.Id, &v.PhotoId, &old.RandId, &old.Format, &old.Ext,
+		&old.Frames, &old.PosterFrame, &edits, &v.Tm,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	old.Edits, err = ParsePhotoEdits(edits)
+	if err != nil {
+		return nil, err
+	}
+
+	// The derivatives of the version are made on demand.
+	old.Sizes = nil
+	v.Photo = &old
+	return v, nil
+}
+
+// Returns the previous versions of a photo, the latest first.
+func GetPhotoVersions(photo *Photo) ([]*PhotoVersion, error) {
+	result := make([]*PhotoVersion, 0, 1)
+
+	rows, err := Db.Query(
+		`SELECT `+photoVersionColumns+` FROM photo_versions v WHERE v.photo_id = $1 ORDER BY v.id DESC`,
+		photo.Id,
+	)
+	if err != nil {
+		return []*PhotoVersion{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v, err := scanPhotoVersion(rows, photo)
+		if err != nil {
+			return []*PhotoVersion{}, err
+		}
+		result = append(result, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return []*PhotoVersion{}, err
+	}
+	return result, nil
+}
+
+// Returns the version of a photo with the given RandId.
+func GetPhotoVersionByRandId(photo *Photo, randId string) (*PhotoVersion, error) {
+	row := Db.QueryRow(
+		`SELECT `+photoVersionColumns+` FROM photo_versions v WHERE v.photo_id = $1 AND v.rand_id = $2`,
+		photo.Id, randId,
+	)
+	v, err := scanPhotoVersion(row, photo)
+	if err != nil {
+		return nil, fmt.Errorf("Photo version not found: %d %s", photo.Id, randId)
+	}
+	return v, nil
+}
+
+// Returns the RandIds of all the versions by photo ID.
+func GetPhotoVersionRandIds() (map[int64][]string, error) {
+	result := make(map[int64][]string)
+
+	rows, err := Db.Query(`SELECT photo_id, rand_id FROM photo_versions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var randId string
+		if err := rows.Scan(&id, &randId); err != nil {
+			return nil, err
+		}
+		result[id] = append(result[id], randId)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Stores a new original for the photo and keeps the current one
+// as a version. Everything derived from the old original is reset,
+// and the photo must be processed again.
+func ReplacePhotoOriginal(photo *Photo, data []byte, format string) error {
+	return replacePhotoOriginal(photo, data, format, replacePhoto)
+}
+
+// Stores the new original, then has replace record the change, see
+// replacePhoto.
+func replacePhotoOriginal(photo *Photo, data []byte, format string, replace func(photoId int64, randId string, format string) error) error {
+	err := movePhotoOriginal(photo)
+	if err != nil {
+		return err
+	}
+
+	replaced := *photo
+	replaced.RandId = GetRandId(20)
+	replaced.Format = format
+
+	err = Store.Put(GetPhotoOriginalPath(&replaced), data)
+	if err != nil {
+		return err
+	}
+
+	err = replace(photo.Id, replaced.RandId, replaced.Format)
+	if err != nil {
+		Store.Delete(GetPhotoOriginalPath(&replaced))
+		return err
+	}
+
+	*photo = replaced
+	photo.Ext = "jpg"
+	photo.Frames = 1
+	photo.PosterFrame = 0
+	photo.Edits = []PhotoEdit{}
+	photo.Width = 0
+	photo.Height = 0
+	photo.Sizes = nil
+	photo.BlurHash = ""
+	photo.DominantColor = ""
+	photo.Color = ""
+	photo.Hash = 0
+	photo.HasHash = false
+	return nil
+}
+
+// Keeps the current original of a photo as a version and makes the photo
+// use the new one, in one transaction, so that the version and the photo
+// can't get out of step.
+func replacePhoto(photoId int64, randId string, format string) error {
+	tx, err := Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = savePhotoVersion(tx, photoId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`
+		UPDATE photos
+		SET
+			rand_id = $2, format = $3, ext = 'jpg', frames = 1,
+			poster_frame = 0, edits = '', width = 0, height = 0,
+			phash = NULL, phash_bands = '{}',
+			blurhash = '', dominant_color = '', color = ''
+		WHERE id = $1
+		`,
+		photoId, randId, format,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = clearPhotoSizes(tx, photoId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Makes a version the current photo again. The current photo is kept
+// as a version in turn. The photo must be processed again.
+func RollbackPhotoVersion(photo *Photo, versionId int64) error {
+	err := movePhotoOriginal(photo)
+	if err != nil {
+		return err
+	}
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var restored Photo
+	var edits string
+	err = tx.QueryRow(
+		`
+		DELETE FROM photo_versions
+		WHERE id = $2 AND photo_id = $1
+		RETURNING rand_id, format, ext, frames, poster_frame, edits
+		`,
+		photo.Id, versionId,
+	).Scan(
+		&restored.RandId, &restored.Format, &restored.Ext,
+		&restored.Frames, &restored.PosterFrame, &edits,
+	)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Photo version not found: %d", versionId)
+	} else if err != nil {
+		return err
+	}
+
+	err = savePhotoVersion(tx, photo.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`
+		UPDATE photos
+		SET
+			rand_id = $2, format = $3, ext = $4, frames = $5,
+			poster_frame = $6, edits = $7, width = 0, height = 0,
+			phash = NULL, phash_bands = '{}',
+			blurhash = '', dominant_color = '', color = ''
+		WHERE id = $1
+		`,
+		photo.Id, restored.RandId, restored.Format, restored.Ext,
+		restored.Frames, restored.PosterFrame, edits,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = clearPhotoSizes(tx, photo.Id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Moves the original of a photo that becomes a version out of the public
+// photos if it's still there, see ReadPhotoOriginal. A photo without
+// an original can still be replaced.
+func movePhotoOriginal(photo *Photo) error {
+	_, err := ReadPhotoOriginal(photo)
+	if err != nil && !IsStorageNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Records the current original of a photo as a version. The photo row
+// is locked first, so that concurrent changes wait for each other.
+func savePhotoVersion(tx *Tx, photoId int64) error {
+	_, err := tx.Exec(`UPDATE photos SET rand_id = rand_id WHERE id = $1`, photoId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`
+		INSERT INTO photo_versions (photo_id, rand_id, format, ext, frames, poster_frame, edits, tm)
+		SELECT id, rand_id, format, ext, frames, poster_frame, edits, $2
+		FROM photos
+		WHERE id = $1
+		`,
+		photoId, time.Now(),
+	)
+	return err
+}
+
+// The sizes of the derivatives are stored again by ProcessPhoto.
+func clearPhotoSizes(tx *Tx, photoId int64) error {
+	_, err := tx.Exec(`DELETE FROM photo_sizes WHERE photo_id = $1`, photoId)
+	return err
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -13,36 +14,126 @@ import (
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var Tp *template.Template
-
 func main() {
-	var err error
-
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	// Database initialization
+	// The first argument selects what this node runs: "web" serves HTTP
+	// only, "worker" processes photos and avatars only, and no argument
+	// runs both in one process. Nodes coordinate through the database.
+	// "reprocess", "gc", "migrate" and "recount" are admin commands, see
+	// RunReprocess, RunGc, RunMigrate and RunRecount. The other commands
+	// apply pending migrations.
+
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+
+	case "":
+
+		DbConnect()
+		DbMigrate()
+		StorageConnect()
+		StartProcessing()
+		StartGc()
+		RunWeb()
+
+	case "web":
+
+		DbConnect()
+		DbMigrate()
+		StorageConnect()
+		StartGc()
+		RunWeb()
+
+	case "worker":
+
+		DbConnect()
+		DbMigrate()
+		StorageConnect()
+		StartProcessing()
+		StartGc()
+		select {}
+
+	case "reprocess":
+
+		DbConnect()
+		DbMigrate()
+		StorageConnect()
+		RunReprocess(os.Args[2:])
 
-	DbConnect()
-	DbInitSchema()
+	case "gc":
 
-	// Start photos and avatars processing
+		DbConnect()
+		DbMigrate()
+		StorageConnect()
+		RunGc(os.Args[2:])
 
-	StartProcessing()
+	case "migrate":
 
-	// Prepare templates
+		DbConnect()
+		RunMigrate(os.Args[2:])
+
+	case "recount":
+
+		DbConnect()
+		DbMigrate()
+		RunRecount(os.Args[2:])
+
+	default:
+
+		fmt.Fprintf(os.Stderr, "Usage: %s [web|worker|reprocess|gc|migrate|recount]\n", os.Args[0])
+		os.Exit(2)
+
+	}
+}
+
+func RunWeb() {
+	tp, err := LoadTemplates()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := &App{
+		Stores: NewSqlStores(),
+		Tp:     tp,
+		Sc:     NewSecureCookie(),
+	}
 
+	ListenDerivatives()
+
+	// Start the server
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "80"
+	}
+
+	http.Handle("/", app.Router())
+	http.ListenAndServe(":"+port, nil)
+}
+
+// Parses the templates, relative to the current directory.
+func LoadTemplates() (*template.Template, error) {
 	var funcMap = template.FuncMap{
 		"formatdt": func(t time.Time) string {
 			return t.Format("Jan 2, 2006")
 		},
+		"photourl": GetPhotoUrl,
+		"avatarurl": func(userId int64, suffix string) string {
+			return Store.URL(GetAvatarPath(&User{Id: userId}, suffix))
+		},
 	}
 
-	Tp, err = template.New("Tp").Funcs(funcMap).ParseFiles(
+	return template.New("Tp").Funcs(funcMap).ParseFiles(
 		"templates/header.html",
 		"templates/footer.html",
 		"templates/home.html",
@@ -50,52 +141,63 @@ func main() {
 		"templates/upload.html",
 		"templates/photostream.html",
 		"templates/photo.html",
+		"templates/jobs.html",
+		"templates/error.html",
+		"templates/placeholder.html",
+		"templates/duplicates.html",
+		"templates/edit.html",
+		"templates/replace.html",
 	)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Setup routes
+}
 
+// Returns the routes of the web interface.
+func (app *App) Router() *mux.Router {
 	r := mux.NewRouter()
 	r.StrictSlash(true)
 
-	r.HandleFunc(`/`, HandleHome)
-	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/`, HandleUserPhotos)
-	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/page/{page:\d+}/`, HandleUserPhotos)
-	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/`, HandlePhoto)
-	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/fav/`, HandleAddFavorite)
-	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/unfav/`, HandleDeleteFavorite)
-	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/del/`, HandleDeletePhoto)
-	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/comment/`, HandleAddComment)
-	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/delcomment/{id:\d+}/`, HandleDeleteComment)
-	r.HandleFunc(`/favorites/{username:[a-z0-9_]+}/`, HandleUserFavorites)
-	r.HandleFunc(`/favorites/{username:[a-z0-9_]+}/page/{page:\d+}/`, HandleUserFavorites)
-	r.HandleFunc(`/contacts/add/{username:[a-z0-9_]+}/`, HandleAddContact)
-	r.HandleFunc(`/contacts/del/{username:[a-z0-9_]+}/`, HandleDeleteContact)
-	r.HandleFunc(`/contacts/photos/`, HandleContactsPhotos)
-	r.HandleFunc(`/contacts/photos/page/{page:\d+}/`, HandleContactsPhotos)
-	r.HandleFunc(`/settings/`, HandleSettings)
-	r.HandleFunc(`/upload/`, HandleUpload)
-	r.HandleFunc(`/login/`, HandleLogin)
-	r.HandleFunc(`/logout/`, HandleLogout)
-
-	r.PathPrefix(`/static/`).Handler(http.StripPrefix("/static/", &StaticFileHandler{"static/"}))
-
-	// Start the server
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "80"
-	}
-
-	http.Handle("/", r)
-	http.ListenAndServe(":"+port, nil)
+	r.HandleFunc(`/`, app.HandleHome)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/`, app.HandleUserPhotos)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/page/{page:\d+}/`, app.HandlePageNumber)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/duplicates/`, app.HandleDuplicates)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/`, app.HandlePhoto)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/original/`, app.HandleOriginal)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/fav/`, app.HandleAddFavorite)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/unfav/`, app.HandleDeleteFavorite)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/del/`, app.HandleDeletePhoto)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/poster/`, app.HandlePosterFrame)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/edit/`, app.HandleEditPhoto)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/edit/revert/`, app.HandleRevertPhoto)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/replace/`, app.HandleReplacePhoto)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/versions/{version:\d+}/rollback/`, app.HandleRollbackPhoto)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/comment/`, app.HandleAddComment)
+	r.HandleFunc(`/photos/{username:[a-z0-9_]+}/{photo:\d+}/delcomment/{id:\d+}/`, app.HandleDeleteComment)
+	r.HandleFunc(`/favorites/{username:[a-z0-9_]+}/`, app.HandleUserFavorites)
+	r.HandleFunc(`/favorites/{username:[a-z0-9_]+}/page/{page:\d+}/`, app.HandlePageNumber)
+	r.HandleFunc(`/contacts/add/{username:[a-z0-9_]+}/`, app.HandleAddContact)
+	r.HandleFunc(`/contacts/del/{username:[a-z0-9_]+}/`, app.HandleDeleteContact)
+	r.HandleFunc(`/contacts/photos/`, app.HandleContactsPhotos)
+	r.HandleFunc(`/contacts/photos/page/{page:\d+}/`, app.HandlePageNumber)
+	r.HandleFunc(`/settings/`, app.HandleSettings)
+	r.HandleFunc(`/upload/`, app.HandleUpload)
+	r.HandleFunc(`/login/`, app.HandleLogin)
+	r.HandleFunc(`/logout/`, app.HandleLogout)
+	r.HandleFunc(`/admin/jobs/`, app.HandleDeadJobs)
+	r.HandleFunc(`/admin/jobs/{id:\d+}/requeue/`, app.HandleRequeueJob)
+
+	r.HandleFunc(`/img/{photo:\d+}/{rand:[a-z0-9]+}/{suffix:[a-z0-9]+}.{ext:jpg|png|gif}`, app.HandleImage)
+
+	r.PathPrefix(`/static/`).Handler(http.StripPrefix("/static/", &StaticFileHandler{
+		StaticDir: "static/",
+		Private:   []string{PathToOriginals},
+		Immutable: []string{PathToPhotos, PathToCache},
+	}))
+
+	return r
 }
 
-func HandleHome(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleHome(w http.ResponseWriter, r *http.Request) {
 	var err error
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser != nil && currentUser.Username == "" {
 		http.Redirect(w, r, "/settings/", http.StatusFound)
@@ -107,25 +209,28 @@ func HandleHome(w http.ResponseWriter, r *http.Request) {
 	var othersPhotos []*Photo
 
 	if currentUser != nil {
-		userPhotos, err = GetPhotosByUserId(currentUser.Id, 0, 5)
+		page, err := app.Photos.GetByUserId(currentUser.Id, PhotoOrderUploaded, "", PhotoCursor{}, 5)
 		if err != nil {
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
-		contactsPhotos, err = GetContactsPhotosByUserId(currentUser.Id, 0, 5)
+		userPhotos = page.Photos
+
+		page, err = app.Photos.GetContactsPhotos(currentUser.Id, PhotoOrderUploaded, "", PhotoCursor{}, 5)
 		if err != nil {
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
+		contactsPhotos = page.Photos
 	}
 
-	othersPhotos, err = GetLatestPhotos(0, 15)
+	othersPhotos, err = app.Photos.GetLatest("", 0, 15)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	err = Tp.ExecuteTemplate(w, "home.html",
+	err = app.Tp.ExecuteTemplate(w, "home.html",
 		struct {
 			CurrentUser    *User
 			UserPhotos     []*Photo
@@ -145,51 +250,103 @@ func HandleHome(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandleUserPhotos(w http.ResponseWriter, r *http.Request) {
+// Photostreams used to be paged by number. The old URLs go to the page
+// that starts at the same photo now, in the order and with the color
+// filter of the request: the page older than the last photo of page n-1.
+// Pages past the end go to the first page.
+func (app *App) HandlePageNumber(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	username := vars["username"]
-	pageStr := vars["page"]
-	page, err := strconv.ParseInt(pageStr, 10, 64)
-	if err != nil || page < 1 {
-		page = 1
+	url := *r.URL
+	url.Path = url.Path[:strings.LastIndex(url.Path, "page/")]
+
+	pageNumber, err := strconv.Atoi(vars["page"])
+	if err != nil || pageNumber <= 1 {
+		http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
+		return
+	}
+
+	offset := (pageNumber-1)*PhotostreamPageSize - 1
+	order := GetPhotoOrder(r)
+	color := GetColorFilter(r)
+
+	var cursor PhotoCursor
+	if strings.HasPrefix(url.Path, "/contacts/") {
+		currentUser := app.GetCurrentUser(r)
+		if currentUser == nil {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		cursor, err = app.Photos.ContactsPhotosCursor(currentUser.Id, order, color, offset)
+	} else {
+		var user *User
+		user, err = app.Users.GetByUsername(vars["username"])
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if strings.HasPrefix(url.Path, "/favorites/") {
+			cursor, err = app.Photos.FavoritesCursor(user.Id, color, offset)
+		} else {
+			cursor, err = app.Photos.CursorByUserId(user.Id, order, color, offset)
+		}
+	}
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !cursor.IsZero() {
+		query := url.Query()
+		query.Set("older", cursor.Token())
+		url.RawQuery = query.Encode()
 	}
+	http.Redirect(w, r, url.String(), http.StatusFound)
+}
+
+func (app *App) HandleUserPhotos(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	username := vars["username"]
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser != nil && currentUser.Username == "" {
 		http.Redirect(w, r, "/settings/", http.StatusFound)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	limit := 30
-	offset := (int(page) - 1) * limit
-	photos, err := GetPhotosByUserId(user.Id, offset, limit)
+	order := GetPhotoOrder(r)
+	color := GetColorFilter(r)
+	page, err := app.Photos.GetByUserId(user.Id, order, color, GetPhotoCursor(r), PhotostreamPageSize)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	photosCount, err := GetPhotosCountByUserId(user.Id)
+	photosCount, err := app.Photos.CountByUserId(user.Id, color)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-	lastPage := int64(1 + photosCount/limit)
 
 	layout := GetLayout(r)
 	suffix := GetPhotoSuffixByLayout(layout)
 
+	var rows []*JustifiedRow
+	if layout == "J" {
+		rows = JustifyPhotos(page.Photos, JustifiedWidth, JustifiedRowHeight, JustifiedGap)
+	}
+
 	showAddContact := false
 	showDelContact := false
 
 	if currentUser != nil && currentUser.Id != user.Id {
-		res, err := IsContacted(currentUser.Id, user.Id)
+		res, err := app.Contacts.IsContacted(currentUser.Id, user.Id)
 		if err == nil {
 			if res {
 				showDelContact = true
@@ -199,37 +356,55 @@ func HandleUserPhotos(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = Tp.ExecuteTemplate(w, "photostream.html",
+	// Remind the owner about duplicates among the recent uploads.
+	showDuplicates := false
+	if currentUser != nil && currentUser.Id == user.Id {
+		pairs, err := app.Photos.GetDuplicatePairs(user.Id, time.Now().Add(-DuplicateWarningPeriod), 1)
+		if err != nil {
+			log.Printf("ERROR: cannot find duplicates of user %d: %v\n", user.Id, err)
+		}
+		showDuplicates = len(pairs) > 0
+	}
+
+	err = app.Tp.ExecuteTemplate(w, "photostream.html",
 		struct {
 			PhotostreamType string
 			PhotostreamUrl  string
 			CurrentUser     *User
 			User            *User
 			Photos          []*Photo
-			Page            int64
-			PrevPage        int64
-			NextPage        int64
-			LastPage        int64
+			Rows            []*JustifiedRow
+			PhotosCount     int
+			Newer           string
+			Older           string
 			Layout          string
+			Order           string
+			Color           string
+			Colors          []string
 			PhotoSuffix     string
 			ShowAddContact  bool
 			ShowDelContact  bool
 			ShowPhotoAuthor bool
+			ShowDuplicates  bool
 		}{
 			PhotostreamType: "user-photos",
 			PhotostreamUrl:  fmt.Sprintf("/photos/%s/", user.Username),
 			CurrentUser:     currentUser,
 			User:            user,
-			Photos:          photos,
-			Page:            page,
-			PrevPage:        page - 1,
-			NextPage:        page + 1,
-			LastPage:        lastPage,
+			Photos:          page.Photos,
+			Rows:            rows,
+			PhotosCount:     photosCount,
+			Newer:           page.Newer,
+			Older:           page.Older,
 			Layout:          layout,
+			Order:           order,
+			Color:           color,
+			Colors:          PhotoColors,
 			PhotoSuffix:     suffix,
 			ShowAddContact:  showAddContact,
 			ShowDelContact:  showDelContact,
 			ShowPhotoAuthor: false,
+			ShowDuplicates:  showDuplicates,
 		},
 	)
 
@@ -240,7 +415,7 @@ func HandleUserPhotos(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandlePhoto(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandlePhoto(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
 	photoIdStr := vars["photo"]
@@ -250,20 +425,20 @@ func HandlePhoto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser != nil && currentUser.Username == "" {
 		http.Redirect(w, r, "/settings/", http.StatusFound)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	photo, err := GetPhotoById(photoId)
+	photo, err := app.Photos.GetById(photoId)
 	if err != nil || photo.UserId != user.Id {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
@@ -273,7 +448,7 @@ func HandlePhoto(w http.ResponseWriter, r *http.Request) {
 	showDelContact := false
 
 	if currentUser != nil && currentUser.Id != user.Id {
-		res, err := IsContacted(currentUser.Id, user.Id)
+		res, err := app.Contacts.IsContacted(currentUser.Id, user.Id)
 		if err == nil {
 			if res {
 				showDelContact = true
@@ -287,7 +462,7 @@ func HandlePhoto(w http.ResponseWriter, r *http.Request) {
 	showDelFavorite := false
 
 	if currentUser != nil && currentUser.Id != user.Id {
-		res, err := IsFavorited(currentUser.Id, photo.Id)
+		res, err := app.Favorites.IsFavorited(currentUser.Id, photo.Id)
 		if err == nil {
 			if res {
 				showDelFavorite = true
@@ -297,17 +472,35 @@ func HandlePhoto(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	comments, err := GetCommentsByPhotoId(photo.Id)
+	comments, err := app.Comments.GetByPhotoId(photo.Id)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
+	metadata, err := app.Photos.GetMetadata(photo.Id)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The owner is sent here right after an upload, the page waits
+	// for the processing to show the photo and its duplicates.
+	processing := false
+	duplicates := []*Photo{}
+	if currentUser != nil && currentUser.Id == user.Id {
+		processing = photo.Processed == 0
+		duplicates, err = app.Photos.GetDuplicates(photo)
+		if err != nil {
+			log.Printf("ERROR: cannot find duplicates of photo %d: %v\n", photo.Id, err)
+		}
+	}
+
 	if currentUser == nil || currentUser.Id != user.Id {
-		IncPhotoViewsCount(photo.Id)
+		app.Photos.IncViewsCount(photo.Id)
 	}
 
-	err = Tp.ExecuteTemplate(w, "photo.html",
+	err = app.Tp.ExecuteTemplate(w, "photo.html",
 		struct {
 			CurrentUser     *User
 			User            *User
@@ -317,6 +510,10 @@ func HandlePhoto(w http.ResponseWriter, r *http.Request) {
 			ShowAddFavorite bool
 			ShowDelFavorite bool
 			Comments        []*Comment
+			Metadata        *PhotoMetadata
+			Processing      bool
+			Duplicates      []*Photo
+			ShowOriginal    bool
 		}{
 			CurrentUser:     currentUser,
 			User:            user,
@@ -326,6 +523,10 @@ func HandlePhoto(w http.ResponseWriter, r *http.Request) {
 			ShowAddFavorite: showAddFavorite,
 			ShowDelFavorite: showDelFavorite,
 			Comments:        comments,
+			Metadata:        metadata,
+			Processing:      processing,
+			Duplicates:      duplicates,
+			ShowOriginal:    app.canDownloadOriginals(currentUser, user),
 		},
 	)
 
@@ -336,7 +537,78 @@ func HandlePhoto(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandleAddFavorite(w http.ResponseWriter, r *http.Request) {
+// Serves the original file of a photo. The owner gets the file as it was
+// uploaded, others get it with metadata removed per the owner's settings.
+func (app *App) HandleOriginal(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	username := vars["username"]
+	photoIdStr := vars["photo"]
+	photoId, err := strconv.ParseInt(photoIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	currentUser := app.GetCurrentUser(r)
+
+	user, err := app.Users.GetByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	photo, err := app.Photos.GetById(photoId)
+	if err != nil || photo.UserId != user.Id {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if !app.canDownloadOriginals(currentUser, user) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	data, err := ReadPhotoOriginal(photo)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	format := photo.Format
+	if currentUser == nil || currentUser.Id != user.Id {
+		data, format, err = SanitizeMetadata(data, format, user.MetadataPrivacy)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", ImageFormatMimeTypes[format])
+	w.Header().Set("Cache-Control", "private")
+	http.ServeContent(w, r, "", photo.Tm, bytes.NewReader(data))
+}
+
+// Whether currentUser, nil if not signed in, may download the originals
+// of the photos of user, see OriginalsAccessNames.
+func (app *App) canDownloadOriginals(currentUser *User, user *User) bool {
+	if currentUser != nil && currentUser.Id == user.Id {
+		return true
+	}
+
+	switch user.OriginalsAccess {
+	case OriginalsEveryone:
+		return true
+	case OriginalsContacts:
+		if currentUser == nil {
+			return false
+		}
+		res, err := app.Contacts.IsContacted(user.Id, currentUser.Id)
+		return err == nil && res
+	}
+	return false
+}
+
+func (app *App) HandleAddFavorite(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -351,20 +623,20 @@ func HandleAddFavorite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	photo, err := GetPhotoById(photoId)
+	photo, err := app.Photos.GetById(photoId)
 	if err != nil || photo.UserId != user.Id {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
@@ -375,7 +647,7 @@ func HandleAddFavorite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := IsFavorited(currentUser.Id, photo.Id)
+	res, err := app.Favorites.IsFavorited(currentUser.Id, photo.Id)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
@@ -386,7 +658,7 @@ func HandleAddFavorite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = CreateFavorite(currentUser.Id, photo.Id)
+	_, err = app.Favorites.Create(currentUser.Id, photo.Id)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
@@ -395,7 +667,7 @@ func HandleAddFavorite(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
-func HandleDeleteFavorite(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleDeleteFavorite(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -410,20 +682,20 @@ func HandleDeleteFavorite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	photo, err := GetPhotoById(photoId)
+	photo, err := app.Photos.GetById(photoId)
 	if err != nil || photo.UserId != user.Id {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
@@ -434,27 +706,406 @@ func HandleDeleteFavorite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := IsFavorited(currentUser.Id, photo.Id)
+	res, err := app.Favorites.IsFavorited(currentUser.Id, photo.Id)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if !res {
+		fmt.Fprintln(w, "OK")
+		return
+	}
+
+	err = app.Favorites.Delete(currentUser.Id, photo.Id)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
+
+func (app *App) HandleDeletePhoto(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	photoIdStr := vars["photo"]
+	photoId, err := strconv.ParseInt(photoIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	currentUser := app.GetCurrentUser(r)
+
+	if currentUser == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.Users.GetByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	photo, err := app.Photos.GetById(photoId)
+	if err != nil || photo.UserId != user.Id {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if photo.UserId != currentUser.Id {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	// TODO: Remove images from disk first
+	err = app.Photos.Delete(photo.Id)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
+
+// Sets the frame of an animated photo its thumbnails are made from.
+// The thumbnails are made again by the workers, under a new RandId.
+func (app *App) HandlePosterFrame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	photoIdStr := vars["photo"]
+	photoId, err := strconv.ParseInt(photoIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	currentUser := app.GetCurrentUser(r)
+
+	if currentUser == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.Users.GetByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	photo, err := app.Photos.GetById(photoId)
+	if err != nil || photo.UserId != user.Id {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if photo.UserId != currentUser.Id {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	frame, err := strconv.Atoi(r.FormValue("frame"))
+	if err != nil || frame < 0 || frame >= photo.Frames {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if frame != photo.PosterFrame {
+		err = RenewPhotoRandId(photo, func(randId string) error {
+			return app.Photos.SetPosterFrame(photo.Id, frame, randId)
+		})
+		if err != nil {
+			log.Printf("ERROR: cannot set poster frame of photo %d: %v\n", photo.Id, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		photo.PosterFrame = frame
+
+		err = app.Jobs.EnqueuePhoto(photo)
+		if err != nil {
+			log.Printf("ERROR: cannot enqueue photo %d: %v\n", photo.Id, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fmt.Fprintln(w, "OK")
+}
+
+// Shows and saves the edits of a photo. The derivatives are made again
+// by the workers, under a new RandId. Animated photos can't be edited.
+func (app *App) HandleEditPhoto(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	username := vars["username"]
+	photoIdStr := vars["photo"]
+	photoId, err := strconv.ParseInt(photoIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	currentUser := app.GetCurrentUser(r)
+
+	if currentUser == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := app.Users.GetByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	photo, err := app.Photos.GetById(photoId)
+	if err != nil || photo.UserId != user.Id {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if photo.UserId != currentUser.Id {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if photo.IsAnimated() {
+		app.RenderError(w, currentUser, http.StatusBadRequest, "Animated photos can't be edited")
+		return
+	}
+
+	switch r.Method {
+
+	case "GET":
+
+		err = app.Tp.ExecuteTemplate(w, "edit.html",
+			struct {
+				CurrentUser *User
+				User        *User
+				Photo       *Photo
+				Form        *PhotoEditForm
+			}{
+				CurrentUser: currentUser,
+				User:        user,
+				Photo:       photo,
+				Form:        NewPhotoEditForm(photo.Edits),
+			},
+		)
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+	case "POST":
+
+		form, err := parsePhotoEditForm(r)
+		if err != nil {
+			app.RenderError(w, currentUser, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		edits, err := form.Edits()
+		if err != nil {
+			app.RenderError(w, currentUser, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		err = app.savePhotoEdits(photo, edits)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		photoPage := fmt.Sprintf("/photos/%s/%d/", user.Username, photo.Id)
+		http.Redirect(w, r, photoPage, http.StatusFound)
+
+	default:
+
+		http.Error(w, "Bad request", http.StatusBadRequest)
+
+	}
+}
+
+// Removes all the edits of a photo.
+func (app *App) HandleRevertPhoto(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	username := vars["username"]
+	photoIdStr := vars["photo"]
+	photoId, err := strconv.ParseInt(photoIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	currentUser := app.GetCurrentUser(r)
+
+	if currentUser == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.Users.GetByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	photo, err := app.Photos.GetById(photoId)
+	if err != nil || photo.UserId != user.Id {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if photo.UserId != currentUser.Id {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if len(photo.Edits) > 0 {
+		err = app.savePhotoEdits(photo, []PhotoEdit{})
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	photoPage := fmt.Sprintf("/photos/%s/%d/", user.Username, photo.Id)
+	http.Redirect(w, r, photoPage, http.StatusFound)
+}
+
+// Shows the versions of a photo and replaces its original with
+// an uploaded file.
+func (app *App) HandleReplacePhoto(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	username := vars["username"]
+	photoIdStr := vars["photo"]
+	photoId, err := strconv.ParseInt(photoIdStr, 10, 64)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	if !res {
-		fmt.Fprintln(w, "OK")
-		return
-	}
+	currentUser := app.GetCurrentUser(r)
+
+	if currentUser == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	user, err := app.Users.GetByUsername(username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	photo, err := app.Photos.GetById(photoId)
+	if err != nil || photo.UserId != user.Id {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if photo.UserId != currentUser.Id {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+
+	case "GET":
+
+		versions, err := app.Versions.GetByPhotoId(photo)
+		if err != nil {
+			log.Printf("ERROR: cannot get versions of photo %d: %v\n", photo.Id, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		err = app.Tp.ExecuteTemplate(w, "replace.html",
+			struct {
+				CurrentUser *User
+				User        *User
+				Photo       *Photo
+				Versions    []*PhotoVersion
+			}{
+				CurrentUser: currentUser,
+				User:        user,
+				Photo:       photo,
+				Versions:    versions,
+			},
+		)
+
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+	case "POST":
+
+		if !app.limitUploadBody(w, r, currentUser) {
+			return
+		}
+
+		photoFile, _, err := r.FormFile("photo_file")
+		if err != nil {
+			app.renderUploadError(w, currentUser, err)
+			return
+		}
+
+		data, err := ReadUpload(photoFile)
+		if err != nil {
+			app.renderUploadError(w, currentUser, err)
+			return
+		}
+
+		format, err := DetectImageFormat(data)
+		if err != nil {
+			app.RenderError(w, currentUser, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		err = app.Versions.Replace(photo, data, format)
+		if err != nil {
+			log.Printf("ERROR: cannot replace photo %d: %v\n", photo.Id, err)
+			http.Error(w, "Upload error", http.StatusInternalServerError)
+			return
+		}
+
+		err = app.Jobs.EnqueuePhoto(photo)
+		if err != nil {
+			log.Printf("ERROR: cannot enqueue photo %d: %v\n", photo.Id, err)
+		}
+
+		photoPage := fmt.Sprintf("/photos/%s/%d/", user.Username, photo.Id)
+		http.Redirect(w, r, photoPage, http.StatusFound)
 
-	err = DelFavorite(currentUser.Id, photo.Id)
-	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
-	}
+	default:
 
-	fmt.Fprintln(w, "OK")
+		http.Error(w, "Bad request", http.StatusBadRequest)
+
+	}
 }
 
-func HandleDeletePhoto(w http.ResponseWriter, r *http.Request) {
+// Makes a previous version of a photo the current one.
+func (app *App) HandleRollbackPhoto(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -462,27 +1113,31 @@ func HandleDeletePhoto(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	username := vars["username"]
-	photoIdStr := vars["photo"]
-	photoId, err := strconv.ParseInt(photoIdStr, 10, 64)
+	photoId, err := strconv.ParseInt(vars["photo"], 10, 64)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	versionId, err := strconv.ParseInt(vars["version"], 10, 64)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	photo, err := GetPhotoById(photoId)
+	photo, err := app.Photos.GetById(photoId)
 	if err != nil || photo.UserId != user.Id {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
@@ -493,17 +1148,76 @@ func HandleDeletePhoto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Remove images from disk first
-	err = DelPhotoById(photo.Id)
+	err = app.Versions.Rollback(photo, versionId)
 	if err != nil {
-		http.Error(w, "Server error", http.StatusInternalServerError)
+		log.Printf("ERROR: cannot roll back photo %d: %v\n", photo.Id, err)
+		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
 
-	fmt.Fprintln(w, "OK")
+	err = app.Jobs.EnqueuePhoto(photo)
+	if err != nil {
+		log.Printf("ERROR: cannot enqueue photo %d: %v\n", photo.Id, err)
+	}
+
+	photoPage := fmt.Sprintf("/photos/%s/%d/", user.Username, photo.Id)
+	http.Redirect(w, r, photoPage, http.StatusFound)
+}
+
+func parsePhotoEditForm(r *http.Request) (*PhotoEditForm, error) {
+	form := NewPhotoEditForm(nil)
+
+	rotate, err := strconv.Atoi(r.FormValue("rotate"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid rotation")
+	}
+	form.Rotate = rotate
+
+	fields := []struct {
+		name  string
+		value *float64
+	}{
+		{"straighten", &form.Straighten},
+		{"crop_x", &form.CropX},
+		{"crop_y", &form.CropY},
+		{"crop_width", &form.CropWidth},
+		{"crop_height", &form.CropHeight},
+		{"brightness", &form.Brightness},
+		{"contrast", &form.Contrast},
+		{"gamma", &form.Gamma},
+		{"saturation", &form.Saturation},
+	}
+	for _, f := range fields {
+		v, err := strconv.ParseFloat(r.FormValue(f.name), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s", strings.Replace(f.name, "_", " ", -1))
+		}
+		*f.value = v
+	}
+
+	return form, nil
+}
+
+// Stores the edits and has the derivatives made again.
+func (app *App) savePhotoEdits(photo *Photo, edits []PhotoEdit) error {
+	err := RenewPhotoRandId(photo, func(randId string) error {
+		return app.Photos.SetEdits(photo.Id, edits, randId)
+	})
+	if err != nil {
+		log.Printf("ERROR: cannot save edits of photo %d: %v\n", photo.Id, err)
+		return err
+	}
+	photo.Edits = edits
+
+	err = app.Jobs.EnqueuePhoto(photo)
+	if err != nil {
+		log.Printf("ERROR: cannot enqueue photo %d: %v\n", photo.Id, err)
+		return err
+	}
+	return nil
 }
 
-func HandleAddComment(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleAddComment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -518,27 +1232,27 @@ func HandleAddComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	photo, err := GetPhotoById(photoId)
+	photo, err := app.Photos.GetById(photoId)
 	if err != nil || photo.UserId != user.Id {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
 
 	commentText := r.FormValue("comment")
-	_, err = CreateComment(currentUser.Id, photo.Id, commentText)
+	_, err = app.Comments.Create(currentUser.Id, photo.Id, commentText)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
@@ -547,7 +1261,7 @@ func HandleAddComment(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
-func HandleDeleteComment(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleDeleteComment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -568,26 +1282,26 @@ func HandleDeleteComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	photo, err := GetPhotoById(photoId)
+	photo, err := app.Photos.GetById(photoId)
 	if err != nil || photo.UserId != user.Id {
 		http.Error(w, "Photo not found", http.StatusNotFound)
 		return
 	}
 
-	comment, err := GetCommentById(commentId)
+	comment, err := app.Comments.GetById(commentId)
 	if err != nil || comment.PhotoId != photo.Id {
 		http.Error(w, "Comment not found", http.StatusNotFound)
 		return
@@ -598,7 +1312,7 @@ func HandleDeleteComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = DelCommentById(commentId)
+	err = app.Comments.Delete(commentId)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
@@ -607,51 +1321,49 @@ func HandleDeleteComment(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
-func HandleUserFavorites(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleUserFavorites(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
-	pageStr := vars["page"]
-	page, err := strconv.ParseInt(pageStr, 10, 64)
-	if err != nil || page < 1 {
-		page = 1
-	}
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser != nil && currentUser.Username == "" {
 		http.Redirect(w, r, "/settings/", http.StatusFound)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	limit := 30
-	offset := (int(page) - 1) * limit
-	photos, err := GetFavoritePhotosByUserId(user.Id, offset, limit)
+	color := GetColorFilter(r)
+	page, err := app.Photos.GetFavorites(user.Id, color, GetPhotoCursor(r), PhotostreamPageSize)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	photosCount, err := GetFavoritesCountByUserId(user.Id)
+	photosCount, err := app.Favorites.CountByUserId(user.Id, color)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-	lastPage := int64(1 + photosCount/limit)
 
 	layout := GetLayout(r)
 	suffix := GetPhotoSuffixByLayout(layout)
 
+	var rows []*JustifiedRow
+	if layout == "J" {
+		rows = JustifyPhotos(page.Photos, JustifiedWidth, JustifiedRowHeight, JustifiedGap)
+	}
+
 	showAddContact := false
 	showDelContact := false
 
 	if currentUser != nil && currentUser.Id != user.Id {
-		res, err := IsContacted(currentUser.Id, user.Id)
+		res, err := app.Contacts.IsContacted(currentUser.Id, user.Id)
 		if err == nil {
 			if res {
 				showDelContact = true
@@ -661,33 +1373,40 @@ func HandleUserFavorites(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = Tp.ExecuteTemplate(w, "photostream.html",
+	err = app.Tp.ExecuteTemplate(w, "photostream.html",
 		struct {
 			PhotostreamType string
 			PhotostreamUrl  string
 			CurrentUser     *User
 			User            *User
 			Photos          []*Photo
-			Page            int64
-			PrevPage        int64
-			NextPage        int64
-			LastPage        int64
+			Rows            []*JustifiedRow
+			PhotosCount     int
+			Newer           string
+			Older           string
 			Layout          string
+			Order           string
+			Color           string
+			Colors          []string
 			PhotoSuffix     string
 			ShowAddContact  bool
 			ShowDelContact  bool
 			ShowPhotoAuthor bool
+			ShowDuplicates  bool
 		}{
 			PhotostreamType: "user-favorites",
 			PhotostreamUrl:  fmt.Sprintf("/favorites/%s/", user.Username),
 			CurrentUser:     currentUser,
 			User:            user,
-			Photos:          photos,
-			Page:            page,
-			PrevPage:        page - 1,
-			NextPage:        page + 1,
-			LastPage:        lastPage,
+			Photos:          page.Photos,
+			Rows:            rows,
+			PhotosCount:     photosCount,
+			Newer:           page.Newer,
+			Older:           page.Older,
 			Layout:          layout,
+			Order:           "",
+			Color:           color,
+			Colors:          PhotoColors,
 			PhotoSuffix:     suffix,
 			ShowAddContact:  showAddContact,
 			ShowDelContact:  showDelContact,
@@ -702,15 +1421,8 @@ func HandleUserFavorites(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandleContactsPhotos(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	pageStr := vars["page"]
-	page, err := strconv.ParseInt(pageStr, 10, 64)
-	if err != nil || page < 1 {
-		page = 1
-	}
-
-	currentUser := GetCurrentUser(r)
+func (app *App) HandleContactsPhotos(w http.ResponseWriter, r *http.Request) {
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -722,51 +1434,62 @@ func HandleContactsPhotos(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	limit := 30
-	offset := (int(page) - 1) * limit
-	photos, err := GetContactsPhotosByUserId(currentUser.Id, offset, limit)
+	order := GetPhotoOrder(r)
+	color := GetColorFilter(r)
+	page, err := app.Photos.GetContactsPhotos(currentUser.Id, order, color, GetPhotoCursor(r), PhotostreamPageSize)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
 
-	photosCount, err := GetContactsPhotosCountByUserId(currentUser.Id)
+	photosCount, err := app.Photos.CountContactsPhotos(currentUser.Id, color)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
 	}
-	lastPage := int64(1 + photosCount/limit)
 
 	layout := GetLayout(r)
 	suffix := GetPhotoSuffixByLayout(layout)
 
-	err = Tp.ExecuteTemplate(w, "photostream.html",
+	var rows []*JustifiedRow
+	if layout == "J" {
+		rows = JustifyPhotos(page.Photos, JustifiedWidth, JustifiedRowHeight, JustifiedGap)
+	}
+
+	err = app.Tp.ExecuteTemplate(w, "photostream.html",
 		struct {
 			PhotostreamType string
 			PhotostreamUrl  string
 			CurrentUser     *User
 			User            *User
 			Photos          []*Photo
-			Page            int64
-			PrevPage        int64
-			NextPage        int64
-			LastPage        int64
+			Rows            []*JustifiedRow
+			PhotosCount     int
+			Newer           string
+			Older           string
 			Layout          string
+			Order           string
+			Color           string
+			Colors          []string
 			PhotoSuffix     string
 			ShowAddContact  bool
 			ShowDelContact  bool
 			ShowPhotoAuthor bool
+			ShowDuplicates  bool
 		}{
 			PhotostreamType: "contacts-photos",
 			PhotostreamUrl:  "/contacts/photos/",
 			CurrentUser:     currentUser,
 			User:            currentUser,
-			Photos:          photos,
-			Page:            page,
-			PrevPage:        page - 1,
-			NextPage:        page + 1,
-			LastPage:        lastPage,
+			Photos:          page.Photos,
+			Rows:            rows,
+			PhotosCount:     photosCount,
+			Newer:           page.Newer,
+			Older:           page.Older,
 			Layout:          layout,
+			Order:           order,
+			Color:           color,
+			Colors:          PhotoColors,
 			PhotoSuffix:     suffix,
 			ShowAddContact:  false,
 			ShowDelContact:  false,
@@ -781,7 +1504,7 @@ func HandleContactsPhotos(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandleAddContact(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleAddContact(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -790,14 +1513,14 @@ func HandleAddContact(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -808,7 +1531,7 @@ func HandleAddContact(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := IsContacted(currentUser.Id, user.Id)
+	res, err := app.Contacts.IsContacted(currentUser.Id, user.Id)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
@@ -819,7 +1542,7 @@ func HandleAddContact(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = CreateContact(currentUser.Id, user.Id)
+	_, err = app.Contacts.Create(currentUser.Id, user.Id)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
@@ -828,7 +1551,7 @@ func HandleAddContact(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
-func HandleDeleteContact(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleDeleteContact(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -837,14 +1560,14 @@ func HandleDeleteContact(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
 
-	currentUser := GetCurrentUser(r)
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	user, err := app.Users.GetByUsername(username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -855,7 +1578,7 @@ func HandleDeleteContact(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := IsContacted(currentUser.Id, user.Id)
+	res, err := app.Contacts.IsContacted(currentUser.Id, user.Id)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
@@ -866,7 +1589,7 @@ func HandleDeleteContact(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = DelContact(currentUser.Id, user.Id)
+	err = app.Contacts.Delete(currentUser.Id, user.Id)
 	if err != nil {
 		http.Error(w, "Server error", http.StatusInternalServerError)
 		return
@@ -875,8 +1598,8 @@ func HandleDeleteContact(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
-func HandleUpload(w http.ResponseWriter, r *http.Request) {
-	currentUser := GetCurrentUser(r)
+func (app *App) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -892,7 +1615,7 @@ func HandleUpload(w http.ResponseWriter, r *http.Request) {
 
 	case "GET":
 
-		err := Tp.ExecuteTemplate(w, "upload.html",
+		err := app.Tp.ExecuteTemplate(w, "upload.html",
 			struct {
 				CurrentUser *User
 			}{
@@ -908,39 +1631,51 @@ func HandleUpload(w http.ResponseWriter, r *http.Request) {
 
 	case "POST":
 
+		if !app.limitUploadBody(w, r, currentUser) {
+			return
+		}
+
 		pTitle := r.FormValue("photo_title")
 		pDesc := r.FormValue("photo_description")
 
 		photoFile, _, err := r.FormFile("photo_file")
 		if err != nil {
-			http.Error(w, "Upload error", http.StatusBadRequest)
+			app.renderUploadError(w, currentUser, err)
 			return
 		}
 
-		data, err := ioutil.ReadAll(photoFile)
+		data, err := ReadUpload(photoFile)
 		if err != nil {
-			http.Error(w, "Upload error", http.StatusInternalServerError)
+			app.renderUploadError(w, currentUser, err)
+			return
+		}
+
+		format, err := DetectImageFormat(data)
+		if err != nil {
+			app.RenderError(w, currentUser, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		photo, err := CreatePhoto(currentUser.Id, pTitle, pDesc)
+		photo, err := app.Photos.Create(currentUser.Id, pTitle, pDesc, format)
 		if err != nil {
 			http.Error(w, "Upload error", http.StatusInternalServerError)
 			return
 		}
 
-		origPhotoPath := GetPhotoPath(photo, "o")
-		err = ioutil.WriteFile(origPhotoPath, data, 0777)
+		err = Store.Put(GetPhotoOriginalPath(photo), data)
 		if err != nil {
-			DelPhotoById(photo.Id)
+			app.Photos.Delete(photo.Id)
 			http.Error(w, "Upload error", http.StatusInternalServerError)
 			return
 		}
 
-		EnqueuePhoto(photo)
+		err = app.Jobs.EnqueuePhoto(photo)
+		if err != nil {
+			log.Printf("ERROR: cannot enqueue photo %d: %v\n", photo.Id, err)
+		}
 
-		userPhotoPage := fmt.Sprintf("/photos/%s/", currentUser.Username)
-		http.Redirect(w, r, userPhotoPage, http.StatusFound)
+		photoPage := fmt.Sprintf("/photos/%s/%d/", currentUser.Username, photo.Id)
+		http.Redirect(w, r, photoPage, http.StatusFound)
 
 	default:
 
@@ -949,8 +1684,8 @@ func HandleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandleSettings(w http.ResponseWriter, r *http.Request) {
-	currentUser := GetCurrentUser(r)
+func (app *App) HandleSettings(w http.ResponseWriter, r *http.Request) {
+	currentUser := app.GetCurrentUser(r)
 
 	if currentUser == nil {
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -961,11 +1696,15 @@ func HandleSettings(w http.ResponseWriter, r *http.Request) {
 
 	case "GET":
 
-		err := Tp.ExecuteTemplate(w, "settings.html",
+		err := app.Tp.ExecuteTemplate(w, "settings.html",
 			struct {
-				CurrentUser *User
+				CurrentUser          *User
+				MetadataPrivacyNames []MetadataPrivacyName
+				OriginalsAccessNames []OriginalsAccessName
 			}{
-				CurrentUser: currentUser,
+				CurrentUser:          currentUser,
+				MetadataPrivacyNames: MetadataPrivacyNames,
+				OriginalsAccessNames: OriginalsAccessNames,
 			},
 		)
 
@@ -977,11 +1716,15 @@ func HandleSettings(w http.ResponseWriter, r *http.Request) {
 
 	case "POST":
 
+		if !app.limitUploadBody(w, r, currentUser) {
+			return
+		}
+
 		username := r.FormValue("username")
 		if currentUser.Username == "" && username != "" {
 			matched, _ := regexp.MatchString("^[a-z0-9_]{3,30}$", username)
 			if matched {
-				_, err := GetUserByUsername(username)
+				_, err := app.Users.GetByUsername(username)
 				if err.Error() == "User not found" {
 					currentUser.Username = username
 				}
@@ -991,16 +1734,37 @@ func HandleSettings(w http.ResponseWriter, r *http.Request) {
 		realName := r.FormValue("realname")
 		currentUser.RealName = realName
 
-		UpdateUser(currentUser)
+		metadataPrivacy := r.FormValue("metadata_privacy")
+		if IsValidMetadataPrivacy(metadataPrivacy) {
+			currentUser.MetadataPrivacy = metadataPrivacy
+		}
+
+		originalsAccess := r.FormValue("originals_access")
+		if IsValidOriginalsAccess(originalsAccess) {
+			currentUser.OriginalsAccess = originalsAccess
+		}
+
+		app.Users.Update(currentUser)
 
 		avFile, _, err := r.FormFile("avatar_file")
 		if err == nil {
-			data, err := ioutil.ReadAll(avFile)
+			data, err := ReadUpload(avFile)
+			if err != nil {
+				app.renderUploadError(w, currentUser, err)
+				return
+			}
+
+			_, err = DetectImageFormat(data)
+			if err != nil {
+				app.RenderError(w, currentUser, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			err = Store.Put(GetAvatarOriginalPath(currentUser), data)
 			if err == nil {
-				origAvPath := GetAvatarPath(currentUser, "o")
-				err = ioutil.WriteFile(origAvPath, data, 0777)
-				if err == nil {
-					EnqueueAvatar(currentUser)
+				err = app.Jobs.EnqueueAvatar(currentUser)
+				if err != nil {
+					log.Printf("ERROR: cannot enqueue avatar %d: %v\n", currentUser.Id, err)
 				}
 			}
 		}
@@ -1014,7 +1778,61 @@ func HandleSettings(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func HandleLogin(w http.ResponseWriter, r *http.Request) {
+// Limits the body of an upload request, so that a huge request doesn't
+// fill the memory or the disk while the form is parsed, and parses
+// the form. Requests that declare a larger size are rejected right away,
+// chunked ones once the limit is reached; returns false then, or if
+// the form can't be parsed, so that no field of a truncated form is used.
+func (app *App) limitUploadBody(w http.ResponseWriter, r *http.Request, currentUser *User) bool {
+	// Some room for the other form fields.
+	maxSize := GetMaxUploadSize() + 1024*1024
+
+	if r.ContentLength > maxSize {
+		app.renderUploadError(w, currentUser, &UploadTooLargeError{Limit: GetMaxUploadSize()})
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+
+	// Same memory limit as r.FormValue.
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		app.renderUploadError(w, currentUser, err)
+		return false
+	}
+	return true
+}
+
+func (app *App) renderUploadError(w http.ResponseWriter, currentUser *User, err error) {
+	if IsUploadTooLarge(err) {
+		app.RenderError(w, currentUser, http.StatusRequestEntityTooLarge,
+			(&UploadTooLargeError{Limit: GetMaxUploadSize()}).Error())
+		return
+	}
+	log.Printf("ERROR: cannot read upload: %v\n", err)
+	app.RenderError(w, currentUser, http.StatusBadRequest, "Upload error")
+}
+
+// Shows an error page with a message for the user.
+func (app *App) RenderError(w http.ResponseWriter, currentUser *User, status int, message string) {
+	w.WriteHeader(status)
+
+	err := app.Tp.ExecuteTemplate(w, "error.html",
+		struct {
+			CurrentUser *User
+			Message     string
+		}{
+			CurrentUser: currentUser,
+			Message:     message,
+		},
+	)
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (app *App) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -1056,9 +1874,9 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserByPersona(data.Email)
+	user, err := app.Users.GetByPersona(data.Email)
 	if err != nil {
-		user, err = CreatePersonaUser(data.Email)
+		user, err = app.Users.CreatePersona(data.Email)
 		if err != nil {
 			http.Error(w, "Authentication error", http.StatusInternalServerError)
 			return
@@ -1071,11 +1889,11 @@ func HandleLogin(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	SetCurrentUser(w, user)
+	app.SetCurrentUser(w, user)
 	fmt.Fprintln(w, "OK")
 }
 
-func HandleLogout(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
@@ -1085,16 +1903,316 @@ func HandleLogout(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "OK")
 }
 
+// Lists the pairs of near-identical photos of the current user.
+func (app *App) HandleDuplicates(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	username := vars["username"]
+
+	currentUser := app.GetCurrentUser(r)
+
+	if currentUser == nil || currentUser.Username != username {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	pairs, err := app.Photos.GetDuplicatePairs(currentUser.Id, time.Time{}, 100)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Tp.ExecuteTemplate(w, "duplicates.html",
+		struct {
+			CurrentUser *User
+			Pairs       []*DuplicatePair
+		}{
+			CurrentUser: currentUser,
+			Pairs:       pairs,
+		},
+	)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (app *App) HandleDeadJobs(w http.ResponseWriter, r *http.Request) {
+	currentUser := app.GetCurrentUser(r)
+
+	if currentUser == nil || !currentUser.IsAdmin() {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	jobs, err := app.Jobs.GetDead()
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Tp.ExecuteTemplate(w, "jobs.html",
+		struct {
+			CurrentUser *User
+			Jobs        []*Job
+		}{
+			CurrentUser: currentUser,
+			Jobs:        jobs,
+		},
+	)
+
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (app *App) HandleRequeueJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	jobIdStr := vars["id"]
+	jobId, err := strconv.ParseInt(jobIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	currentUser := app.GetCurrentUser(r)
+
+	if currentUser == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !currentUser.IsAdmin() {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	job, err := app.Jobs.GetById(jobId)
+	if err != nil || job.State != JobStateDead {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	err = app.Jobs.RequeueDead(job)
+	if err != nil {
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "OK")
+}
+
+// Photo derivatives are served by HandleImage, which picks the format.
+func GetPhotoUrl(photo *Photo, suffix string) string {
+	return fmt.Sprintf("/img/%d/%s/%s.%s", photo.Id, photo.RandId, suffix, photo.SuffixExt(suffix))
+}
+
+// Returns the color photo listings are filtered by, from the "color"
+// query parameter, or "" for no filter.
+func GetColorFilter(r *http.Request) string {
+	color := r.URL.Query().Get("color")
+	if IsPhotoColor(color) {
+		return color
+	}
+	return ""
+}
+
+// Returns the position in a photostream given by the "older" or "newer"
+// query parameter, or the first page.
+func GetPhotoCursor(r *http.Request) PhotoCursor {
+	query := r.URL.Query()
+	if cursor, err := ParsePhotoCursor(query.Get("older")); err == nil {
+		return cursor
+	}
+	if cursor, err := ParsePhotoCursor(query.Get("newer")); err == nil {
+		cursor.Newer = true
+		return cursor
+	}
+	return PhotoCursor{}
+}
+
+// How long HandleImage waits for the workers to make a size on demand
+// before it answers 202 Accepted and lets the client retry.
+const ImageWaitTimeout = 10 * time.Second
+
+// Seconds after which clients retry the sizes that are not ready.
+const ImageRetryAfter = "5"
+
+// Redirects to photo derivatives in the storage, so that their bytes don't
+// go through the web nodes. Browsers that accept WebP get the WebP version
+// if there is one, others get the JPEG or PNG one. Animated photos have
+// GIF derivatives, which are served as they are. Sizes that are not
+// pre-generated, and all the sizes of the previous versions of photos,
+// are made by the workers on first request, see EnqueuePhotoDerivative.
+func (app *App) HandleImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(r)
+	photoIdStr := vars["photo"]
+	photoId, err := strconv.ParseInt(photoIdStr, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	suffix := vars["suffix"]
+	if _, ok := GetPhotoSize(suffix); !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	ext := vars["ext"]
+	acceptsWebp := strings.Contains(r.Header.Get("Accept"), "image/webp") && ext != "gif"
+
+	w.Header().Set("Vary", "Accept")
+
+	// Pre-generated sizes. Their files never change (a new file gets
+	// a new name), so the redirects can be cached forever.
+
+	photo := &Photo{Id: photoId, RandId: vars["rand"], Ext: ext}
+
+	keys := []string{GetPhotoPath(photo, suffix)}
+	if acceptsWebp {
+		keys = append([]string{GetPhotoWebpPath(photo, suffix)}, keys...)
+	}
+
+	for _, key := range keys {
+		if redirectToStoredFile(w, r, key, "public, max-age=31536000") {
+			return
+		}
+	}
+
+	// On-demand sizes. They expire, so the redirects are not cached.
+
+	photo, err = app.Photos.GetById(photoId)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if photo.RandId != vars["rand"] {
+		version, err := app.Versions.GetByRandId(photo, vars["rand"])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		photo = version.Photo
+	}
+
+	if photo.SuffixExt(suffix) != ext {
+		http.NotFound(w, r)
+		return
+	}
+
+	format := ext
+	if acceptsWebp {
+		format = "webp"
+	}
+
+	key := GetPhotoCachePath(photo, suffix, format)
+	if redirectToStoredFile(w, r, key, "no-cache") {
+		if ImgCache != nil {
+			ImgCache.Touch(key)
+		}
+		return
+	}
+
+	// Start watching before the job is enqueued, so that its completion
+	// can't be missed. Web nodes that are not notified by the workers
+	// don't wait at all.
+	var ready chan bool
+	if CanWaitForDerivatives() {
+		var unwatch func()
+		ready, unwatch = watchDerivative(key)
+		defer unwatch()
+	}
+
+	err = app.Jobs.EnqueuePhotoDerivative(photo, suffix, format)
+	if err != nil {
+		log.Printf("ERROR: cannot enqueue image %s: %v\n", key, err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+
+	if ready != nil {
+		// The job may have been done between the first check and watching.
+		if redirectToStoredFile(w, r, key, "no-cache") {
+			return
+		}
+
+		timeout := time.After(ImageWaitTimeout)
+	wait:
+		for {
+			select {
+			case <-ready:
+				if redirectToStoredFile(w, r, key, "no-cache") {
+					return
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Retry-After", ImageRetryAfter)
+	http.Error(w, "Image is not ready", http.StatusAccepted)
+}
+
+// Redirects to the URL of a file in the storage. Returns false if there's
+// no such file. Conditional requests are left to the server of the file.
+func redirectToStoredFile(w http.ResponseWriter, r *http.Request, key string, cacheControl string) bool {
+	_, err := Store.Stat(key)
+	if err != nil {
+		if !IsStorageNotFound(err) {
+			log.Printf("ERROR: cannot stat %s: %v\n", key, err)
+		}
+		return false
+	}
+
+	w.Header().Set("Cache-Control", cacheControl)
+	http.Redirect(w, r, Store.URL(key), http.StatusFound)
+	return true
+}
+
+// Serves the static files and the files of LocalStorage. Files under
+// the Private prefixes are not served, files under the Immutable ones
+// never change and can be cached forever.
 type StaticFileHandler struct {
 	StaticDir string
+	Private   []string
+	Immutable []string
 }
 
 func (h *StaticFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" || r.Method == "HEAD" {
 		pth := filepath.Join(h.StaticDir, r.URL.Path)
 
+		for _, private := range h.Private {
+			if strings.HasPrefix(pth, filepath.Join(h.StaticDir, private)) {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
 		if stat, err := os.Stat(pth); err == nil {
 			if stat.Mode().IsRegular() {
+				for _, immutable := range h.Immutable {
+					if strings.HasPrefix(pth, filepath.Join(h.StaticDir, immutable)) {
+						w.Header().Set("Cache-Control", "public, max-age=31536000")
+					}
+				}
 				http.ServeFile(w, r, pth)
 				return
 			}
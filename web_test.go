@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The handlers run against the memory stores and a local storage
+// in a temporary directory.
+func newTestApp(t *testing.T) (*App, *mux.Router) {
+	tp, err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := Store
+	Store = &LocalStorage{Dir: t.TempDir() + "/", UrlPrefix: "/static/"}
+	t.Cleanup(func() { Store = store })
+
+	app := &App{
+		Stores: NewMemoryStores(),
+		Tp:     tp,
+		Sc:     NewSecureCookie(),
+	}
+	return app, app.Router()
+}
+
+func createTestUser(t *testing.T, app *App, username string) *User {
+	user, err := app.Users.CreatePersona(username + "@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Username = username
+	err = app.Users.Update(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// Creates a photo with an original in the storage.
+func createTestPhoto(t *testing.T, app *App, user *User) *Photo {
+	photo, err := app.Photos.Create(user.Id, "Test", "", "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Store.Put(GetPhotoOriginalPath(photo), testPng(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return photo
+}
+
+func testPng(t *testing.T) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, solidImage(testColor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Serves a request, signed in as user if it's not nil.
+func serveTestRequest(t *testing.T, app *App, router *mux.Router, r *http.Request, user *User) *httptest.ResponseRecorder {
+	if user != nil {
+		value, err := app.Sc.Encode("user", strconv.FormatInt(user.Id, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.AddCookie(&http.Cookie{Name: "user", Value: value})
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func newUploadRequest(t *testing.T, url string, data []byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("photo_file", "photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+
+	r := httptest.NewRequest("POST", url, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func getTestJobs(t *testing.T, app *App, kind string, targetId int64) []*Job {
+	result := []*Job{}
+	for _, job := range app.Jobs.(*MemJobStore).data.jobs {
+		if job.Kind == kind && job.TargetId == targetId {
+			result = append(result, job)
+		}
+	}
+	return result
+}
+
+func checkRedirect(t *testing.T, w *httptest.ResponseRecorder, location string) {
+	t.Helper()
+	if w.Code != http.StatusFound || w.Header().Get("Location") != location {
+		t.Fatalf("got %d to %q, want %d to %q: %s", w.Code, w.Header().Get("Location"), http.StatusFound, location, w.Body)
+	}
+}
+
+func TestHandleReplaceAndRollbackPhoto(t *testing.T) {
+	app, router := newTestApp(t)
+	user := createTestUser(t, app, "alice")
+	photo := createTestPhoto(t, app, user)
+	photoPage := fmt.Sprintf("/photos/alice/%d/", photo.Id)
+
+	w := serveTestRequest(t, app, router, newUploadRequest(t, photoPage+"replace/", testPng(t)), user)
+	checkRedirect(t, w, photoPage)
+
+	replaced, err := app.Photos.GetById(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.RandId == photo.RandId {
+		t.Error("replace: the RandId didn't change")
+	}
+	if _, err := StorageReadFile(GetPhotoOriginalPath(replaced)); err != nil {
+		t.Errorf("replace: %v", err)
+	}
+	jobs := getTestJobs(t, app, JobKindPhoto, photo.Id)
+	if len(jobs) != 1 {
+		t.Fatalf("replace: %d photo jobs, want 1", len(jobs))
+	}
+	// Claimed by a worker, the rollback needs another job.
+	jobs[0].State = JobStateRunning
+
+	versions, err := app.Versions.GetByPhotoId(replaced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Photo.RandId != photo.RandId {
+		t.Fatalf("replace: got %d versions, want the replaced photo", len(versions))
+	}
+
+	w = serveTestRequest(t, app, router, httptest.NewRequest("GET", photoPage+"replace/", nil), user)
+	rollback := fmt.Sprintf("%sversions/%d/rollback/", photoPage, versions[0].Id)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), rollback) {
+		t.Errorf("replace page: got %d, want a form to %s", w.Code, rollback)
+	}
+
+	// Only the owner can roll back.
+	other := createTestUser(t, app, "bob")
+	w = serveTestRequest(t, app, router, httptest.NewRequest("POST", rollback, nil), other)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("rollback by another user: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = serveTestRequest(t, app, router, httptest.NewRequest("POST", rollback, nil), user)
+	checkRedirect(t, w, photoPage)
+
+	restored, err := app.Photos.GetById(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.RandId != photo.RandId {
+		t.Errorf("rollback: got RandId %s, want %s", restored.RandId, photo.RandId)
+	}
+	versions, err = app.Versions.GetByPhotoId(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Photo.RandId != replaced.RandId {
+		t.Errorf("rollback: got %d versions, want the replacement", len(versions))
+	}
+	if n := len(getTestJobs(t, app, JobKindPhoto, photo.Id)); n != 2 {
+		t.Errorf("rollback: %d photo jobs, want 2", n)
+	}
+
+	w = serveTestRequest(t, app, router, httptest.NewRequest("POST", rollback, nil), user)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("rollback of a rolled back version: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleRevertPhoto(t *testing.T) {
+	app, router := newTestApp(t)
+	user := createTestUser(t, app, "alice")
+	photo := createTestPhoto(t, app, user)
+	photoPage := fmt.Sprintf("/photos/alice/%d/", photo.Id)
+
+	err := app.Photos.SetEdits(photo.Id, []PhotoEdit{{Op: EditRotate, Value: 90}}, photo.RandId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveTestRequest(t, app, router, httptest.NewRequest("POST", photoPage+"edit/revert/", nil), user)
+	checkRedirect(t, w, photoPage)
+
+	reverted, err := app.Photos.GetById(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted.Edits) != 0 {
+		t.Errorf("got %d edits, want none", len(reverted.Edits))
+	}
+	if reverted.RandId == photo.RandId {
+		t.Error("the RandId didn't change")
+	}
+	if _, err := StorageReadFile(GetPhotoOriginalPath(reverted)); err != nil {
+		t.Error(err)
+	}
+	if n := len(getTestJobs(t, app, JobKindPhoto, photo.Id)); n != 1 {
+		t.Errorf("%d photo jobs, want 1", n)
+	}
+}
+
+func TestHandleDeletePhoto(t *testing.T) {
+	app, router := newTestApp(t)
+	user := createTestUser(t, app, "alice")
+	photo := createTestPhoto(t, app, user)
+	kept := createTestPhoto(t, app, user)
+
+	for _, p := range []*Photo{photo, kept} {
+		err := app.Versions.Replace(p, testPng(t), "png")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	del := fmt.Sprintf("/photos/alice/%d/del/", photo.Id)
+	w := serveTestRequest(t, app, router, httptest.NewRequest("POST", del, nil), user)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	if _, err := app.Photos.GetById(photo.Id); err == nil {
+		t.Error("the photo was not deleted")
+	}
+	for _, v := range app.Photos.(*MemPhotoStore).data.versions {
+		if v.PhotoId == photo.Id {
+			t.Errorf("version %d of the deleted photo was kept", v.Id)
+		}
+	}
+	versions, err := app.Versions.GetByPhotoId(kept)
+	if err != nil || len(versions) != 1 {
+		t.Errorf("got %d versions of the other photo, %v", len(versions), err)
+	}
+}
+
+func TestHandleEditPhoto(t *testing.T) {
+	app, router := newTestApp(t)
+	user := createTestUser(t, app, "alice")
+	photo := createTestPhoto(t, app, user)
+	photoPage := fmt.Sprintf("/photos/alice/%d/", photo.Id)
+
+	form := url.Values{
+		"rotate": {"90"}, "straighten": {"0"},
+		"crop_x": {"0"}, "crop_y": {"0"}, "crop_width": {"100"}, "crop_height": {"100"},
+		"brightness": {"0"}, "contrast": {"0"}, "gamma": {"1"}, "saturation": {"0"},
+	}
+	newEditRequest := func() *http.Request {
+		r := httptest.NewRequest("POST", photoPage+"edit/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	// Without an original there's no new RandId, the edits are not saved.
+	original := GetPhotoOriginalPath(photo)
+	data, err := StorageReadFile(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Store.Delete(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serveTestRequest(t, app, router, newEditRequest(), user)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("no original: got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	failed, err := app.Photos.GetById(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed.Edits) != 0 || failed.RandId != photo.RandId {
+		t.Errorf("no original: got %d edits and RandId %s", len(failed.Edits), failed.RandId)
+	}
+
+	err = Store.Put(original, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serveTestRequest(t, app, router, newEditRequest(), user)
+	checkRedirect(t, w, photoPage)
+
+	edited, err := app.Photos.GetById(photo.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edited.Edits) != 1 || edited.Edits[0].Op != EditRotate || edited.RandId == photo.RandId {
+		t.Errorf("got edits %+v and RandId %s, want the rotation under a new RandId", edited.Edits, edited.RandId)
+	}
+	if _, err := StorageReadFile(GetPhotoOriginalPath(edited)); err != nil {
+		t.Error(err)
+	}
+	if n := len(getTestJobs(t, app, JobKindPhoto, photo.Id)); n != 1 {
+		t.Errorf("%d photo jobs, want 1", n)
+	}
+}
+
+func TestHandleImageVersion(t *testing.T) {
+	app, router := newTestApp(t)
+	user := createTestUser(t, app, "alice")
+	photo := createTestPhoto(t, app, user)
+
+	err := app.Versions.Replace(photo, testPng(t), "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := app.Versions.GetByPhotoId(photo)
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got %d versions, %v", len(versions), err)
+	}
+
+	key := GetPhotoCachePath(versions[0].Photo, "t50", "jpg")
+	err = Store.Put(key, []byte("jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageUrl := fmt.Sprintf("/img/%d/%s/t50.jpg", photo.Id, versions[0].Photo.RandId)
+	w := serveTestRequest(t, app, router, httptest.NewRequest("GET", imageUrl, nil), nil)
+	checkRedirect(t, w, Store.URL(key))
+	if cc := w.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("got Cache-Control %q, want no-cache", cc)
+	}
+
+	imageUrl = fmt.Sprintf("/img/%d/%s/t50.jpg", photo.Id, "unknown")
+	w = serveTestRequest(t, app, router, httptest.NewRequest("GET", imageUrl, nil), nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown RandId: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandleImageOnDemand(t *testing.T) {
+	app, router := newTestApp(t)
+	user := createTestUser(t, app, "alice")
+	photo := createTestPhoto(t, app, user)
+
+	notified := atomic.LoadInt32(&derivativesNotified)
+	t.Cleanup(func() { atomic.StoreInt32(&derivativesNotified, notified) })
+
+	ext := photo.SuffixExt("t50")
+	key := GetPhotoCachePath(photo, "t50", ext)
+	imageUrl := fmt.Sprintf("/img/%d/%s/t50.%s", photo.Id, photo.RandId, ext)
+
+	// Nothing notifies this node: the request is answered at once.
+	atomic.StoreInt32(&derivativesNotified, 0)
+	for i := 0; i < 2; i++ {
+		w := serveTestRequest(t, app, router, httptest.NewRequest("GET", imageUrl, nil), nil)
+		if w.Code != http.StatusAccepted || w.Header().Get("Retry-After") != ImageRetryAfter {
+			t.Errorf("not notified: got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	if n := len(getTestJobs(t, app, JobKindDerivative, photo.Id)); n != 1 {
+		t.Errorf("%d derivative jobs, want 1", n)
+	}
+
+	// The request waits until the derivative is stored.
+	atomic.StoreInt32(&derivativesNotified, 1)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveTestRequest(t, app, router, httptest.NewRequest("GET", imageUrl, nil), nil)
+	}()
+
+	for waiting := false; !waiting; {
+		time.Sleep(10 * time.Millisecond)
+		derivativeWaitersMu.Lock()
+		waiting = len(derivativeWaiters[key]) > 0
+		derivativeWaitersMu.Unlock()
+	}
+
+	// Other derivatives don't answer the request.
+	derivativeReady(GetPhotoCachePath(photo, "t100", ext))
+
+	err := Store.Put(key, []byte("jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	derivativeReady(key)
+
+	select {
+	case w := <-done:
+		checkRedirect(t, w, Store.URL(key))
+	case <-time.After(ImageWaitTimeout / 2):
+		t.Fatal("the request is still waiting")
+	}
+
+	derivativeWaitersMu.Lock()
+	if len(derivativeWaiters[key]) != 0 {
+		t.Errorf("%d waiters left", len(derivativeWaiters[key]))
+	}
+	derivativeWaitersMu.Unlock()
+}
+
+func TestHandleDeadJobs(t *testing.T) {
+	app, router := newTestApp(t)
+	user := createTestUser(t, app, "alice")
+	admin := createTestUser(t, app, "admin")
+	photo := createTestPhoto(t, app, user)
+
+	admins := os.Getenv("ADMINS")
+	os.Setenv("ADMINS", "admin")
+	t.Cleanup(func() { os.Setenv("ADMINS", admins) })
+
+	err := app.Jobs.EnqueuePhoto(photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := getTestJobs(t, app, JobKindPhoto, photo.Id)[0]
+	err = app.Jobs.(*MemJobStore).Fail(job.Id, "cannot decode")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveTestRequest(t, app, router, httptest.NewRequest("GET", "/admin/jobs/", nil), user)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("jobs page for a user: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = serveTestRequest(t, app, router, httptest.NewRequest("GET", "/admin/jobs/", nil), admin)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "cannot decode") {
+		t.Errorf("jobs page: got %d, want the dead job", w.Code)
+	}
+
+	requeue := fmt.Sprintf("/admin/jobs/%d/requeue/", job.Id)
+	w = serveTestRequest(t, app, router, httptest.NewRequest("POST", requeue, nil), admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("requeue: got %d: %s", w.Code, w.Body)
+	}
+	requeued, err := app.Jobs.GetById(job.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued.State != JobStatePending || requeued.LastError != "" {
+		t.Errorf("requeue: got state %s and error %q", requeued.State, requeued.LastError)
+	}
+
+	w = serveTestRequest(t, app, router, httptest.NewRequest("POST", requeue, nil), admin)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("requeue of a pending job: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestHandlePageNumber(t *testing.T) {
+	app, router := newTestApp(t)
+	user := createTestUser(t, app, "alice")
+
+	// Two and a half pages, newest first.
+	photos := make([]*Photo, 0, 75)
+	for i := 0; i < 75; i++ {
+		photo, err := app.Photos.Create(user.Id, "Test", "", "jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.Photos.(*MemPhotoStore).SetProcessed(photo.Id, 1)
+		photos = append([]*Photo{photo}, photos...)
+	}
+
+	for _, test := range []struct {
+		url   string
+		first *Photo // of the page redirected to, nil for the first page
+	}{
+		{"/photos/alice/page/1/", nil},
+		{"/photos/alice/page/2/", photos[30]},
+		{"/photos/alice/page/3/?layout=S", photos[60]},
+		{"/photos/alice/page/4/", nil},
+	} {
+		w := serveTestRequest(t, app, router, httptest.NewRequest("GET", test.url, nil), nil)
+		if w.Code != http.StatusFound && w.Code != http.StatusMovedPermanently {
+			t.Errorf("%s: got %d, want a redirect", test.url, w.Code)
+			continue
+		}
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.Path != "/photos/alice/" {
+			t.Errorf("%s: redirected to %s", test.url, location)
+		}
+		if strings.Contains(test.url, "layout=S") && location.Query().Get("layout") != "S" {
+			t.Errorf("%s: the query was not kept: %s", test.url, location)
+		}
+
+		cursor, err := ParsePhotoCursor(location.Query().Get("older"))
+		if test.first == nil {
+			if err == nil {
+				t.Errorf("%s: got a cursor, want the first page", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+
+		page, err := app.Photos.GetByUserId(user.Id, PhotoOrderUploaded, "", cursor, PhotostreamPageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Photos) == 0 || page.Photos[0].Id != test.first.Id {
+			t.Errorf("%s: the page doesn't start at photo %d", test.url, test.first.Id)
+		}
+	}
+
+	w := serveTestRequest(t, app, router, httptest.NewRequest("GET", "/contacts/photos/page/2/", nil), nil)
+	checkRedirect(t, w, "/")
+}
+
+func TestHandleOriginal(t *testing.T) {
+	app, router := newTestApp(t)
+	owner := createTestUser(t, app, "alice")
+	contact := createTestUser(t, app, "bob")
+	other := createTestUser(t, app, "carol")
+	photo := createTestPhoto(t, app, owner)
+
+	_, err := app.Contacts.Create(owner.Id, contact.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	photoPage := fmt.Sprintf("/photos/alice/%d/", photo.Id)
+	for _, test := range []struct {
+		access string
+		user   *User
+		want   bool
+	}{
+		{OriginalsOwner, owner, true},
+		{OriginalsOwner, contact, false},
+		{OriginalsOwner, nil, false},
+		{OriginalsContacts, contact, true},
+		{OriginalsContacts, other, false},
+		{OriginalsContacts, nil, false},
+		{OriginalsEveryone, other, true},
+		{OriginalsEveryone, nil, true},
+	} {
+		owner.OriginalsAccess = test.access
+		err := app.Users.Update(owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "anonymous"
+		if test.user != nil {
+			name = test.user.Username
+		}
+
+		w := serveTestRequest(t, app, router, httptest.NewRequest("GET", photoPage+"original/", nil), test.user)
+		if test.want && w.Code != http.StatusOK {
+			t.Errorf("%s, %s: got %d, want the original", test.access, name, w.Code)
+		} else if !test.want && w.Code != http.StatusForbidden {
+			t.Errorf("%s, %s: got %d, want %d", test.access, name, w.Code, http.StatusForbidden)
+		}
+
+		w = serveTestRequest(t, app, router, httptest.NewRequest("GET", photoPage, nil), test.user)
+		if w.Code != http.StatusOK {
+			t.Fatalf("photo page: got %d", w.Code)
+		}
+		if strings.Contains(w.Body.String(), photoPage+"original/") != test.want {
+			t.Errorf("%s, %s: the photo page doesn't link the original as it should", test.access, name)
+		}
+	}
+}